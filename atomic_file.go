@@ -0,0 +1,165 @@
+package base
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+var (
+	// ErrAtomicFileTooLarge is the category of the error returned by
+	// AtomicFile.Write when the contents would exceed the maximum size.
+	ErrAtomicFileTooLarge = errors.New("atomic file too large")
+
+	// ErrAtomicFileFinished is returned by the AtomicFile operations after
+	// Commit or Abort have been called.
+	ErrAtomicFileFinished = errors.New("atomic file already committed or aborted")
+)
+
+// An AtomicFile is an io.WriteCloser that makes a whole file appear
+// atomically. The contents are written into a temporary file in the same
+// directory as the destination, which is only renamed into place when Commit
+// is called. If the process crashes or the file is closed without being
+// committed, the destination is left untouched. All operations are
+// thread-safe.
+type AtomicFile struct {
+	path    string
+	maxSize Byte
+
+	lock     sync.Mutex
+	file     *os.File
+	size     Byte
+	finished bool
+}
+
+var _ io.WriteCloser = &AtomicFile{}
+
+// NewAtomicFile creates a temporary file that will be renamed to path once
+// committed. If maxSize is positive, writes that would make the file larger
+// than maxSize fail with an error of category ErrAtomicFileTooLarge.
+func NewAtomicFile(path string, mode os.FileMode, maxSize Byte) (*AtomicFile, error) {
+	dir, base := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+	file, err := ioutil.TempFile(dir, "."+base+".tmp*")
+	if err != nil {
+		return nil, err
+	}
+	if err := file.Chmod(mode); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+	return &AtomicFile{
+		path:    path,
+		maxSize: maxSize,
+		file:    file,
+	}, nil
+}
+
+// Write writes the bytes into the temporary file. If the write would exceed
+// the maximum size, nothing is written and an error of category
+// ErrAtomicFileTooLarge is returned.
+func (f *AtomicFile) Write(b []byte) (int, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.finished {
+		return 0, ErrAtomicFileFinished
+	}
+	if f.maxSize > 0 && f.size+Byte(len(b)) > f.maxSize {
+		return 0, ErrorWithCategory(
+			ErrAtomicFileTooLarge,
+			fmt.Errorf("writing %d bytes would exceed the limit of %d bytes", len(b), f.maxSize.Bytes()),
+		)
+	}
+	n, err := f.file.Write(b)
+	f.size += Byte(n)
+	return n, err
+}
+
+// WriteString is like Write, but writes the contents of string s rather than a
+// slice of bytes.
+func (f *AtomicFile) WriteString(s string) (int, error) {
+	return f.Write([]byte(s))
+}
+
+// Size returns the number of bytes that have been written so far.
+func (f *AtomicFile) Size() Byte {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.size
+}
+
+// Commit flushes the temporary file to stable storage, renames it to its
+// final path and flushes the directory so that the rename is also durable.
+// If any of these steps fail, the temporary file is removed.
+func (f *AtomicFile) Commit() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.finished {
+		return ErrAtomicFileFinished
+	}
+	f.finished = true
+
+	tempPath := f.file.Name()
+	if err := f.file.Sync(); err != nil {
+		f.file.Close()
+		os.Remove(tempPath)
+		return err
+	}
+	if err := f.file.Close(); err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+	if err := os.Rename(tempPath, f.path); err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+	return syncDir(filepath.Dir(f.path))
+}
+
+// Abort discards the temporary file. The destination is left untouched.
+func (f *AtomicFile) Abort() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.finished {
+		return ErrAtomicFileFinished
+	}
+	f.finished = true
+
+	tempPath := f.file.Name()
+	closeErr := f.file.Close()
+	if err := os.Remove(tempPath); err != nil {
+		return err
+	}
+	return closeErr
+}
+
+// Close aborts the file if it has not been committed yet. It is safe to call
+// Close after Commit or Abort, so it can be deferred right after creating the
+// file.
+func (f *AtomicFile) Close() error {
+	err := f.Abort()
+	if err == ErrAtomicFileFinished {
+		return nil
+	}
+	return err
+}
+
+// syncDir flushes the directory entry changes to stable storage.
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
@@ -0,0 +1,86 @@
+package base
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+func TestAtomicFile(t *testing.T) {
+	dirname, err := ioutil.TempDir("", "atomic-file")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir failed with %v", err)
+	}
+	defer os.RemoveAll(dirname)
+
+	filename := path.Join(dirname, "snapshot")
+	if err := ioutil.WriteFile(filename, []byte("old"), 0644); err != nil {
+		t.Fatalf("WriteFile failed with %v", err)
+	}
+
+	// An aborted file leaves the destination untouched.
+	{
+		f, err := NewAtomicFile(filename, 0644, Byte(8))
+		if err != nil {
+			t.Fatalf("NewAtomicFile failed with %v", err)
+		}
+		if _, err := f.WriteString("new"); err != nil {
+			t.Fatalf("WriteString failed with %v", err)
+		}
+		if err := f.Close(); err != nil {
+			t.Fatalf("Close failed with %v", err)
+		}
+		if err := f.Commit(); err != ErrAtomicFileFinished {
+			t.Errorf("Commit after Close = %v, expected %v", err, ErrAtomicFileFinished)
+		}
+	}
+
+	// Writes over the limit fail without writing anything.
+	{
+		f, err := NewAtomicFile(filename, 0644, Byte(8))
+		if err != nil {
+			t.Fatalf("NewAtomicFile failed with %v", err)
+		}
+		defer f.Close()
+		if _, err := f.WriteString("new "); err != nil {
+			t.Fatalf("WriteString failed with %v", err)
+		}
+		if _, err := f.WriteString("contents"); !HasErrorCategory(err, ErrAtomicFileTooLarge) {
+			t.Errorf("WriteString = %v, expected an error of category %v", err, ErrAtomicFileTooLarge)
+		}
+		if _, err := f.WriteString("file"); err != nil {
+			t.Fatalf("WriteString failed with %v", err)
+		}
+		if f.Size() != Byte(8) {
+			t.Errorf("f.Size() = %d, expected 8", f.Size().Bytes())
+		}
+
+		contents, err := ioutil.ReadFile(filename)
+		if err != nil {
+			t.Fatalf("ReadFile failed with %v", err)
+		}
+		if string(contents) != "old" {
+			t.Errorf("contents before Commit = %q, expected %q", string(contents), "old")
+		}
+
+		if err := f.Commit(); err != nil {
+			t.Fatalf("Commit failed with %v", err)
+		}
+		if err := f.Close(); err != nil {
+			t.Errorf("Close after Commit failed with %v", err)
+		}
+	}
+
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("ReadFile failed with %v", err)
+	}
+	if string(contents) != "new file" {
+		t.Errorf("contents = %q, expected %q", string(contents), "new file")
+	}
+	if files := listDir(t, dirname); !reflect.DeepEqual(files, []string{"snapshot"}) {
+		t.Errorf("files = %v, expected only the snapshot", files)
+	}
+}
@@ -0,0 +1,415 @@
+package base
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const (
+	// AuditLogEntryHeader is the type of the entry that is written at the
+	// beginning of every audit log file to carry the chain across rotations.
+	AuditLogEntryHeader = "header"
+
+	// AuditLogEntryRecord is the type of the entries written by
+	// AuditLogWriter.Write.
+	AuditLogEntryRecord = "record"
+)
+
+// An AuditLogEntry is a single line of an audit log. Each entry contains the
+// hash of the entry that precedes it, so that modifying or removing any entry
+// breaks the chain.
+type AuditLogEntry struct {
+	// Type is either AuditLogEntryHeader or AuditLogEntryRecord.
+	Type string `json:"type"`
+
+	// Sequence is the position of the entry in the chain, starting at 1.
+	Sequence uint64 `json:"seq"`
+
+	// Time is the time at which the entry was written, in UTC.
+	Time time.Time `json:"time"`
+
+	// PrevHash is the hash of the previous entry in the chain, which might be
+	// in a previous file. It is empty for the first entry.
+	PrevHash string `json:"prev_hash"`
+
+	// Data is the JSON-encoded record. It is empty for headers.
+	Data json.RawMessage `json:"data,omitempty"`
+
+	// Hash is the hex-encoded SHA-256 hash of the JSON encoding of the entry
+	// with this field empty.
+	Hash string `json:"hash,omitempty"`
+}
+
+// computeHash returns the hash of the entry, ignoring its Hash field.
+func (e AuditLogEntry) computeHash() (string, error) {
+	e.Hash = ""
+	encoded, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256(encoded)
+	return hex.EncodeToString(hash[:]), nil
+}
+
+// An AuditLogWriter is an append-only, tamper-evident log on top of a
+// RotatingFile. Every record is written as a JSON line that contains the hash
+// of the previous one. Every new file starts with a header entry that links it
+// to the last entry of the previous file. All operations are thread-safe.
+type AuditLogWriter struct {
+	file *RotatingFile
+	now  func() time.Time
+
+	// lastHash and sequence are the state of the chain. They are only accessed
+	// while the RotatingFile's lock is held.
+	lastHash string
+	sequence uint64
+
+	// pending is the state of the chain after the header of a file that is
+	// being opened. It only becomes the state of the chain once the file is in
+	// place, so that an aborted rotation does not break the chain.
+	pending *AuditLogEntry
+}
+
+// NewAuditLogWriter creates a new AuditLogWriter that writes into a
+// RotatingFile created with the provided options. If there are previous files
+// produced by the same options, the chain continues from the most recent
+// entry found in them. If options has an OpenedCallback, it is invoked after
+// the header is written.
+func NewAuditLogWriter(options RotatingFileOptions) (*AuditLogWriter, error) {
+	w := &AuditLogWriter{
+		now: time.Now,
+	}
+	if err := w.resume(options.Path); err != nil {
+		return nil, err
+	}
+
+	callback := options.OpenedCallback
+	if callback == nil {
+		callback = NopOpenedCallback
+	}
+	options.OpenedCallback = func(f *os.File, isEmpty bool) error {
+		w.pending = nil
+		if isEmpty {
+			if err := w.writeHeader(f); err != nil {
+				return err
+			}
+		}
+		return callback(f, isEmpty)
+	}
+	options.committedCallback = func() {
+		if w.pending == nil {
+			return
+		}
+		w.lastHash = w.pending.Hash
+		w.sequence = w.pending.Sequence
+		w.pending = nil
+	}
+
+	file, err := NewRotatingFileWithOptions(options)
+	if err != nil {
+		return nil, err
+	}
+	w.file = file
+	return w, nil
+}
+
+// Write appends a new record with the JSON encoding of data to the log.
+func (w *AuditLogWriter) Write(data any) error {
+	encodedData, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	var entry AuditLogEntry
+	return w.file.writeComposed(
+		func() ([]byte, error) {
+			entry, err = w.nextEntry(AuditLogEntryRecord, encodedData)
+			if err != nil {
+				return nil, err
+			}
+			return encodeAuditLogEntry(entry)
+		},
+		func() {
+			w.lastHash = entry.Hash
+			w.sequence = entry.Sequence
+		},
+	)
+}
+
+// File returns the underlying RotatingFile.
+func (w *AuditLogWriter) File() *RotatingFile {
+	return w.file
+}
+
+// Close closes the underlying RotatingFile.
+func (w *AuditLogWriter) Close() error {
+	return w.file.Close()
+}
+
+// writeHeader writes a header entry into a newly-opened file, which becomes
+// the pending state of the chain.
+func (w *AuditLogWriter) writeHeader(f *os.File) error {
+	entry, err := w.nextEntry(AuditLogEntryHeader, nil)
+	if err != nil {
+		return err
+	}
+	encoded, err := encodeAuditLogEntry(entry)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(encoded); err != nil {
+		return err
+	}
+	w.pending = &entry
+	return nil
+}
+
+// nextEntry creates the entry that follows the current state of the chain.
+func (w *AuditLogWriter) nextEntry(entryType string, data json.RawMessage) (AuditLogEntry, error) {
+	entry := AuditLogEntry{
+		Type:     entryType,
+		Sequence: w.sequence + 1,
+		Time:     w.now().UTC(),
+		PrevHash: w.lastHash,
+		Data:     data,
+	}
+	hash, err := entry.computeHash()
+	if err != nil {
+		return AuditLogEntry{}, err
+	}
+	entry.Hash = hash
+	return entry, nil
+}
+
+// resume finds the most recently modified file that could have been produced
+// by path and continues the chain from its last entry. If the process crashed
+// while writing that entry, the partially-written entry is removed and the
+// chain continues from the one before it.
+func (w *AuditLogWriter) resume(path string) error {
+	glob, re, err := rotatedFilePattern(path, "")
+	if err != nil {
+		return err
+	}
+	candidates, err := filepath.Glob(glob)
+	if err != nil {
+		return err
+	}
+	type candidateFile struct {
+		path    string
+		modTime time.Time
+	}
+	var files []candidateFile
+	for _, candidate := range candidates {
+		if !re.MatchString(candidate) {
+			continue
+		}
+		info, err := os.Stat(candidate)
+		if err != nil || !info.Mode().IsRegular() || info.Size() == 0 {
+			continue
+		}
+		files = append(files, candidateFile{path: candidate, modTime: info.ModTime()})
+	}
+	if len(files) == 0 {
+		return nil
+	}
+	sort.Slice(files, func(i, j int) bool {
+		if !files[i].modTime.Equal(files[j].modTime) {
+			return files[i].modTime.After(files[j].modTime)
+		}
+		return files[i].path > files[j].path
+	})
+
+	for _, file := range files {
+		if err := truncateTornEntry(file.path); err != nil {
+			return err
+		}
+		line, err := readLastLine(file.path)
+		if err != nil {
+			return err
+		}
+		if len(line) == 0 {
+			// The file only contained a partially-written entry.
+			continue
+		}
+		var entry AuditLogEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return fmt.Errorf("audit log: invalid last entry in %s: %w", file.path, err)
+		}
+		w.lastHash = entry.Hash
+		w.sequence = entry.Sequence
+		return nil
+	}
+	return nil
+}
+
+// truncateTornEntry removes the partially-written entry that a crash could
+// have left at the end of the file at path, which is everything after the last
+// newline.
+func truncateTornEntry(path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	const chunkSize = 4096
+	for pos := info.Size(); pos > 0; {
+		n := Min(int64(chunkSize), pos)
+		pos -= n
+		chunk := make([]byte, n)
+		if _, err := f.ReadAt(chunk, pos); err != nil {
+			return err
+		}
+		idx := bytes.LastIndexByte(chunk, '\n')
+		if idx == -1 {
+			continue
+		}
+		if end := pos + int64(idx) + 1; end != info.Size() {
+			return f.Truncate(end)
+		}
+		return nil
+	}
+	return f.Truncate(0)
+}
+
+func encodeAuditLogEntry(entry AuditLogEntry) ([]byte, error) {
+	encoded, err := json.Marshal(entry)
+	if err != nil {
+		return nil, err
+	}
+	return append(encoded, '\n'), nil
+}
+
+// readLastLine returns the last non-empty line of the file at path.
+func readLastLine(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	const chunkSize = 4096
+	var contents []byte
+	for pos := info.Size(); pos > 0; {
+		n := Min(int64(chunkSize), pos)
+		pos -= n
+		chunk := make([]byte, n)
+		if _, err := f.ReadAt(chunk, pos); err != nil {
+			return nil, err
+		}
+		contents = append(chunk, contents...)
+		trimmed := bytes.TrimRight(contents, "\n")
+		if idx := bytes.LastIndexByte(trimmed, '\n'); idx != -1 {
+			return trimmed[idx+1:], nil
+		}
+		if pos == 0 {
+			return trimmed, nil
+		}
+	}
+	return nil, nil
+}
+
+// An AuditLogVerificationError describes the first broken link in the chain
+// of an audit log.
+type AuditLogVerificationError struct {
+	// Path is the file that contains the broken link.
+	Path string
+
+	// Line is the 1-based line number of the entry that is invalid.
+	Line int
+
+	// Reason is a human-readable description of the problem.
+	Reason string
+}
+
+func (e *AuditLogVerificationError) Error() string {
+	return fmt.Sprintf("audit log: %s:%d: %s", e.Path, e.Line, e.Reason)
+}
+
+// VerifyAuditLog scans the audit log files at paths, in the order provided,
+// and verifies that every entry has a valid hash and is correctly linked to
+// the previous one, including across files. It returns an
+// *AuditLogVerificationError with the first broken link, or nil if the chain
+// is intact. The first entry of the first file is trusted to link to whatever
+// preceded it.
+func VerifyAuditLog(paths ...string) error {
+	var previous *AuditLogEntry
+	for _, path := range paths {
+		if err := verifyAuditLogFile(path, &previous); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func verifyAuditLogFile(path string, previous **AuditLogEntry) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), int(Gibibyte.Bytes()))
+	line := 0
+	for scanner.Scan() {
+		line++
+		fail := func(format string, args ...any) error {
+			return &AuditLogVerificationError{
+				Path:   path,
+				Line:   line,
+				Reason: fmt.Sprintf(format, args...),
+			}
+		}
+
+		var entry AuditLogEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return fail("invalid entry: %v", err)
+		}
+		if line == 1 && entry.Type != AuditLogEntryHeader {
+			return fail("file does not start with a header")
+		}
+		if entry.Type != AuditLogEntryHeader && entry.Type != AuditLogEntryRecord {
+			return fail("invalid entry type %q", entry.Type)
+		}
+		hash, err := entry.computeHash()
+		if err != nil {
+			return fail("failed to compute hash: %v", err)
+		}
+		if hash != entry.Hash {
+			return fail("hash mismatch: got %s, expected %s", entry.Hash, hash)
+		}
+		if *previous != nil {
+			if entry.PrevHash != (*previous).Hash {
+				return fail("previous hash mismatch: got %s, expected %s", entry.PrevHash, (*previous).Hash)
+			}
+			if entry.Sequence != (*previous).Sequence+1 {
+				return fail("sequence mismatch: got %d, expected %d", entry.Sequence, (*previous).Sequence+1)
+			}
+		}
+		*previous = &entry
+	}
+	if err := scanner.Err(); err != nil {
+		return &AuditLogVerificationError{
+			Path:   path,
+			Line:   line + 1,
+			Reason: err.Error(),
+		}
+	}
+	return nil
+}
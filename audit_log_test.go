@@ -0,0 +1,272 @@
+package base
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuditLog(t *testing.T) {
+	dirname, err := ioutil.TempDir("", "audit-log")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir failed with %v", err)
+	}
+	defer os.RemoveAll(dirname)
+
+	location := time.UTC
+	options := RotatingFileOptions{
+		Path:     path.Join(dirname, "audit-%Y%m%d.log"),
+		Mode:     0644,
+		Location: location,
+	}
+	type event struct {
+		Action string `json:"action"`
+		User   string `json:"user"`
+	}
+
+	w, err := NewAuditLogWriter(options)
+	if err != nil {
+		t.Fatalf("NewAuditLogWriter failed with %v", err)
+	}
+	// Ensure that the file that was created with the current time is the
+	// oldest one.
+	todayFilename := w.File().Name()
+	if err := w.File().rotateAt(time.Date(2100, 1, 1, 0, 0, 0, 0, location)); err != nil {
+		t.Fatalf("rotateAt failed with %v", err)
+	}
+	if err := w.Write(event{Action: "submit", User: "alice"}); err != nil {
+		t.Fatalf("Write failed with %v", err)
+	}
+	if err := w.Write(event{Action: "rejudge", User: "bob"}); err != nil {
+		t.Fatalf("Write failed with %v", err)
+	}
+	if err := w.File().rotateAt(time.Date(2100, 1, 2, 0, 0, 0, 0, location)); err != nil {
+		t.Fatalf("rotateAt failed with %v", err)
+	}
+	if err := w.Write(event{Action: "submit", User: "carol"}); err != nil {
+		t.Fatalf("Write failed with %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close failed with %v", err)
+	}
+
+	// The chain continues after a restart.
+	w, err = NewAuditLogWriter(options)
+	if err != nil {
+		t.Fatalf("NewAuditLogWriter failed with %v", err)
+	}
+	if err := w.File().rotateAt(time.Date(2100, 1, 2, 12, 0, 0, 0, location)); err != nil {
+		t.Fatalf("rotateAt failed with %v", err)
+	}
+	if err := w.Write(event{Action: "scoreboard", User: "dave"}); err != nil {
+		t.Fatalf("Write failed with %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close failed with %v", err)
+	}
+
+	paths := []string{
+		todayFilename,
+		path.Join(dirname, "audit-21000101.log"),
+		path.Join(dirname, "audit-21000102.log"),
+	}
+	if err := VerifyAuditLog(paths...); err != nil {
+		t.Fatalf("VerifyAuditLog failed with %v", err)
+	}
+
+	// Removing a file breaks the chain.
+	err = VerifyAuditLog(paths[0], paths[2])
+	if verificationErr, ok := err.(*AuditLogVerificationError); !ok || verificationErr.Path != paths[2] || verificationErr.Line != 1 {
+		t.Errorf("VerifyAuditLog = %v, expected a failure in %s:1", err, paths[2])
+	}
+
+	// Tampering with an entry is detected.
+	contents, err := ioutil.ReadFile(paths[1])
+	if err != nil {
+		t.Fatalf("ReadFile failed with %v", err)
+	}
+	if err := ioutil.WriteFile(paths[1], []byte(strings.Replace(string(contents), "bob", "eve", 1)), 0644); err != nil {
+		t.Fatalf("WriteFile failed with %v", err)
+	}
+	err = VerifyAuditLog(paths...)
+	if verificationErr, ok := err.(*AuditLogVerificationError); !ok || verificationErr.Path != paths[1] || verificationErr.Line != 3 {
+		t.Errorf("VerifyAuditLog = %v, expected a failure in %s:3", err, paths[1])
+	}
+}
+
+func TestAuditLogFailedRotation(t *testing.T) {
+	dirname, err := ioutil.TempDir("", "audit-log")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir failed with %v", err)
+	}
+	defer os.RemoveAll(dirname)
+
+	location := time.UTC
+	errFailed := errors.New("failed")
+	failing := false
+	w, err := NewAuditLogWriter(RotatingFileOptions{
+		Path:     path.Join(dirname, "audit-%Y%m%d.log"),
+		Mode:     0644,
+		Location: location,
+		OpenedCallback: func(f *os.File, isEmpty bool) error {
+			if failing {
+				return errFailed
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewAuditLogWriter failed with %v", err)
+	}
+	defer w.Close()
+	todayFilename := w.File().Name()
+
+	// The rotation is aborted after the header of the new file was written,
+	// so the chain continues in the previous file.
+	failing = true
+	if err := w.File().rotateAt(time.Date(2100, 1, 1, 0, 0, 0, 0, location)); err != errFailed {
+		t.Fatalf("rotateAt = %v, expected %v", err, errFailed)
+	}
+	if err := w.Write("first"); err != nil {
+		t.Fatalf("Write failed with %v", err)
+	}
+	failing = false
+	if err := w.File().rotateAt(time.Date(2100, 1, 1, 0, 0, 0, 0, location)); err != nil {
+		t.Fatalf("rotateAt failed with %v", err)
+	}
+	if err := w.Write("second"); err != nil {
+		t.Fatalf("Write failed with %v", err)
+	}
+
+	paths := []string{
+		todayFilename,
+		path.Join(dirname, "audit-21000101.log"),
+	}
+	if err := VerifyAuditLog(paths...); err != nil {
+		t.Fatalf("VerifyAuditLog failed with %v", err)
+	}
+}
+
+func TestAuditLogTornEntry(t *testing.T) {
+	dirname, err := ioutil.TempDir("", "audit-log")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir failed with %v", err)
+	}
+	defer os.RemoveAll(dirname)
+
+	options := RotatingFileOptions{
+		Path: path.Join(dirname, "audit.log"),
+		Mode: 0644,
+	}
+	w, err := NewAuditLogWriter(options)
+	if err != nil {
+		t.Fatalf("NewAuditLogWriter failed with %v", err)
+	}
+	if err := w.Write("first"); err != nil {
+		t.Fatalf("Write failed with %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close failed with %v", err)
+	}
+
+	// Simulate a crash in the middle of writing an entry.
+	f, err := os.OpenFile(options.Path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("OpenFile failed with %v", err)
+	}
+	if _, err := f.WriteString(`{"type":"record","seq":3,"ti`); err != nil {
+		t.Fatalf("WriteString failed with %v", err)
+	}
+	f.Close()
+
+	w, err = NewAuditLogWriter(options)
+	if err != nil {
+		t.Fatalf("NewAuditLogWriter failed with %v", err)
+	}
+	if err := w.Write("second"); err != nil {
+		t.Fatalf("Write failed with %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close failed with %v", err)
+	}
+
+	if err := VerifyAuditLog(options.Path); err != nil {
+		t.Fatalf("VerifyAuditLog failed with %v", err)
+	}
+	contents, err := ioutil.ReadFile(options.Path)
+	if err != nil {
+		t.Fatalf("ReadFile failed with %v", err)
+	}
+	if lines := strings.Count(string(contents), "\n"); lines != 3 {
+		t.Errorf("the log has %d lines, expected 3", lines)
+	}
+}
+
+func TestAuditLogLowDiskSpace(t *testing.T) {
+	dirname, err := ioutil.TempDir("", "audit-log")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir failed with %v", err)
+	}
+	defer os.RemoveAll(dirname)
+
+	for _, entry := range []struct {
+		name   string
+		policy LowDiskSpacePolicy
+	}{
+		{"drop", LowDiskSpaceDrop},
+		{"buffer", LowDiskSpaceBuffer},
+	} {
+		t.Run(entry.name, func(t *testing.T) {
+			monitor, setFree := newFakeDiskSpaceMonitor(t, Gibibyte)
+			logFilename := path.Join(dirname, entry.name+".log")
+			w, err := NewAuditLogWriter(RotatingFileOptions{
+				Path:               logFilename,
+				Mode:               0644,
+				DiskSpaceMonitor:   monitor,
+				MinFreeSpace:       Mebibyte,
+				LowDiskSpacePolicy: entry.policy,
+				// Only the first record written while the disk space is low fits.
+				LowDiskSpaceBufferSize: Byte(300),
+			})
+			if err != nil {
+				t.Fatalf("NewAuditLogWriter failed with %v", err)
+			}
+			defer w.Close()
+
+			if err := w.Write("before"); err != nil {
+				t.Fatalf("Write failed with %v", err)
+			}
+			setFree(Kibibyte)
+			for _, data := range []string{"during", "dropped"} {
+				if err := w.Write(data); err != nil {
+					t.Fatalf("Write failed with %v", err)
+				}
+			}
+			setFree(Gibibyte)
+			if err := w.Write("after"); err != nil {
+				t.Fatalf("Write failed with %v", err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatalf("Close failed with %v", err)
+			}
+
+			if err := VerifyAuditLog(logFilename); err != nil {
+				t.Fatalf("VerifyAuditLog failed with %v", err)
+			}
+			contents, err := ioutil.ReadFile(logFilename)
+			if err != nil {
+				t.Fatalf("ReadFile failed with %v", err)
+			}
+			if strings.Contains(string(contents), "dropped") {
+				t.Errorf("contents = %q, expected the dropped record to be missing", string(contents))
+			}
+			if strings.Contains(string(contents), "during") != (entry.policy == LowDiskSpaceBuffer) {
+				t.Errorf("contents = %q, unexpected presence of the buffered record", string(contents))
+			}
+		})
+	}
+}
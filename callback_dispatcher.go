@@ -0,0 +1,137 @@
+package base
+
+import (
+	"runtime/debug"
+	"sync"
+
+	"github.com/omegaup/go-base/v3/logging"
+)
+
+// CallbackDispatcherOptions are options that can be passed to
+// NewCallbackDispatcher to customize its behavior.
+type CallbackDispatcherOptions struct {
+	// Workers is the number of goroutines that run the callbacks. The default
+	// is 4 if unset.
+	Workers int
+
+	// QueueSize is the number of callbacks that can be waiting for a worker
+	// before Dispatch blocks. The default is 64 if unset.
+	QueueSize int
+
+	// Log is used to report the callbacks that panicked. Panics are silently
+	// recovered if unset.
+	Log logging.Logger
+}
+
+// A CallbackDispatcher runs callbacks in a bounded pool of background
+// goroutines, so that slow callbacks (like the teardown of evicted objects) do
+// not stall their callers. Once all the workers are busy and the queue is
+// full, Dispatch blocks until there is room. Callbacks that panic are
+// recovered and logged. All operations are thread-safe.
+type CallbackDispatcher struct {
+	options CallbackDispatcherOptions
+	queue   chan func()
+	wg      sync.WaitGroup
+
+	// lock protects closed, and prevents the queue from being closed while a
+	// callback is being enqueued.
+	lock   sync.RWMutex
+	closed bool
+
+	// pending is the number of callbacks that have been dispatched and have
+	// not finished running yet.
+	pendingLock sync.Mutex
+	pending     int
+	idle        *sync.Cond
+}
+
+// NewCallbackDispatcher creates a new CallbackDispatcher and starts its
+// workers.
+func NewCallbackDispatcher(options CallbackDispatcherOptions) *CallbackDispatcher {
+	if options.Workers <= 0 {
+		options.Workers = 4
+	}
+	if options.QueueSize <= 0 {
+		options.QueueSize = 64
+	}
+	d := &CallbackDispatcher{
+		options: options,
+		queue:   make(chan func(), options.QueueSize),
+	}
+	d.idle = sync.NewCond(&d.pendingLock)
+	d.wg.Add(options.Workers)
+	for i := 0; i < options.Workers; i++ {
+		go d.work()
+	}
+	return d
+}
+
+// Dispatch schedules callback to be run by one of the workers, blocking while
+// the queue is full. If the dispatcher has been closed, callback is run on the
+// calling goroutine. Callbacks must not call Dispatch on the dispatcher that
+// runs them: if all the workers block on a full queue, nothing drains it and
+// they deadlock.
+func (d *CallbackDispatcher) Dispatch(callback func()) {
+	d.pendingLock.Lock()
+	d.pending++
+	d.pendingLock.Unlock()
+
+	d.lock.RLock()
+	if d.closed {
+		d.lock.RUnlock()
+		d.run(callback)
+		return
+	}
+	d.queue <- callback
+	d.lock.RUnlock()
+}
+
+// Wait blocks until all the callbacks that have been dispatched so far, and
+// any that are dispatched while waiting, have finished running.
+func (d *CallbackDispatcher) Wait() {
+	d.pendingLock.Lock()
+	defer d.pendingLock.Unlock()
+	for d.pending > 0 {
+		d.idle.Wait()
+	}
+}
+
+// Close waits for all the dispatched callbacks to finish and stops the
+// workers. Callbacks dispatched after Close are run synchronously.
+func (d *CallbackDispatcher) Close() {
+	d.lock.Lock()
+	if !d.closed {
+		d.closed = true
+		close(d.queue)
+	}
+	d.lock.Unlock()
+	d.wg.Wait()
+}
+
+func (d *CallbackDispatcher) work() {
+	defer d.wg.Done()
+	for callback := range d.queue {
+		d.run(callback)
+	}
+}
+
+// run invokes callback, recovering from any panics, and marks it as
+// finished.
+func (d *CallbackDispatcher) run(callback func()) {
+	defer func() {
+		if r := recover(); r != nil && d.options.Log != nil {
+			d.options.Log.Error("callback panicked", map[string]any{
+				"panic": r,
+				"stack": string(debug.Stack()),
+			})
+		}
+
+		d.pendingLock.Lock()
+		d.pending--
+		if d.pending == 0 {
+			d.idle.Broadcast()
+		}
+		d.pendingLock.Unlock()
+	}()
+	callback()
+}
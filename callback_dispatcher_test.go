@@ -0,0 +1,125 @@
+package base
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/omegaup/go-base/v3/logging"
+)
+
+func TestCallbackDispatcher(t *testing.T) {
+	var buf bytes.Buffer
+	d := NewCallbackDispatcher(CallbackDispatcherOptions{
+		Workers:   1,
+		QueueSize: 1,
+		Log:       logging.NewInMemoryLogfmtLogger(&buf),
+	})
+
+	// The worker is busy with the first callback and the second one fills the
+	// queue, so the third one blocks.
+	unblock := make(chan struct{})
+	var lock sync.Mutex
+	var ran []int
+	record := func(i int) func() {
+		return func() {
+			lock.Lock()
+			defer lock.Unlock()
+			ran = append(ran, i)
+		}
+	}
+	d.Dispatch(func() {
+		<-unblock
+		record(1)()
+	})
+	d.Dispatch(record(2))
+	dispatched := make(chan struct{})
+	go func() {
+		d.Dispatch(record(3))
+		close(dispatched)
+	}()
+	select {
+	case <-dispatched:
+		t.Fatalf("Dispatch should have blocked")
+	case <-time.After(10 * time.Millisecond):
+	}
+	close(unblock)
+	<-dispatched
+
+	// Panics are recovered and logged.
+	d.Dispatch(func() {
+		panic("oops")
+	})
+	d.Dispatch(record(4))
+	d.Wait()
+
+	lock.Lock()
+	if len(ran) != 4 || ran[0] != 1 || ran[3] != 4 {
+		t.Errorf("ran = %v, want [1 2 3 4]", ran)
+	}
+	lock.Unlock()
+	if !strings.Contains(buf.String(), "callback panicked") || !strings.Contains(buf.String(), "oops") {
+		t.Errorf("log = %q, want a panic report", buf.String())
+	}
+
+	// Callbacks dispatched after Close are run synchronously.
+	d.Close()
+	d.Dispatch(record(5))
+	lock.Lock()
+	defer lock.Unlock()
+	if len(ran) != 5 {
+		t.Errorf("ran = %v, want [1 2 3 4 5]", ran)
+	}
+}
+
+func TestCallbackDispatcherEvictions(t *testing.T) {
+	d := NewCallbackDispatcher(CallbackDispatcherOptions{})
+	defer d.Close()
+
+	var lock sync.Mutex
+	var evicted []int
+	p := NewKeyedPool[int](KeyedPoolOptions[int]{
+		MaxEntries: 1,
+		Shards:     1,
+		Dispatcher: d,
+		OnEvicted: func(key string, value int) {
+			lock.Lock()
+			defer lock.Unlock()
+			evicted = append(evicted, value)
+		},
+	})
+	p.Put("a", 1)
+	p.Put("b", 2)
+	d.Wait()
+	lock.Lock()
+	if len(evicted) != 1 || evicted[0] != 1 {
+		t.Errorf("evicted = %v, want [1]", evicted)
+	}
+	lock.Unlock()
+
+	c := NewLRUCacheWithOptions[*releasable](LRUCacheOptions{
+		SizeLimit:  Byte(1),
+		Dispatcher: d,
+	})
+	r := &releasable{size: Byte(1), t: t}
+	ref, err := c.Get("r", func(key string) (*releasable, error) {
+		return r, nil
+	})
+	if err != nil {
+		t.Fatalf("c.Get() failed with %v", err)
+	}
+	c.Put(ref)
+	ref, err = c.Get("r2", func(key string) (*releasable, error) {
+		return &releasable{size: Byte(1), t: t}, nil
+	})
+	if err != nil {
+		t.Fatalf("c.Get() failed with %v", err)
+	}
+	defer c.Put(ref)
+	d.Wait()
+	if !r.released {
+		t.Errorf("releasable object was not released")
+	}
+}
@@ -0,0 +1,137 @@
+package base
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/omegaup/go-base/v3/logging"
+)
+
+// DiskSpaceMonitorOptions are options that can be passed to
+// NewDiskSpaceMonitor to customize how the free space is tracked.
+type DiskSpaceMonitorOptions struct {
+	// Path is any path in the filesystem that will be monitored.
+	Path string
+
+	// Interval is how often the free space is refreshed. The default is 10
+	// seconds if unset.
+	Interval Duration
+
+	// Metrics, if set, is used to publish the free space in bytes as a gauge.
+	Metrics Metrics
+
+	// GaugeName is the name of the gauge that is published through Metrics.
+	// The default is disk_space_free_bytes if unset.
+	GaugeName string
+
+	// Log is used to report failures to query the free space. Failures are
+	// silently ignored if unset.
+	Log logging.Logger
+}
+
+// A DiskSpaceMonitor periodically tracks the free space available to
+// unprivileged users in a filesystem. All operations are thread-safe.
+type DiskSpaceMonitor struct {
+	options DiskSpaceMonitorOptions
+	statfs  func(path string) (Byte, error)
+
+	// free is the last observed free space, in bytes.
+	free int64
+
+	lock      sync.Mutex
+	published Byte
+	updated   chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+// NewDiskSpaceMonitor queries the free space of the filesystem that contains
+// the path in options and starts refreshing it periodically.
+func NewDiskSpaceMonitor(options DiskSpaceMonitorOptions) (*DiskSpaceMonitor, error) {
+	if options.Interval <= 0 {
+		options.Interval = Duration(10 * time.Second)
+	}
+	if options.GaugeName == "" {
+		options.GaugeName = "disk_space_free_bytes"
+	}
+	m := &DiskSpaceMonitor{
+		options: options,
+		statfs:  freeDiskSpace,
+		updated: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	if err := m.Check(); err != nil {
+		return nil, err
+	}
+	m.wg.Add(1)
+	go m.run()
+	return m, nil
+}
+
+// Free returns the free space that was observed in the last check.
+func (m *DiskSpaceMonitor) Free() Byte {
+	return Byte(atomic.LoadInt64(&m.free))
+}
+
+// Updated returns a channel that will be closed the next time the free space
+// is refreshed.
+func (m *DiskSpaceMonitor) Updated() <-chan struct{} {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.updated
+}
+
+// Check refreshes the free space immediately.
+func (m *DiskSpaceMonitor) Check() error {
+	free, err := m.statfs(m.options.Path)
+	if err != nil {
+		return err
+	}
+	atomic.StoreInt64(&m.free, free.Bytes())
+
+	m.lock.Lock()
+	if m.options.Metrics != nil {
+		m.options.Metrics.GaugeAdd(m.options.GaugeName, float64(free.Bytes()-m.published.Bytes()))
+		m.published = free
+	}
+	close(m.updated)
+	m.updated = make(chan struct{})
+	m.lock.Unlock()
+	return nil
+}
+
+// Close stops refreshing the free space and retracts the published gauge.
+func (m *DiskSpaceMonitor) Close() {
+	m.closeOnce.Do(func() {
+		close(m.done)
+	})
+	m.wg.Wait()
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.options.Metrics != nil {
+		m.options.Metrics.GaugeAdd(m.options.GaugeName, -float64(m.published.Bytes()))
+		m.published = 0
+	}
+}
+
+func (m *DiskSpaceMonitor) run() {
+	defer m.wg.Done()
+	ticker := time.NewTicker(time.Duration(m.options.Interval))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.done:
+			return
+		case <-ticker.C:
+		}
+		if err := m.Check(); err != nil && m.options.Log != nil {
+			m.options.Log.Error("failed to check free disk space", map[string]any{
+				"path": m.options.Path,
+				"err":  err,
+			})
+		}
+	}
+}
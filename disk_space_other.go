@@ -0,0 +1,12 @@
+//go:build !linux && !darwin && !freebsd
+
+package base
+
+import (
+	"errors"
+)
+
+// freeDiskSpace is not supported in this platform.
+func freeDiskSpace(path string) (Byte, error) {
+	return 0, errors.New("disk space monitoring is not supported in this platform")
+}
@@ -0,0 +1,52 @@
+package base
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDiskSpaceMonitor(t *testing.T) {
+	dirname, err := ioutil.TempDir("", "disk-space")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir failed with %v", err)
+	}
+	defer os.RemoveAll(dirname)
+
+	metrics := &recordingMetrics{}
+	m, err := NewDiskSpaceMonitor(DiskSpaceMonitorOptions{
+		Path:     dirname,
+		Interval: Duration(time.Hour),
+		Metrics:  metrics,
+	})
+	if err != nil {
+		t.Skipf("NewDiskSpaceMonitor failed with %v", err)
+	}
+	defer m.Close()
+	if m.Free() <= 0 {
+		t.Errorf("m.Free() = %d, expected a positive number", m.Free().Bytes())
+	}
+
+	m.statfs = func(string) (Byte, error) { return Mebibyte, nil }
+	updated := m.Updated()
+	if err := m.Check(); err != nil {
+		t.Fatalf("Check failed with %v", err)
+	}
+	select {
+	case <-updated:
+	default:
+		t.Errorf("Updated channel was not closed after Check")
+	}
+	if m.Free() != Mebibyte {
+		t.Errorf("m.Free() = %d, expected %d", m.Free().Bytes(), Mebibyte.Bytes())
+	}
+	if gauge := metrics.gauge("disk_space_free_bytes"); gauge != float64(Mebibyte.Bytes()) {
+		t.Errorf("gauge = %v, expected %d", gauge, Mebibyte.Bytes())
+	}
+
+	m.Close()
+	if gauge := metrics.gauge("disk_space_free_bytes"); gauge != 0 {
+		t.Errorf("gauge after Close = %v, expected 0", gauge)
+	}
+}
@@ -0,0 +1,17 @@
+//go:build linux || darwin || freebsd
+
+package base
+
+import (
+	"syscall"
+)
+
+// freeDiskSpace returns the free space available to unprivileged users in the
+// filesystem that contains path.
+func freeDiskSpace(path string) (Byte, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+	return Byte(int64(stat.Bavail) * int64(stat.Bsize)), nil
+}
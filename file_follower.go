@@ -0,0 +1,457 @@
+package base
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/omegaup/go-base/v3/logging"
+)
+
+// fingerprintSize is the number of bytes from the beginning of a file that are
+// used to identify it across restarts.
+const fingerprintSize = 256
+
+// FileFollowerOptions are options that can be passed to NewFileFollower to
+// customize how the file is followed.
+type FileFollowerOptions struct {
+	// Path is the path of the file that will be followed. The file does not
+	// need to exist when the FileFollower is created.
+	Path string
+
+	// PollInterval is how often the file is checked for new data, truncation,
+	// or rotation once all its contents have been read. The default is 250ms
+	// if unset.
+	PollInterval Duration
+
+	// Delimiter is the byte that separates records in the file. The default is
+	// '\n' if unset.
+	Delimiter byte
+
+	// MaxRecordSize is the maximum size of a single record. Records that are
+	// longer will be split. The default is 1 MiB if unset.
+	MaxRecordSize Byte
+
+	// CheckpointPath, if set, is the path of a file where the offset of the
+	// last committed record is persisted. If the file exists when the
+	// FileFollower is created and it still refers to the same file, reading
+	// resumes right after that record.
+	CheckpointPath string
+
+	// StartAtEnd makes the FileFollower skip over the current contents of the
+	// file when there is no usable checkpoint, as tail -F does. Files that
+	// appear after a rotation are always read from the beginning.
+	StartAtEnd bool
+
+	// Log is used to report errors that are retried, such as failures to open
+	// the file. Errors are silently retried if unset.
+	Log logging.Logger
+}
+
+// A FollowedRecord is a single record that was read by a FileFollower.
+type FollowedRecord struct {
+	// Data is the contents of the record, without the delimiter.
+	Data []byte
+
+	// Offset is the offset in the file immediately after this record.
+	Offset int64
+
+	// fingerprint identifies the file that this record was read from.
+	fingerprint fileFingerprint
+}
+
+// fileFingerprint identifies a file by the hash of its first bytes.
+type fileFingerprint struct {
+	Size int64  `json:"size"`
+	Hash string `json:"hash"`
+}
+
+// fileFollowerCheckpoint is the contents of the checkpoint file.
+type fileFollowerCheckpoint struct {
+	Offset      int64           `json:"offset"`
+	Fingerprint fileFingerprint `json:"fingerprint"`
+}
+
+// A FileFollower reads a file as it is being written, following it across
+// truncations and rotations, much like tail -F. Complete records are delivered
+// through the Records channel.
+type FileFollower struct {
+	options FileFollowerOptions
+	records chan FollowedRecord
+
+	lock sync.Mutex
+	err  error
+
+	// checkpointLock serializes the writes to the checkpoint file.
+	checkpointLock sync.Mutex
+
+	file        *os.File
+	offset      int64
+	fingerprint fileFingerprint
+	pending     []byte
+
+	stat func(name string) (os.FileInfo, error)
+}
+
+// NewFileFollower starts following the file described by options. Records
+// will be delivered until ctx is done.
+func NewFileFollower(ctx context.Context, options FileFollowerOptions) (*FileFollower, error) {
+	if options.PollInterval <= 0 {
+		options.PollInterval = Duration(250 * time.Millisecond)
+	}
+	if options.Delimiter == 0 {
+		options.Delimiter = '\n'
+	}
+	if options.MaxRecordSize <= 0 {
+		options.MaxRecordSize = Mebibyte
+	}
+
+	var checkpoint *fileFollowerCheckpoint
+	if options.CheckpointPath != "" {
+		contents, err := ioutil.ReadFile(options.CheckpointPath)
+		if err == nil {
+			checkpoint = &fileFollowerCheckpoint{}
+			if err := json.Unmarshal(contents, checkpoint); err != nil {
+				return nil, fmt.Errorf("file follower: invalid checkpoint %s: %w", options.CheckpointPath, err)
+			}
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	f := &FileFollower{
+		options: options,
+		records: make(chan FollowedRecord),
+		stat:    os.Stat,
+	}
+	go f.run(ctx, checkpoint)
+	return f, nil
+}
+
+// Records returns the channel through which the records are delivered. The
+// channel is closed once the context is done.
+func (f *FileFollower) Records() <-chan FollowedRecord {
+	return f.records
+}
+
+// Err returns the reason why the Records channel was closed.
+func (f *FileFollower) Err() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.err
+}
+
+// Commit persists the position immediately after record into the checkpoint
+// file, so that following the file after a restart resumes from there. It
+// does nothing if CheckpointPath is unset.
+func (f *FileFollower) Commit(record FollowedRecord) error {
+	if f.options.CheckpointPath == "" {
+		return nil
+	}
+	contents, err := json.Marshal(fileFollowerCheckpoint{
+		Offset:      record.Offset,
+		Fingerprint: record.fingerprint,
+	})
+	if err != nil {
+		return err
+	}
+
+	f.checkpointLock.Lock()
+	defer f.checkpointLock.Unlock()
+	tempPath := f.options.CheckpointPath + ".tmp"
+	if err := ioutil.WriteFile(tempPath, contents, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tempPath, f.options.CheckpointPath)
+}
+
+func (f *FileFollower) run(ctx context.Context, checkpoint *fileFollowerCheckpoint) {
+	defer close(f.records)
+	defer func() {
+		if f.file != nil {
+			f.file.Close()
+		}
+	}()
+
+	err := f.follow(ctx, checkpoint)
+	f.lock.Lock()
+	f.err = err
+	f.lock.Unlock()
+}
+
+func (f *FileFollower) follow(ctx context.Context, checkpoint *fileFollowerCheckpoint) error {
+	for f.file == nil {
+		if err := f.open(checkpoint, f.options.StartAtEnd); err != nil {
+			if !os.IsNotExist(err) && f.options.Log != nil {
+				f.options.Log.Error("failed to open followed file", map[string]any{
+					"path": f.options.Path,
+					"err":  err,
+				})
+			}
+			if err := f.sleep(ctx); err != nil {
+				return err
+			}
+		}
+	}
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := f.file.Read(buf)
+		if n > 0 {
+			if err := f.consume(ctx, buf[:n]); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil && err != io.EOF {
+			return err
+		}
+
+		// All the available data has been read. Before waiting for more, check
+		// whether the file was truncated or replaced.
+		reopened, err := f.checkReplaced(ctx)
+		if err != nil {
+			return err
+		}
+		if reopened {
+			continue
+		}
+		if err := f.sleep(ctx); err != nil {
+			return err
+		}
+	}
+}
+
+// open opens the file at the followed path. If a checkpoint is provided and
+// it matches the file, reading will resume from its offset. Otherwise, reading
+// starts from the end of the file if startAtEnd is true, or from the beginning
+// otherwise.
+func (f *FileFollower) open(checkpoint *fileFollowerCheckpoint, startAtEnd bool) error {
+	file, err := os.Open(f.options.Path)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	fingerprint, err := computeFingerprint(file, info.Size())
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	var offset int64
+	if checkpoint != nil {
+		if checkpoint.Offset <= info.Size() && checkpoint.Fingerprint.matches(file) {
+			offset = checkpoint.Offset
+		}
+	} else if startAtEnd {
+		offset = info.Size()
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return err
+	}
+
+	f.file = file
+	f.offset = offset
+	f.fingerprint = fingerprint
+	f.pending = f.pending[:0]
+	return nil
+}
+
+// consume splits data into records and delivers them.
+func (f *FileFollower) consume(ctx context.Context, data []byte) error {
+	for len(data) > 0 {
+		idx := bytes.IndexByte(data, f.options.Delimiter)
+		if idx == -1 {
+			f.pending = append(f.pending, data...)
+			data = nil
+			for Byte(len(f.pending)) > f.options.MaxRecordSize {
+				record := f.pending[:f.options.MaxRecordSize.Bytes()]
+				if err := f.deliver(ctx, record, int64(len(record))); err != nil {
+					return err
+				}
+				f.pending = append(f.pending[:0], f.pending[len(record):]...)
+			}
+			return nil
+		}
+		record := append(f.pending, data[:idx]...)
+		consumed := int64(len(record)) + 1
+		f.pending = nil
+		data = data[idx+1:]
+		for Byte(len(record)) > f.options.MaxRecordSize {
+			chunk := record[:f.options.MaxRecordSize.Bytes()]
+			if err := f.deliver(ctx, chunk, int64(len(chunk))); err != nil {
+				return err
+			}
+			record = record[len(chunk):]
+			consumed -= int64(len(chunk))
+		}
+		if err := f.deliver(ctx, record, consumed); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deliver sends a record through the channel, advancing the offset by
+// consumed bytes.
+func (f *FileFollower) deliver(ctx context.Context, data []byte, consumed int64) error {
+	f.offset += consumed
+	if f.fingerprint.Size < fingerprintSize && f.offset > f.fingerprint.Size {
+		fingerprint, err := computeFingerprint(f.file, f.offset)
+		if err != nil {
+			return err
+		}
+		f.fingerprint = fingerprint
+	}
+	record := FollowedRecord{
+		Data:        append([]byte(nil), data...),
+		Offset:      f.offset,
+		fingerprint: f.fingerprint,
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case f.records <- record:
+		return nil
+	}
+}
+
+// checkReplaced checks whether the file was truncated, in which case it is
+// read again from the beginning, or whether the path now refers to a new file,
+// in which case the old file is finished and the new one is opened. It returns
+// true if there might be more data to read immediately.
+func (f *FileFollower) checkReplaced(ctx context.Context) (bool, error) {
+	openInfo, err := f.file.Stat()
+	if err != nil {
+		return false, err
+	}
+	position := f.offset + int64(len(f.pending))
+	if openInfo.Size() < position {
+		if _, err := f.file.Seek(0, io.SeekStart); err != nil {
+			return false, err
+		}
+		f.offset = 0
+		f.pending = f.pending[:0]
+		fingerprint, err := computeFingerprint(f.file, openInfo.Size())
+		if err != nil {
+			return false, err
+		}
+		f.fingerprint = fingerprint
+		return true, nil
+	}
+	if openInfo.Size() > position {
+		// More data was written since the last read.
+		return true, nil
+	}
+
+	pathInfo, err := f.stat(f.options.Path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// The file was moved and there is no new file yet.
+			return false, nil
+		}
+		return false, err
+	}
+	if os.SameFile(openInfo, pathInfo) {
+		return false, nil
+	}
+
+	// The file was rotated. Whatever was appended to the old file between the
+	// size check and the rotation is read first. Anything left in the old file
+	// without a trailing delimiter is delivered as a final record, and the new
+	// file is read from the beginning.
+	if err := f.drain(ctx); err != nil {
+		return false, err
+	}
+	if len(f.pending) > 0 {
+		record := f.pending
+		f.pending = nil
+		if err := f.deliver(ctx, record, int64(len(record))); err != nil {
+			return false, err
+		}
+	}
+	f.file.Close()
+	f.file = nil
+	for {
+		err := f.open(nil, false)
+		if err == nil {
+			return true, nil
+		}
+		if !os.IsNotExist(err) {
+			return false, err
+		}
+		// The new file was moved away as well. Keep trying.
+		if err := f.sleep(ctx); err != nil {
+			return false, err
+		}
+	}
+}
+
+// drain reads the open file until the end.
+func (f *FileFollower) drain(ctx context.Context) error {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := f.file.Read(buf)
+		if n > 0 {
+			if err := f.consume(ctx, buf[:n]); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF || (err == nil && n == 0) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (f *FileFollower) sleep(ctx context.Context) error {
+	timer := time.NewTimer(time.Duration(f.options.PollInterval))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// computeFingerprint hashes the first bytes of file, up to size.
+func computeFingerprint(file *os.File, size int64) (fileFingerprint, error) {
+	if size > fingerprintSize {
+		size = fingerprintSize
+	}
+	buf := make([]byte, size)
+	if _, err := file.ReadAt(buf, 0); err != nil && err != io.EOF {
+		return fileFingerprint{}, err
+	}
+	hash := sha256.Sum256(buf)
+	return fileFingerprint{
+		Size: size,
+		Hash: hex.EncodeToString(hash[:]),
+	}, nil
+}
+
+// matches returns whether the first bytes of file have the same hash as the
+// fingerprint.
+func (fp fileFingerprint) matches(file *os.File) bool {
+	other, err := computeFingerprint(file, fp.Size)
+	if err != nil {
+		return false
+	}
+	return other == fp
+}
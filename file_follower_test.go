@@ -0,0 +1,240 @@
+package base
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func expectFollowedRecords(t *testing.T, f *FileFollower, expected ...string) []FollowedRecord {
+	t.Helper()
+	var records []FollowedRecord
+	for _, expectedRecord := range expected {
+		select {
+		case record, ok := <-f.Records():
+			if !ok {
+				t.Fatalf("records channel closed with %v, expected %q", f.Err(), expectedRecord)
+			}
+			if string(record.Data) != expectedRecord {
+				t.Fatalf("record = %q, expected %q", string(record.Data), expectedRecord)
+			}
+			records = append(records, record)
+		case <-time.After(10 * time.Second):
+			t.Fatalf("timed out waiting for %q", expectedRecord)
+		}
+	}
+	return records
+}
+
+func appendToFile(t *testing.T, filename string, contents string) {
+	t.Helper()
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatalf("OpenFile(%s) failed with %v", filename, err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(contents); err != nil {
+		t.Fatalf("WriteString(%s) failed with %v", filename, err)
+	}
+}
+
+func TestFileFollower(t *testing.T) {
+	dirname, err := ioutil.TempDir("", "file-follower")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir failed with %v", err)
+	}
+	defer os.RemoveAll(dirname)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	logFilename := path.Join(dirname, "log")
+	f, err := NewFileFollower(ctx, FileFollowerOptions{
+		Path:         logFilename,
+		PollInterval: Duration(10 * time.Millisecond),
+	})
+	if err != nil {
+		t.Fatalf("NewFileFollower failed with %v", err)
+	}
+
+	// The file is created after the follower started.
+	appendToFile(t, logFilename, "first\nsecond\npart")
+	expectFollowedRecords(t, f, "first", "second")
+	appendToFile(t, logFilename, "ial\n")
+	expectFollowedRecords(t, f, "partial")
+
+	// The file is rotated with a trailing record without a delimiter.
+	appendToFile(t, logFilename, "unterminated")
+	if err := os.Rename(logFilename, logFilename+".old"); err != nil {
+		t.Fatalf("Rename failed with %v", err)
+	}
+	appendToFile(t, logFilename, "rotated\n")
+	expectFollowedRecords(t, f, "unterminated", "rotated")
+
+	// The file is truncated.
+	if err := os.Truncate(logFilename, 0); err != nil {
+		t.Fatalf("Truncate failed with %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	appendToFile(t, logFilename, "truncated\n")
+	expectFollowedRecords(t, f, "truncated")
+
+	cancel()
+	for range f.Records() {
+	}
+	if f.Err() != context.Canceled {
+		t.Errorf("f.Err() = %v, expected %v", f.Err(), context.Canceled)
+	}
+}
+
+func TestFileFollowerCheckpoint(t *testing.T) {
+	dirname, err := ioutil.TempDir("", "file-follower")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir failed with %v", err)
+	}
+	defer os.RemoveAll(dirname)
+
+	logFilename := path.Join(dirname, "log")
+	checkpointFilename := path.Join(dirname, "checkpoint")
+	appendToFile(t, logFilename, "one\ntwo\nthree\n")
+
+	{
+		ctx, cancel := context.WithCancel(context.Background())
+		f, err := NewFileFollower(ctx, FileFollowerOptions{
+			Path:           logFilename,
+			PollInterval:   Duration(10 * time.Millisecond),
+			CheckpointPath: checkpointFilename,
+		})
+		if err != nil {
+			t.Fatalf("NewFileFollower failed with %v", err)
+		}
+		records := expectFollowedRecords(t, f, "one", "two")
+		if err := f.Commit(records[1]); err != nil {
+			t.Fatalf("Commit failed with %v", err)
+		}
+		cancel()
+		for range f.Records() {
+		}
+	}
+
+	appendToFile(t, logFilename, "four\n")
+
+	{
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		f, err := NewFileFollower(ctx, FileFollowerOptions{
+			Path:           logFilename,
+			PollInterval:   Duration(10 * time.Millisecond),
+			CheckpointPath: checkpointFilename,
+		})
+		if err != nil {
+			t.Fatalf("NewFileFollower failed with %v", err)
+		}
+		expectFollowedRecords(t, f, "three", "four")
+	}
+
+	// A checkpoint that belongs to a different file is ignored.
+	if err := os.Remove(logFilename); err != nil {
+		t.Fatalf("Remove failed with %v", err)
+	}
+	appendToFile(t, logFilename, "another file\n")
+	{
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		f, err := NewFileFollower(ctx, FileFollowerOptions{
+			Path:           logFilename,
+			PollInterval:   Duration(10 * time.Millisecond),
+			CheckpointPath: checkpointFilename,
+		})
+		if err != nil {
+			t.Fatalf("NewFileFollower failed with %v", err)
+		}
+		expectFollowedRecords(t, f, "another file")
+	}
+}
+
+func TestFileFollowerMaxRecordSize(t *testing.T) {
+	dirname, err := ioutil.TempDir("", "file-follower")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir failed with %v", err)
+	}
+	defer os.RemoveAll(dirname)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	logFilename := path.Join(dirname, "log")
+	appendToFile(t, logFilename, "")
+	f, err := NewFileFollower(ctx, FileFollowerOptions{
+		Path:          logFilename,
+		PollInterval:  Duration(10 * time.Millisecond),
+		MaxRecordSize: Byte(4),
+	})
+	if err != nil {
+		t.Fatalf("NewFileFollower failed with %v", err)
+	}
+
+	// A record of exactly MaxRecordSize is not split when its delimiter
+	// arrives in a later read.
+	appendToFile(t, logFilename, "abcd")
+	time.Sleep(50 * time.Millisecond)
+	appendToFile(t, logFilename, "\nefghij\n")
+	expectFollowedRecords(t, f, "abcd", "efgh", "ij")
+}
+
+func TestFileFollowerRotationDrainsOldFile(t *testing.T) {
+	dirname, err := ioutil.TempDir("", "file-follower")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir failed with %v", err)
+	}
+	defer os.RemoveAll(dirname)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	logFilename := path.Join(dirname, "log")
+	appendToFile(t, logFilename, "first\n")
+	f := &FileFollower{
+		options: FileFollowerOptions{
+			Path:          logFilename,
+			PollInterval:  Duration(10 * time.Millisecond),
+			Delimiter:     '\n',
+			MaxRecordSize: Mebibyte,
+		},
+		records: make(chan FollowedRecord, 10),
+		// The old file is written to and rotated after its size was checked,
+		// but before the path is looked up.
+		stat: func(name string) (os.FileInfo, error) {
+			appendToFile(t, logFilename, "second\nlast")
+			if err := os.Rename(logFilename, logFilename+".old"); err != nil {
+				t.Fatalf("Rename failed with %v", err)
+			}
+			appendToFile(t, logFilename, "rotated\n")
+			return os.Stat(name)
+		},
+	}
+	if err := f.open(nil, false); err != nil {
+		t.Fatalf("open failed with %v", err)
+	}
+	defer func() {
+		f.file.Close()
+	}()
+	if err := f.drain(ctx); err != nil {
+		t.Fatalf("drain failed with %v", err)
+	}
+	reopened, err := f.checkReplaced(ctx)
+	if err != nil {
+		t.Fatalf("checkReplaced failed with %v", err)
+	}
+	if !reopened {
+		t.Fatalf("checkReplaced did not reopen the file")
+	}
+	if err := f.drain(ctx); err != nil {
+		t.Fatalf("drain failed with %v", err)
+	}
+	close(f.records)
+	expectFollowedRecords(t, f, "first", "second", "last", "rotated")
+}
@@ -2,27 +2,66 @@ package base
 
 import (
 	"container/list"
+	"context"
 	"errors"
 	"hash/maphash"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/omegaup/go-base/v3/logging"
 )
 
+// maxPrewarmConcurrency is the maximum number of calls to New that Prewarm
+// makes in parallel if the pool does not have MaxConcurrentNewPerKey set.
+const maxPrewarmConcurrency = 16
+
 var (
 	// ErrKeyNotFound will be returned from Get to indicate that the key was not
 	// found to prevent returning a zero value.
 	ErrKeyNotFound = errors.New("key not found")
+
+	// ErrKeyedPoolClosed will be returned from Get and Prewarm after the pool
+	// has been closed.
+	ErrKeyedPoolClosed = errors.New("keyed pool closed")
 )
 
 // KeyedPool is an implementation of a length-bounded set of objects, each of
 // which is associated with a key. If the objects in the pool exceed the
 // maximum length (with a default of 256), the least-recently-used item in the
-// pool will be evicted.  Two callbacks can be provided and will be invoked
-// when a new object should atomically be created when calling Get() and a
-// suitable object is not available, and when an object is evicted due to lack
-// of space.
+// pool will be evicted. Objects can also be evicted after being idle in the
+// pool for too long, or after they exceed their maximum lifetime. Two
+// callbacks can be provided and will be invoked when a new object should
+// atomically be created when calling Get() and a suitable object is not
+// available, and when an object is evicted due to lack of space. Objects can
+// optionally be validated when they are obtained from and returned to the
+// pool, and the ones that are found to be broken are evicted.
+//
+// Optionally, the number of objects that are checked out of the pool (obtained
+// through Get and not yet returned through Put or Discard) can be bounded, per
+// key and in total. Once the limit is reached, Get will block until an object
+// is returned.
 type KeyedPool[T any] struct {
-	seed   maphash.Seed
-	shards []*poolShard[T]
+	// outstanding is the number of objects that are checked out. It is
+	// accessed atomically, so it needs to be the first field to guarantee its
+	// alignment.
+	outstanding int64
+
+	// closed is set atomically once Close is called, and drained is closed
+	// once there are no outstanding objects after that.
+	closed      uint32
+	drained     chan struct{}
+	drainedOnce sync.Once
+
+	seed      maphash.Seed
+	shards    []*poolShard[T]
+	limiter   *poolLimiter
+	onEvicted func(key string, value T)
+	leaks     poolLeakOptions
+
+	done      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
 }
 
 // KeyedPoolOptions are options that can be passed to NewKeyedPool to customize
@@ -43,6 +82,105 @@ type KeyedPoolOptions[T any] struct {
 	// OnEvicted is a callback that will be invoked when an object is evicted
 	// from the pool.
 	OnEvicted func(key string, value T)
+
+	// MaxActivePerKey is the maximum number of objects associated with the
+	// same key that can be checked out of the pool at any given time. Get will
+	// block until an object is returned if the limit is reached. There is no
+	// limit if unset.
+	MaxActivePerKey int
+
+	// MaxActive is the maximum number of objects that can be checked out of
+	// the pool at any given time, regardless of their key. Get will block
+	// until an object is returned if the limit is reached. There is no limit if
+	// unset.
+	MaxActive int
+
+	// IdleTimeout is the maximum amount of time that an object can stay in the
+	// pool without being used. Objects that exceed it are evicted. There is no
+	// limit if unset.
+	IdleTimeout Duration
+
+	// MaxLifetime is the maximum amount of time since an object was created
+	// before it is evicted, regardless of how recently it was used. Objects
+	// that are returned to the pool after exceeding it are evicted
+	// immediately. Objects that are returned through Put are assumed to be
+	// the ones with the same key that have been checked out the longest, so
+	// their exact creation time is only known if they are obtained through
+	// Acquire and returned through their lease. There is no limit if unset.
+	MaxLifetime Duration
+
+	// ReapInterval is how often the expired objects are evicted in the
+	// background. The default is half of the smallest of IdleTimeout and
+	// MaxLifetime, with a minimum of one second, if any of them is set.
+	ReapInterval Duration
+
+	// ValidateOnGet is a callback that will be invoked with every object that
+	// was previously in the pool before it is returned by Get. If it returns an
+	// error, the object is evicted and Get tries with the next object in the
+	// pool, or creates a new one if there are none left. Newly-created objects
+	// are not validated.
+	ValidateOnGet func(key string, value T) error
+
+	// ValidateOnPut is a callback that will be invoked with every object that
+	// is returned to the pool through Put. If it returns an error, the object
+	// is evicted instead of being stored.
+	ValidateOnPut func(key string, value T) error
+
+	// MaxConcurrentNewPerKey is the maximum number of calls to New that can be
+	// in flight for the same key at any given time. If set, Get calls that
+	// miss the pool wait in a queue, and New is invoked in the background on
+	// their behalf, only as many times as needed to give an object to each of
+	// them. Every object that is created, or that is returned to the pool with
+	// the same key while callers are waiting, is handed to the caller at the
+	// head of the queue, so a caller never waits for a call to New of its own
+	// if another object becomes available first. If a call to New fails, all
+	// the callers in the queue fail with the same error. Setting it to 1
+	// prevents a thundering herd of expensive concurrent creations when many
+	// callers miss the same key at once, at the cost of serializing them.
+	// There is no limit if unset.
+	MaxConcurrentNewPerKey int
+
+	// Metrics is where the pool counters and the number of entries are
+	// published, in addition to being available through Stats. They are not
+	// published if unset.
+	Metrics Metrics
+
+	// MetricsPrefix is the prefix of the names of the metrics published to
+	// Metrics. The default is "keyed_pool" if unset.
+	MetricsPrefix string
+
+	// LeakDetection enables a debug mode in which Acquire records the stack
+	// of its caller, and leases that are garbage-collected without having
+	// been released are reported. The objects of those leases are discarded.
+	// This is expensive, so it should not be enabled in production.
+	LeakDetection bool
+
+	// LeakTimeout is the maximum amount of time a lease can be held before it
+	// is reported as leaked. It is only used if LeakDetection is enabled.
+	// Leases are not reported because of the time they are held if unset.
+	LeakTimeout Duration
+
+	// OnLeak is invoked for every lease that is reported as leaked.
+	OnLeak func(err *KeyedPoolLeakError)
+
+	// Log is used to report the leases that are leaked, if OnLeak is unset.
+	// Leaks are silently ignored if neither is set.
+	Log logging.Logger
+
+	// EvictionPolicy chooses which object is evicted when the pool is full.
+	// The default is EvictLRU if unset.
+	EvictionPolicy KeyedPoolEvictionPolicy
+
+	// ReuseOrder chooses which of the objects associated with a key is
+	// returned by Get. The default is ReuseFIFO if unset.
+	ReuseOrder ReuseOrder
+
+	// Dispatcher is used to invoke OnEvicted in the background, so that
+	// callers are not stalled by slow teardowns. Use Dispatcher.Wait to wait
+	// for the pending evictions. OnEvicted must not dispatch more callbacks to
+	// the same Dispatcher, since that can deadlock once its queue is full.
+	// OnEvicted is invoked on the goroutine that caused the eviction if unset.
+	Dispatcher *CallbackDispatcher
 }
 
 // NewKeyedPool creates a new object pool with the provided options.
@@ -53,34 +191,201 @@ func NewKeyedPool[T any](options KeyedPoolOptions[T]) *KeyedPool[T] {
 	if options.MaxEntries == 0 {
 		options.MaxEntries = 256
 	}
+	if options.MetricsPrefix == "" {
+		options.MetricsPrefix = "keyed_pool"
+	}
+	if options.EvictionPolicy == nil {
+		options.EvictionPolicy = EvictLRU
+	}
+	_, lru := options.EvictionPolicy.(lruEvictionPolicy)
+	if options.OnEvicted != nil && options.Dispatcher != nil {
+		onEvicted, dispatcher := options.OnEvicted, options.Dispatcher
+		options.OnEvicted = func(key string, value T) {
+			dispatcher.Dispatch(func() { onEvicted(key, value) })
+		}
+	}
 	pool := &KeyedPool[T]{
-		seed:   maphash.MakeSeed(),
-		shards: make([]*poolShard[T], options.Shards),
+		seed:      maphash.MakeSeed(),
+		shards:    make([]*poolShard[T], options.Shards),
+		onEvicted: options.OnEvicted,
+		done:      make(chan struct{}),
+		drained:   make(chan struct{}),
+		leaks: poolLeakOptions{
+			enabled: options.LeakDetection,
+			timeout: time.Duration(options.LeakTimeout),
+			onLeak:  options.OnLeak,
+			log:     options.Log,
+		},
+	}
+	if options.MaxActivePerKey > 0 || options.MaxActive > 0 {
+		pool.limiter = newPoolLimiter(options.MaxActivePerKey, options.MaxActive)
 	}
 	for i := range pool.shards {
 		pool.shards[i] = &poolShard[T]{
-			new:        options.New,
-			onEvicted:  options.OnEvicted,
-			maxEntries: (options.MaxEntries + (options.Shards - 1)) / options.Shards,
-			list:       list.New(),
-			entries:    make(map[string]*list.List),
+			new:           options.New,
+			onEvicted:     options.OnEvicted,
+			validateOnGet: options.ValidateOnGet,
+			validateOnPut: options.ValidateOnPut,
+			maxNew:        options.MaxConcurrentNewPerKey,
+			creating:      make(map[string]*poolCreation[T]),
+			metrics:       options.Metrics,
+			metricsPrefix: options.MetricsPrefix,
+			closed:        &pool.closed,
+			maxEntries:    (options.MaxEntries + (options.Shards - 1)) / options.Shards,
+			idleTimeout:   time.Duration(options.IdleTimeout),
+			maxLifetime:   time.Duration(options.MaxLifetime),
+			now:           time.Now,
+			list:          list.New(),
+			entries:       make(map[string]*list.List),
+			checkedOut:    make(map[string]*list.List),
+			policy:        options.EvictionPolicy,
+			lru:           lru,
+			reuseOrder:    options.ReuseOrder,
 		}
 	}
+	if options.IdleTimeout > 0 || options.MaxLifetime > 0 {
+		reapInterval := time.Duration(options.ReapInterval)
+		if reapInterval <= 0 {
+			reapInterval = time.Duration(options.IdleTimeout)
+			if options.MaxLifetime > 0 && (reapInterval <= 0 || time.Duration(options.MaxLifetime) < reapInterval) {
+				reapInterval = time.Duration(options.MaxLifetime)
+			}
+			reapInterval = Max(reapInterval/2, time.Second)
+		}
+		pool.wg.Add(1)
+		go pool.reapPeriodically(reapInterval)
+	}
 	return pool
 }
 
 // Get obtains one element from the pool. If it was already present, the
 // element is removed from the pool and returned. Otherwise, a new one will be
 // created. If the New callback function is missing, it will return
-// ErrKeyNotFound.
+// ErrKeyNotFound. If the pool limits the number of objects that can be checked
+// out, Get can block indefinitely. Once the pool is closed, it will return
+// ErrKeyedPoolClosed.
 func (p *KeyedPool[T]) Get(key string) (T, error) {
-	return p.shards[p.hash(key)].get(key)
+	return p.GetContext(context.Background(), key)
+}
+
+// GetContext is like Get, but if the pool limits the number of objects that
+// can be checked out and the limit has been reached, it blocks until an object
+// is returned to the pool or ctx is done, in which case ctx.Err() is returned.
+// Callers that are blocked are served in the order in which they arrived,
+// except that callers that are only blocked by MaxActivePerKey do not hold
+// back the ones with other keys. If the pool has MaxConcurrentNewPerKey set,
+// callers that miss the pool are also served in the order in which they
+// arrived, as objects with their key become available.
+func (p *KeyedPool[T]) GetContext(ctx context.Context, key string) (T, error) {
+	entry, err := p.getEntry(ctx, key)
+	if err != nil {
+		var zero T
+		return zero, err
+	}
+	return entry.value, nil
+}
+
+// getEntry checks out an object, and returns it along with the information
+// that needs to be preserved until it is put back.
+func (p *KeyedPool[T]) getEntry(ctx context.Context, key string) (*poolEntry[T], error) {
+	// The object is counted as checked out before checking whether the pool is
+	// closed, so that Close can never miss it.
+	atomic.AddInt64(&p.outstanding, 1)
+	if atomic.LoadUint32(&p.closed) != 0 {
+		p.checkIn()
+		return nil, ErrKeyedPoolClosed
+	}
+	if p.limiter != nil {
+		if err := p.limiter.acquire(ctx, key); err != nil {
+			p.checkIn()
+			return nil, err
+		}
+	}
+	shard := p.shards[p.hash(key)]
+	entry, err := shard.get(ctx, key)
+	if err != nil {
+		p.release(key)
+		return nil, err
+	}
+	shard.checkOut(entry)
+	return entry, nil
 }
 
 // Put inserts an element into the pool. This operation could cause the
-// least-recently-used element to be evicted.
+// least-recently-used element to be evicted. Once the pool is closed, the
+// element is evicted instead. Elements that are put in the pool with a key
+// that has no elements checked out are not counted as returned, so they do
+// not free any of the slots bounded by MaxActivePerKey and MaxActive. Since
+// the pool cannot tell apart the elements that have the same key, it assumes
+// that they are returned in the order in which they were checked out, and the
+// element inherits the creation time and number of uses of the one that has
+// been checked out the longest. Elements that are put in the pool without
+// having been checked out are considered to be created at that point.
 func (p *KeyedPool[T]) Put(key string, value T) {
-	p.shards[p.hash(key)].put(key, value)
+	p.putEntry(&poolEntry[T]{key: key, value: value})
+}
+
+// putEntry returns an object that was checked out to the pool.
+func (p *KeyedPool[T]) putEntry(entry *poolEntry[T]) {
+	shard := p.shards[p.hash(entry.key)]
+	checkedOut := shard.checkIn(entry)
+	shard.put(entry)
+	if checkedOut {
+		p.release(entry.key)
+	}
+}
+
+// Discard destroys an element that was obtained through Get instead of
+// returning it to the pool, for example because it is broken. The OnEvicted
+// callback is invoked with the element, and it is counted as an eviction in
+// the statistics of the pool.
+func (p *KeyedPool[T]) Discard(key string, value T) {
+	p.discardEntry(&poolEntry[T]{key: key, value: value})
+}
+
+// discardEntry destroys an object that was checked out instead of returning
+// it to the pool.
+func (p *KeyedPool[T]) discardEntry(entry *poolEntry[T]) {
+	shard := p.shards[p.hash(entry.key)]
+	shard.countEvictions(poolEvictionDiscarded, 1)
+	if shard.checkIn(entry) {
+		p.release(entry.key)
+	}
+	if p.onEvicted != nil {
+		p.onEvicted(entry.key, entry.value)
+	}
+}
+
+// release frees the slot of an object with the provided key that is no
+// longer checked out.
+func (p *KeyedPool[T]) release(key string) {
+	if p.limiter != nil {
+		p.limiter.release(key)
+	}
+	p.checkIn()
+}
+
+// checkIn records that an object is no longer checked out.
+func (p *KeyedPool[T]) checkIn() {
+	for {
+		outstanding := atomic.LoadInt64(&p.outstanding)
+		if outstanding <= 0 {
+			return
+		}
+		if !atomic.CompareAndSwapInt64(&p.outstanding, outstanding, outstanding-1) {
+			continue
+		}
+		if outstanding == 1 && atomic.LoadUint32(&p.closed) != 0 {
+			p.drainedOnce.Do(func() { close(p.drained) })
+		}
+		return
+	}
+}
+
+// Active returns the number of elements that are currently checked out of the
+// pool.
+func (p *KeyedPool[T]) Active() int {
+	return int(atomic.LoadInt64(&p.outstanding))
 }
 
 // Len returns the number of elements in the pool.
@@ -106,6 +411,100 @@ func (p *KeyedPool[T]) Clear() {
 	}
 }
 
+// Reap evicts all the objects that have exceeded their IdleTimeout or
+// MaxLifetime. This is done periodically in the background, so there is
+// normally no need to call it.
+func (p *KeyedPool[T]) Reap() {
+	for _, shard := range p.shards {
+		shard.reap()
+	}
+}
+
+// SetMaxEntries changes the maximum number of items in the pool, evicting
+// items as needed if it shrinks.
+func (p *KeyedPool[T]) SetMaxEntries(maxEntries int) {
+	shards := len(p.shards)
+	for _, shard := range p.shards {
+		shard.setMaxEntries((maxEntries + (shards - 1)) / shards)
+	}
+}
+
+// Prewarm creates n objects associated with key by invoking New in parallel,
+// and puts them in the pool. At most MaxConcurrentNewPerKey calls to New are
+// in flight for the key at any given time, including the ones made on behalf
+// of Get, or 16 if unset. The objects that were created successfully are kept
+// even if some of the others fail, in which case the first error is returned.
+func (p *KeyedPool[T]) Prewarm(key string, n int) error {
+	if atomic.LoadUint32(&p.closed) != 0 {
+		return ErrKeyedPoolClosed
+	}
+	shard := p.shards[p.hash(key)]
+	workers := maxPrewarmConcurrency
+	if shard.maxNew > 0 {
+		workers = shard.maxNew
+	}
+	workers = Min(workers, n)
+
+	pending := make(chan struct{}, n)
+	for i := 0; i < n; i++ {
+		pending <- struct{}{}
+	}
+	close(pending)
+	errs := make(chan error, n)
+	for i := 0; i < workers; i++ {
+		go func() {
+			for range pending {
+				errs <- shard.prewarm(key)
+			}
+		}()
+	}
+	var firstErr error
+	for i := 0; i < n; i++ {
+		if err := <-errs; err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Close drains the pool. It stops evicting expired objects in the
+// background, makes further calls to Get fail and further calls to Put evict
+// their objects, evicts all the objects in the pool, and then waits until all
+// the objects that are checked out are returned or ctx is done, in which case
+// ctx.Err() is returned. It is safe to call Close more than once.
+func (p *KeyedPool[T]) Close(ctx context.Context) error {
+	p.closeOnce.Do(func() {
+		atomic.StoreUint32(&p.closed, 1)
+		close(p.done)
+		if atomic.LoadInt64(&p.outstanding) == 0 {
+			p.drainedOnce.Do(func() { close(p.drained) })
+		}
+	})
+	p.wg.Wait()
+	p.Clear()
+
+	select {
+	case <-p.drained:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (p *KeyedPool[T]) reapPeriodically(interval time.Duration) {
+	defer p.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+		}
+		p.Reap()
+	}
+}
+
 func (p *KeyedPool[T]) hash(key string) uint64 {
 	var h maphash.Hash
 	h.SetSeed(p.seed)
@@ -122,10 +521,20 @@ func (p *KeyedPool[T]) hash(key string) uint64 {
 //   - entries, the per-key list of poolEntry objects. This is used to be able to
 //     get all the per-key poolEntry objects in a round-robin fashion.
 type poolShard[T any] struct {
+	// counters are accessed atomically, so they need to be the first field to
+	// guarantee their alignment.
+	counters poolCounters
+
 	sync.RWMutex
 
-	new       func(key string) (T, error)
-	onEvicted func(key string, value T)
+	// closed points to the flag of the pool that is set once it is closed. It
+	// is accessed atomically.
+	closed *uint32
+
+	new           func(key string) (T, error)
+	onEvicted     func(key string, value T)
+	validateOnGet func(key string, value T) error
+	validateOnPut func(key string, value T) error
 
 	// maxEntries is the maximum number of entries that should be in the list of
 	// poolEntry objects.
@@ -138,12 +547,76 @@ type poolShard[T any] struct {
 	// entries is a mapping from keys to a list of poolEntry objects that are
 	// associated with that key.
 	entries map[string]*list.List
+
+	// idleTimeout and maxLifetime are the expiration limits for the entries.
+	idleTimeout time.Duration
+	maxLifetime time.Duration
+	now         func() time.Time
+
+	// checkedOut is a mapping from keys to a list of the poolEntry objects
+	// that are currently checked out, in the order in which they were checked
+	// out. This is used to remember when the objects were created and how many
+	// times they have been used while they are out of the pool.
+	checkedOut map[string]*list.List
+
+	// policy chooses the entry to evict, unless lru is set, in which case the
+	// oldest entry in list is evicted without consulting it.
+	policy KeyedPoolEvictionPolicy
+	lru    bool
+
+	// reuseOrder chooses the entry that is taken from the per-key lists.
+	reuseOrder ReuseOrder
+
+	// maxNew is the maximum number of in-flight calls to new per key, and
+	// creating tracks them, along with the callers that are waiting for them,
+	// for every key that has at least one.
+	maxNew   int
+	creating map[string]*poolCreation[T]
+
+	metrics       Metrics
+	metricsPrefix string
+}
+
+// poolCreation tracks the in-flight calls to new for a single key.
+type poolCreation[T any] struct {
+	// count is the number of in-flight calls.
+	count int
+
+	// waiters is the queue of *poolHandoff objects of the callers that are
+	// waiting for an object with the key, in order of arrival.
+	waiters *list.List
+
+	// freed is closed and replaced every time count decreases, so that
+	// Prewarm can wait for its turn to call new.
+	freed chan struct{}
 }
 
+// poolHandoff is where an object, or the error of the call to new that failed
+// to create it, is handed to a caller that is waiting for one.
+type poolHandoff[T any] struct {
+	ready chan struct{}
+	entry *poolEntry[T]
+	err   error
+}
+
+// poolEntry is an object that is either in the pool or checked out of it. The
+// entries of the objects that are checked out are not in any list, and are
+// kept by their leases until they are put back.
 type poolEntry[T any] struct {
 	key   string
 	value T
 
+	// created is the time at which the value was created, and returned is the
+	// time at which it was last put in the pool. created is zero for objects
+	// that are being put in the pool until they inherit it from the entry of an
+	// object that was checked out.
+	created  time.Time
+	returned time.Time
+
+	// uses is the number of times the value has been checked out. It is
+	// inherited along with created.
+	uses uint64
+
 	// shardElement is the node within the list of all of the elements in the
 	// shard, in the order in which they were used.
 	shardElement *list.Element
@@ -151,51 +624,308 @@ type poolEntry[T any] struct {
 	// entriesElement is the node within the list of all of the elements that
 	// have the same key, in the order in which they were used.
 	entriesElement *list.Element
+
+	// checkedOutElement is the node within the list of all of the elements
+	// that have the same key and are checked out, if this one is.
+	checkedOutElement *list.Element
 }
 
-func (p *poolShard[T]) get(key string) (T, error) {
+func (p *poolShard[T]) get(ctx context.Context, key string) (*poolEntry[T], error) {
+	for {
+		entry, ok := p.take(key)
+		if !ok {
+			break
+		}
+		if p.validateOnGet == nil {
+			p.count(&p.counters.hits, "_hits_total", 1)
+			return entry, nil
+		}
+		if err := p.validateOnGet(key, entry.value); err == nil {
+			p.count(&p.counters.hits, "_hits_total", 1)
+			return entry, nil
+		}
+		p.discardInvalid(key, entry.value)
+	}
+	if p.maxNew <= 0 || p.new == nil {
+		p.count(&p.counters.misses, "_misses_total", 1)
+		return p.create(key)
+	}
+
 	p.Lock()
-	entryList, ok := p.entries[key]
+	if _, ok := p.entries[key]; ok {
+		// An object was put in the pool after looking for one.
+		p.Unlock()
+		return p.get(ctx, key)
+	}
+	creation := p.creationLocked(key)
+	handoff := &poolHandoff[T]{ready: make(chan struct{})}
+	element := creation.waiters.PushBack(handoff)
+	p.startCreationsLocked(key, creation)
+	p.Unlock()
+
+	p.count(&p.counters.misses, "_misses_total", 1)
+
+	select {
+	case <-handoff.ready:
+		return handoff.entry, handoff.err
+	case <-ctx.Done():
+	}
+
+	p.Lock()
+	select {
+	case <-handoff.ready:
+		// The object was handed over concurrently with the cancellation, so
+		// it needs to go back to the pool.
+		p.Unlock()
+		if handoff.entry != nil {
+			p.put(handoff.entry)
+		}
+	default:
+		creation.waiters.Remove(element)
+		p.Unlock()
+	}
+	return nil, ctx.Err()
+}
+
+// creationLocked returns the creation for key, adding it if needed.
+func (p *poolShard[T]) creationLocked(key string) *poolCreation[T] {
+	creation, ok := p.creating[key]
 	if !ok {
-		builder := p.new
+		creation = &poolCreation[T]{
+			waiters: list.New(),
+			freed:   make(chan struct{}),
+		}
+		p.creating[key] = creation
+	}
+	return creation
+}
+
+// finishCreationLocked records that one of the in-flight calls to new for key
+// has finished, starting new ones if any of the callers still need them.
+func (p *poolShard[T]) finishCreationLocked(key string, creation *poolCreation[T]) {
+	creation.count--
+	close(creation.freed)
+	creation.freed = make(chan struct{})
+	p.startCreationsLocked(key, creation)
+	if creation.count == 0 {
+		// No more calls were needed, so there are no waiters left either.
+		delete(p.creating, key)
+	}
+}
+
+// prewarm creates an object with key and puts it in the pool. If maxNew is
+// set, it waits until it can be invoked without exceeding it.
+func (p *poolShard[T]) prewarm(key string) error {
+	if p.maxNew <= 0 {
+		entry, err := p.create(key)
+		if err != nil {
+			return err
+		}
+		p.put(entry)
+		return nil
+	}
+
+	p.Lock()
+	creation := p.creationLocked(key)
+	for creation.count >= p.maxNew {
+		freed := creation.freed
 		p.Unlock()
-		if builder == nil {
-			var zero T
-			return zero, ErrKeyNotFound
+		<-freed
+		p.Lock()
+		creation = p.creationLocked(key)
+	}
+	creation.count++
+	p.Unlock()
+
+	entry, err := p.create(key)
+
+	p.Lock()
+	p.finishCreationLocked(key, creation)
+	p.Unlock()
+
+	if err != nil {
+		return err
+	}
+	// This hands the object to a caller that is waiting for one, if any.
+	p.put(entry)
+	return nil
+}
+
+// startCreationsLocked invokes new in the background for the callers that are
+// waiting for an object with key and are not going to get one from the calls
+// that are already in flight, up to maxNew calls.
+func (p *poolShard[T]) startCreationsLocked(key string, creation *poolCreation[T]) {
+	for creation.count < p.maxNew && creation.count < creation.waiters.Len() {
+		creation.count++
+		go p.runCreation(key, creation)
+	}
+}
+
+// runCreation invokes new and hands the object to the caller at the head of
+// the queue of the creation. If new fails, all the callers in the queue fail
+// with the same error.
+func (p *poolShard[T]) runCreation(key string, creation *poolCreation[T]) {
+	entry, err := p.create(key)
+
+	p.Lock()
+	if err != nil {
+		for e := creation.waiters.Front(); e != nil; e = creation.waiters.Front() {
+			handoff := creation.waiters.Remove(e).(*poolHandoff[T])
+			handoff.err = err
+			close(handoff.ready)
 		}
-		return builder(key)
+	} else if e := creation.waiters.Front(); e != nil {
+		handoff := creation.waiters.Remove(e).(*poolHandoff[T])
+		handoff.entry = entry
+		close(handoff.ready)
+		entry = nil
 	}
-	entry := entryList.Back().Value.(*poolEntry[T])
-	entryList.Remove(entry.entriesElement)
-	p.list.Remove(entry.shardElement)
-	if entryList.Len() == 0 {
-		delete(p.entries, key)
+	p.finishCreationLocked(key, creation)
+	p.Unlock()
+
+	if entry != nil {
+		// All the callers that were waiting for the object gave up.
+		p.put(entry)
+	}
+}
+
+// take removes the most suitable unexpired object associated with key from
+// the shard, evicting any expired objects it finds along the way.
+func (p *poolShard[T]) take(key string) (*poolEntry[T], bool) {
+	p.Lock()
+	var evictedEntries []func()
+	defer func() {
+		for _, evictedEntry := range evictedEntries {
+			evictedEntry()
+		}
+	}()
+
+	now := p.now()
+	for {
+		entryList, ok := p.entries[key]
+		if !ok {
+			break
+		}
+		var entry *poolEntry[T]
+		if p.reuseOrder == ReuseLIFO {
+			entry = entryList.Front().Value.(*poolEntry[T])
+		} else {
+			entry = entryList.Back().Value.(*poolEntry[T])
+		}
+		if p.expiredLocked(entry, now) {
+			if evictedEntry := p.removeEntryLocked(entry, poolEvictionExpired); evictedEntry != nil {
+				evictedEntries = append(evictedEntries, evictedEntry)
+			}
+			continue
+		}
+		entryList.Remove(entry.entriesElement)
+		p.list.Remove(entry.shardElement)
+		if entryList.Len() == 0 {
+			delete(p.entries, key)
+		}
+		p.entriesChanged(-1)
+		// clear all references for easier garbage collection.
+		entry.entriesElement = nil
+		entry.shardElement = nil
+		entry.uses++
+		p.Unlock()
+		return entry, true
 	}
-	// clear all references for easier garbage collection.
-	entry.entriesElement = nil
-	entry.shardElement = nil
-	result := entry.value
 	p.Unlock()
-	return result, nil
+
+	return nil, false
+}
+
+// create builds a new object associated with key.
+func (p *poolShard[T]) create(key string) (*poolEntry[T], error) {
+	if p.new == nil {
+		return nil, ErrKeyNotFound
+	}
+	now := p.now()
+	value, err := p.new(key)
+	p.count(&p.counters.news, "_news_total", 1)
+	if err != nil {
+		p.count(&p.counters.newFailures, "_new_failures_total", 1)
+		return nil, err
+	}
+	return &poolEntry[T]{
+		key:     key,
+		value:   value,
+		created: now,
+		uses:    1,
+	}, nil
 }
 
-func (p *poolShard[T]) put(key string, value T) {
+// discardInvalid evicts an object that failed validation.
+func (p *poolShard[T]) discardInvalid(key string, value T) {
+	p.countEvictions(poolEvictionInvalid, 1)
+	if p.onEvicted != nil {
+		p.onEvicted(key, value)
+	}
+}
+
+func (p *poolShard[T]) put(entry *poolEntry[T]) {
+	key, value := entry.key, entry.value
+	if p.validateOnPut != nil {
+		if err := p.validateOnPut(key, value); err != nil {
+			p.discardInvalid(key, value)
+			return
+		}
+	}
+
 	p.Lock()
 
+	if atomic.LoadUint32(p.closed) != 0 {
+		// The pool is closed, so the object is evicted. This is checked while
+		// holding the lock so that it cannot race with the Clear in Close.
+		p.rejectLocked(key, value, poolEvictionCleared)
+		return
+	}
+
+	now := p.now()
+	if entry.created.IsZero() {
+		entry.created = now
+	}
+	if entry.uses == 0 {
+		entry.uses = 1
+	}
+	if p.maxLifetime > 0 {
+		if now.Sub(entry.created) >= p.maxLifetime {
+			p.rejectLocked(key, value, poolEvictionExpired)
+			return
+		}
+	}
+
+	if p.maxEntries <= 0 {
+		// The pool has been shrunk to nothing, so the object is evicted.
+		p.rejectLocked(key, value, poolEvictionCapacity)
+		return
+	}
+
+	if creation, ok := p.creating[key]; ok && creation.waiters.Len() > 0 {
+		// A caller is waiting for an object with this key, so it is handed
+		// over instead of being stored.
+		handoff := creation.waiters.Remove(creation.waiters.Front()).(*poolHandoff[T])
+		entry.returned = now
+		entry.uses++
+		handoff.entry = entry
+		close(handoff.ready)
+		p.Unlock()
+		return
+	}
+
 	var evictedEntry func()
 	if p.list.Len() >= p.maxEntries {
-		evictedEntry = p.evictOldestLocked()
-	}
-	entry := &poolEntry[T]{
-		key:   key,
-		value: value,
+		evictedEntry = p.evictLocked()
 	}
+	entry.returned = now
 	_, ok := p.entries[key]
 	if !ok {
 		p.entries[key] = list.New()
 	}
 	entry.entriesElement = p.entries[key].PushFront(entry)
 	entry.shardElement = p.list.PushFront(entry)
+	p.entriesChanged(1)
 	p.Unlock()
 
 	if evictedEntry != nil {
@@ -203,6 +933,112 @@ func (p *poolShard[T]) put(key string, value T) {
 	}
 }
 
+// rejectLocked evicts an object that is not going to be stored in the shard
+// for the provided reason, and releases the lock.
+func (p *poolShard[T]) rejectLocked(key string, value T, reason poolEvictionReason) {
+	cb := p.onEvicted
+	p.Unlock()
+	p.countEvictions(reason, 1)
+	if cb != nil {
+		cb(key, value)
+	}
+}
+
+// checkOut records that the object of the entry was checked out.
+func (p *poolShard[T]) checkOut(entry *poolEntry[T]) {
+	p.Lock()
+	entryList, ok := p.checkedOut[entry.key]
+	if !ok {
+		entryList = list.New()
+		p.checkedOut[entry.key] = entryList
+	}
+	entry.checkedOutElement = entryList.PushBack(entry)
+	p.Unlock()
+}
+
+// checkIn records that the object of the entry is no longer checked out, and
+// returns whether there was one with the same key. If the entry itself is not
+// the one that was checked out, the one that has been checked out the longest
+// is used instead, and the entry inherits its creation time and number of
+// uses unless it already has them.
+func (p *poolShard[T]) checkIn(entry *poolEntry[T]) bool {
+	p.Lock()
+	defer p.Unlock()
+	entryList, ok := p.checkedOut[entry.key]
+	if !ok {
+		return false
+	}
+	element := entry.checkedOutElement
+	if element == nil {
+		element = entryList.Front()
+	}
+	checkedOut := entryList.Remove(element).(*poolEntry[T])
+	checkedOut.checkedOutElement = nil
+	if entryList.Len() == 0 {
+		delete(p.checkedOut, entry.key)
+	}
+	if entry.created.IsZero() {
+		entry.created = checkedOut.created
+		entry.uses = checkedOut.uses
+	}
+	return true
+}
+
+// setMaxEntries changes the maximum number of entries in the shard, evicting
+// entries as needed.
+func (p *poolShard[T]) setMaxEntries(maxEntries int) {
+	p.Lock()
+	p.maxEntries = maxEntries
+	var evictedEntries []func()
+	for p.list.Len() > p.maxEntries {
+		if evictedEntry := p.evictLocked(); evictedEntry != nil {
+			evictedEntries = append(evictedEntries, evictedEntry)
+		}
+	}
+	p.Unlock()
+
+	for _, evictedEntry := range evictedEntries {
+		evictedEntry()
+	}
+}
+
+// expiredLocked returns whether the entry has exceeded its idle timeout or
+// its maximum lifetime.
+func (p *poolShard[T]) expiredLocked(entry *poolEntry[T], now time.Time) bool {
+	if p.idleTimeout > 0 && now.Sub(entry.returned) >= p.idleTimeout {
+		return true
+	}
+	if p.maxLifetime > 0 && now.Sub(entry.created) >= p.maxLifetime {
+		return true
+	}
+	return false
+}
+
+// reap evicts all the expired entries in the shard.
+func (p *poolShard[T]) reap() {
+	if p.idleTimeout <= 0 && p.maxLifetime <= 0 {
+		return
+	}
+	p.Lock()
+	now := p.now()
+	var evictedEntries []func()
+	for e := p.list.Front(); e != nil; {
+		next := e.Next()
+		entry := e.Value.(*poolEntry[T])
+		if p.expiredLocked(entry, now) {
+			if evictedEntry := p.removeEntryLocked(entry, poolEvictionExpired); evictedEntry != nil {
+				evictedEntries = append(evictedEntries, evictedEntry)
+			}
+		}
+		e = next
+	}
+	p.Unlock()
+
+	for _, evictedEntry := range evictedEntries {
+		evictedEntry()
+	}
+}
+
 func (p *poolShard[T]) remove(key string) {
 	p.Lock()
 
@@ -224,6 +1060,8 @@ func (p *poolShard[T]) remove(key string) {
 		}
 	}
 	delete(p.entries, key)
+	p.entriesChanged(-entryList.Len())
+	p.countEvictions(poolEvictionRemoved, entryList.Len())
 	p.Unlock()
 
 	for _, evictedEntry := range evictedEntries {
@@ -243,6 +1081,8 @@ func (p *poolShard[T]) clear() {
 			evictedEntries = append(evictedEntries, func() { cb(k, v) })
 		}
 	}
+	p.entriesChanged(-p.list.Len())
+	p.countEvictions(poolEvictionCleared, p.list.Len())
 	p.list.Init()
 	p.entries = make(map[string]*list.List)
 	p.Unlock()
@@ -252,22 +1092,53 @@ func (p *poolShard[T]) clear() {
 	}
 }
 
-// evictOldestLocked evicts the oldest entry in the shard. If the eviction
-// causes the per-entry list to be empty, it removes the per-entry list from
-// the entry mapping. This returns a (possibly nil) func that invokes the
-// eviction callback.
-func (p *poolShard[T]) evictOldestLocked() func() {
+// evictLocked evicts the entry in the shard that is chosen by the eviction
+// policy. If the eviction causes the per-entry list to be empty, it removes
+// the per-entry list from the entry mapping. This returns a (possibly nil)
+// func that invokes the eviction callback.
+func (p *poolShard[T]) evictLocked() func() {
 	shardElement := p.list.Back()
 	if shardElement == nil {
 		panic("list is empty")
 	}
-	entry := shardElement.Value.(*poolEntry[T])
+	victim := shardElement.Value.(*poolEntry[T])
+	if !p.lru {
+		victimInfo := p.entryInfoLocked(victim)
+		for e := shardElement.Prev(); e != nil; e = e.Prev() {
+			entry := e.Value.(*poolEntry[T])
+			info := p.entryInfoLocked(entry)
+			if p.policy.Less(info, victimInfo) {
+				victim = entry
+				victimInfo = info
+			}
+		}
+	}
+	return p.removeEntryLocked(victim, poolEvictionCapacity)
+}
+
+func (p *poolShard[T]) entryInfoLocked(entry *poolEntry[T]) KeyedPoolEntryInfo {
+	return KeyedPoolEntryInfo{
+		Key:        entry.key,
+		Created:    entry.created,
+		Returned:   entry.returned,
+		Uses:       entry.uses,
+		KeyEntries: p.entries[entry.key].Len(),
+	}
+}
+
+// removeEntryLocked removes the entry from the shard for the provided reason.
+// If the removal causes the per-entry list to be empty, it removes the
+// per-entry list from the entry mapping. This returns a (possibly nil) func
+// that invokes the eviction callback.
+func (p *poolShard[T]) removeEntryLocked(entry *poolEntry[T], reason poolEvictionReason) func() {
 	entryList := p.entries[entry.key]
 	entryList.Remove(entry.entriesElement)
 	p.list.Remove(entry.shardElement)
 	if entryList.Len() == 0 {
 		delete(p.entries, entry.key)
 	}
+	p.entriesChanged(-1)
+	p.countEvictions(reason, 1)
 	var evictedEntry func()
 	if p.onEvicted != nil {
 		cb := p.onEvicted
@@ -281,3 +1152,130 @@ func (p *poolShard[T]) evictOldestLocked() func() {
 	entry.shardElement = nil
 	return evictedEntry
 }
+
+// poolLimiter bounds the number of objects that are checked out of a
+// KeyedPool, per key and in total. Callers that cannot be admitted wait in a
+// FIFO queue. Callers with the same key are admitted in order, and so are the
+// ones that are waiting for the total limit, but a caller that is only
+// blocked by the limit of its own key does not hold back the ones behind it.
+type poolLimiter struct {
+	lock sync.Mutex
+
+	maxPerKey int
+	maxTotal  int
+
+	// active is the number of objects checked out per key, and total is the
+	// sum of all of them.
+	active map[string]int
+	total  int
+
+	// waiters is the queue of *poolWaiter objects, in order of arrival.
+	waiters *list.List
+}
+
+type poolWaiter struct {
+	key   string
+	ready chan struct{}
+}
+
+func newPoolLimiter(maxPerKey, maxTotal int) *poolLimiter {
+	return &poolLimiter{
+		maxPerKey: maxPerKey,
+		maxTotal:  maxTotal,
+		active:    make(map[string]int),
+		waiters:   list.New(),
+	}
+}
+
+// admissibleLocked returns whether one more object with the provided key can
+// be checked out.
+func (l *poolLimiter) admissibleLocked(key string) bool {
+	if l.maxTotal > 0 && l.total >= l.maxTotal {
+		return false
+	}
+	if l.maxPerKey > 0 && l.active[key] >= l.maxPerKey {
+		return false
+	}
+	return true
+}
+
+func (l *poolLimiter) admitLocked(key string) {
+	l.active[key]++
+	l.total++
+}
+
+// acquire reserves a slot for an object with the provided key, waiting until
+// one is available or ctx is done. Since every waiter in the queue is admitted
+// as soon as it can be, all of them are blocked either by the total limit,
+// which also blocks this caller, or by the limit of their own key, which also
+// blocks this caller if it has the same key. So a caller that can be admitted
+// right away never takes a slot away from an earlier one.
+func (l *poolLimiter) acquire(ctx context.Context, key string) error {
+	l.lock.Lock()
+	if l.admissibleLocked(key) {
+		l.admitLocked(key)
+		l.lock.Unlock()
+		return nil
+	}
+	waiter := &poolWaiter{
+		key:   key,
+		ready: make(chan struct{}),
+	}
+	element := l.waiters.PushBack(waiter)
+	l.lock.Unlock()
+
+	select {
+	case <-waiter.ready:
+		return nil
+	case <-ctx.Done():
+	}
+
+	l.lock.Lock()
+	select {
+	case <-waiter.ready:
+		// The slot was granted concurrently with the cancellation, so it needs
+		// to be handed to someone else.
+		l.lock.Unlock()
+		l.release(key)
+	default:
+		l.waiters.Remove(element)
+		l.lock.Unlock()
+	}
+	return ctx.Err()
+}
+
+// release frees a slot for an object with the provided key and hands the
+// freed capacity to the waiters at the head of the queue.
+func (l *poolLimiter) release(key string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.active[key] > 0 {
+		l.active[key]--
+		l.total--
+		if l.active[key] == 0 {
+			delete(l.active, key)
+		}
+	}
+	l.grantLocked()
+}
+
+// grantLocked admits the waiters in order of arrival, until the total limit
+// is reached. Waiters whose key has reached its limit are skipped, since the
+// slots of other keys would not let them in anyway, and the ones behind them
+// with the same key stay behind them.
+func (l *poolLimiter) grantLocked() {
+	for e := l.waiters.Front(); e != nil; {
+		if l.maxTotal > 0 && l.total >= l.maxTotal {
+			return
+		}
+		next := e.Next()
+		waiter := e.Value.(*poolWaiter)
+		if l.admissibleLocked(waiter.key) {
+			l.admitLocked(waiter.key)
+			l.waiters.Remove(e)
+			close(waiter.ready)
+		}
+		e = next
+	}
+}
@@ -0,0 +1,186 @@
+package base
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"runtime/debug"
+	"sync/atomic"
+	"time"
+
+	"github.com/omegaup/go-base/v3/logging"
+)
+
+// A KeyedPoolLease is an object that was checked out of a KeyedPool through
+// Acquire. Exactly one of Release or Discard must be called once the object is
+// no longer needed. Further calls to either of them are ignored.
+type KeyedPoolLease[T any] struct {
+	pool *KeyedPool[T]
+	key  string
+	info *poolLeaseInfo
+
+	// entry remembers when the object was created and how many times it has
+	// been used, so that they are preserved once it is put back.
+	entry *poolEntry[T]
+}
+
+// A KeyedPoolLeakError describes a lease that was not released in time, or
+// that was garbage-collected without being released.
+type KeyedPoolLeakError struct {
+	// Key is the key of the leased object.
+	Key string
+
+	// Acquired is the time at which the lease was acquired.
+	Acquired time.Time
+
+	// Stack is the stack trace of the call to Acquire.
+	Stack string
+
+	// Collected is true if the lease was garbage-collected without being
+	// released, and false if it exceeded the LeakTimeout.
+	Collected bool
+}
+
+func (e *KeyedPoolLeakError) Error() string {
+	if e.Collected {
+		return fmt.Sprintf(
+			"lease for key %q acquired at %s was garbage-collected without being released",
+			e.Key,
+			e.Acquired.Format(time.RFC3339Nano),
+		)
+	}
+	return fmt.Sprintf(
+		"lease for key %q acquired at %s has not been released after %s",
+		e.Key,
+		e.Acquired.Format(time.RFC3339Nano),
+		time.Since(e.Acquired),
+	)
+}
+
+// poolLeakOptions are the leak detection options of a KeyedPool.
+type poolLeakOptions struct {
+	enabled bool
+	timeout time.Duration
+	onLeak  func(err *KeyedPoolLeakError)
+	log     logging.Logger
+}
+
+func (o *poolLeakOptions) report(err *KeyedPoolLeakError) {
+	if o.onLeak != nil {
+		o.onLeak(err)
+	} else if o.log != nil {
+		o.log.Error("leaked pool lease", map[string]any{
+			"key":      err.Key,
+			"acquired": err.Acquired,
+			"stack":    err.Stack,
+			"err":      err,
+		})
+	}
+}
+
+// poolLeaseInfo is the state of a lease that needs to outlive it, since the
+// leak timer cannot hold a reference to the lease without preventing it from
+// being garbage-collected.
+type poolLeaseInfo struct {
+	// released is accessed atomically, so it needs to be the first field to
+	// guarantee its alignment.
+	released uint32
+
+	key      string
+	acquired time.Time
+	stack    string
+	timer    *time.Timer
+}
+
+func (i *poolLeaseInfo) leakError(collected bool) *KeyedPoolLeakError {
+	return &KeyedPoolLeakError{
+		Key:       i.key,
+		Acquired:  i.acquired,
+		Stack:     i.stack,
+		Collected: collected,
+	}
+}
+
+// Acquire is like GetContext, but returns the object wrapped in a lease that
+// remembers its key, so that it can be returned to the pool with Release or
+// destroyed with Discard. Unlike with Put, which can only assume which of the
+// objects with the same key is being returned, the exact creation time and
+// number of uses of the object are preserved when it is returned with
+// Release.
+func (p *KeyedPool[T]) Acquire(ctx context.Context, key string) (*KeyedPoolLease[T], error) {
+	entry, err := p.getEntry(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	lease := &KeyedPoolLease[T]{
+		pool:  p,
+		key:   key,
+		info:  &poolLeaseInfo{key: key},
+		entry: entry,
+	}
+	if !p.leaks.enabled {
+		return lease, nil
+	}
+
+	info := lease.info
+	info.acquired = time.Now()
+	info.stack = string(debug.Stack())
+	if p.leaks.timeout > 0 {
+		leaks := &p.leaks
+		info.timer = time.AfterFunc(p.leaks.timeout, func() {
+			if atomic.LoadUint32(&info.released) == 0 {
+				leaks.report(info.leakError(false))
+			}
+		})
+	}
+	runtime.SetFinalizer(lease, func(lease *KeyedPoolLease[T]) {
+		if !lease.finish() {
+			return
+		}
+		lease.pool.leaks.report(lease.info.leakError(true))
+		lease.pool.discardEntry(lease.entry)
+	})
+	return lease, nil
+}
+
+// Key returns the key of the leased object.
+func (l *KeyedPoolLease[T]) Key() string {
+	return l.key
+}
+
+// Value returns the leased object. It must not be used after the lease has
+// been released or discarded.
+func (l *KeyedPoolLease[T]) Value() T {
+	return l.entry.value
+}
+
+// Release returns the object to the pool.
+func (l *KeyedPoolLease[T]) Release() {
+	if !l.finish() {
+		return
+	}
+	runtime.SetFinalizer(l, nil)
+	l.pool.putEntry(l.entry)
+}
+
+// Discard destroys the object instead of returning it to the pool, for
+// example because it is broken.
+func (l *KeyedPoolLease[T]) Discard() {
+	if !l.finish() {
+		return
+	}
+	runtime.SetFinalizer(l, nil)
+	l.pool.discardEntry(l.entry)
+}
+
+// finish marks the lease as released, and returns whether this was the first
+// time it happened.
+func (l *KeyedPoolLease[T]) finish() bool {
+	if !atomic.CompareAndSwapUint32(&l.info.released, 0, 1) {
+		return false
+	}
+	if l.info.timer != nil {
+		l.info.timer.Stop()
+	}
+	return true
+}
@@ -0,0 +1,113 @@
+package base
+
+import (
+	"context"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKeyedPoolLease(t *testing.T) {
+	created := 0
+	var evicted []int
+	p := NewKeyedPool[int](KeyedPoolOptions[int]{
+		MaxActivePerKey: 1,
+		New: func(key string) (int, error) {
+			created++
+			return created, nil
+		},
+		OnEvicted: func(key string, value int) {
+			evicted = append(evicted, value)
+		},
+	})
+
+	lease, err := p.Acquire(context.Background(), "a")
+	if err != nil {
+		t.Fatalf("p.Acquire() failed with %v", err)
+	}
+	if lease.Key() != "a" || lease.Value() != 1 {
+		t.Errorf("lease = (%q, %d), want (%q, %d)", lease.Key(), lease.Value(), "a", 1)
+	}
+	lease.Release()
+	// Releasing twice is ignored, and does not free a second slot.
+	lease.Release()
+	lease.Discard()
+	if p.Len() != 1 || p.Active() != 0 {
+		t.Fatalf("p.Len(), p.Active() = %d, %d, want 1, 0", p.Len(), p.Active())
+	}
+
+	lease, err = p.Acquire(context.Background(), "a")
+	if err != nil {
+		t.Fatalf("p.Acquire() failed with %v", err)
+	}
+	if lease.Value() != 1 {
+		t.Errorf("lease.Value() = %d, want 1", lease.Value())
+	}
+	lease.Discard()
+	if p.Len() != 0 || p.Active() != 0 {
+		t.Fatalf("p.Len(), p.Active() = %d, %d, want 0, 0", p.Len(), p.Active())
+	}
+	if len(evicted) != 1 || evicted[0] != 1 {
+		t.Errorf("evicted = %v, want [1]", evicted)
+	}
+}
+
+func TestKeyedPoolLeakDetection(t *testing.T) {
+	leaks := make(chan *KeyedPoolLeakError, 2)
+	p := NewKeyedPool[int](KeyedPoolOptions[int]{
+		MaxActive:     1,
+		LeakDetection: true,
+		LeakTimeout:   Duration(10 * time.Millisecond),
+		New: func(key string) (int, error) {
+			return 1, nil
+		},
+		OnLeak: func(err *KeyedPoolLeakError) {
+			leaks <- err
+		},
+	})
+
+	// A lease that is held for too long is reported, but still works.
+	lease, err := p.Acquire(context.Background(), "slow")
+	if err != nil {
+		t.Fatalf("p.Acquire() failed with %v", err)
+	}
+	select {
+	case leak := <-leaks:
+		if leak.Key != "slow" || leak.Collected {
+			t.Errorf("leak = %+v, want a timeout for %q", leak, "slow")
+		}
+		if !strings.Contains(leak.Stack, "TestKeyedPoolLeakDetection") {
+			t.Errorf("leak.Stack = %q, want it to contain the caller", leak.Stack)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the slow lease was not reported")
+	}
+	lease.Release()
+
+	// A lease that is garbage-collected is reported and its slot is freed.
+	func() {
+		if _, err := p.Acquire(context.Background(), "forgotten"); err != nil {
+			t.Fatalf("p.Acquire() failed with %v", err)
+		}
+	}()
+	deadline := time.After(5 * time.Second)
+	for {
+		runtime.GC()
+		select {
+		case leak := <-leaks:
+			if leak.Key != "forgotten" {
+				t.Errorf("leak.Key = %q, want %q", leak.Key, "forgotten")
+			}
+			if leak.Collected {
+				if p.Active() != 0 {
+					t.Errorf("p.Active() = %d, want 0", p.Active())
+				}
+				return
+			}
+		case <-deadline:
+			t.Fatalf("the forgotten lease was not reported")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package base
+
+import (
+	"time"
+)
+
+// KeyedPoolEntryInfo is the information about an object in a KeyedPool that
+// an eviction policy can use to choose which object to evict.
+type KeyedPoolEntryInfo struct {
+	// Key is the key associated with the object.
+	Key string
+
+	// Created is the time at which the object was created.
+	Created time.Time
+
+	// Returned is the time at which the object was last put in the pool.
+	Returned time.Time
+
+	// Uses is the number of times the object has been checked out of the
+	// pool.
+	Uses uint64
+
+	// KeyEntries is the number of objects in the same shard of the pool that
+	// are associated with Key, including this one.
+	KeyEntries int
+}
+
+// A KeyedPoolEvictionPolicy chooses which object is evicted when a KeyedPool
+// is full.
+type KeyedPoolEvictionPolicy interface {
+	// Less returns whether a should be evicted before b.
+	Less(a, b KeyedPoolEntryInfo) bool
+}
+
+var (
+	// EvictLRU evicts the object that was returned to the pool the longest
+	// time ago. This is the default, and is the only policy that does not need
+	// to consider all the objects in the shard to choose one.
+	EvictLRU KeyedPoolEvictionPolicy = lruEvictionPolicy{}
+
+	// EvictLFU evicts the object that has been checked out the least number of
+	// times, breaking ties with EvictLRU.
+	EvictLFU KeyedPoolEvictionPolicy = lfuEvictionPolicy{}
+
+	// EvictFIFO evicts the object that was created the longest time ago.
+	EvictFIFO KeyedPoolEvictionPolicy = fifoEvictionPolicy{}
+
+	// EvictFairShare evicts one of the objects associated with the key that
+	// has the most objects in the pool, breaking ties with EvictLRU. This
+	// prevents a few busy keys from monopolizing the pool.
+	EvictFairShare KeyedPoolEvictionPolicy = fairShareEvictionPolicy{}
+)
+
+type lruEvictionPolicy struct{}
+
+func (lruEvictionPolicy) Less(a, b KeyedPoolEntryInfo) bool {
+	return a.Returned.Before(b.Returned)
+}
+
+type lfuEvictionPolicy struct{}
+
+func (lfuEvictionPolicy) Less(a, b KeyedPoolEntryInfo) bool {
+	if a.Uses != b.Uses {
+		return a.Uses < b.Uses
+	}
+	return a.Returned.Before(b.Returned)
+}
+
+type fifoEvictionPolicy struct{}
+
+func (fifoEvictionPolicy) Less(a, b KeyedPoolEntryInfo) bool {
+	return a.Created.Before(b.Created)
+}
+
+type fairShareEvictionPolicy struct{}
+
+func (fairShareEvictionPolicy) Less(a, b KeyedPoolEntryInfo) bool {
+	if a.KeyEntries != b.KeyEntries {
+		return a.KeyEntries > b.KeyEntries
+	}
+	return a.Returned.Before(b.Returned)
+}
+
+// ReuseOrder chooses which of the objects associated with a key in a
+// KeyedPool is returned by Get.
+type ReuseOrder int
+
+const (
+	// ReuseFIFO returns the object that was put in the pool the longest time
+	// ago. This spreads the use across all the objects, which keeps all of
+	// them from becoming idle.
+	ReuseFIFO ReuseOrder = iota
+
+	// ReuseLIFO returns the object that was put in the pool most recently.
+	// This keeps the objects that are used warm, and lets the rest become idle
+	// and expire.
+	ReuseLIFO
+)
@@ -0,0 +1,92 @@
+package base
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestKeyedPoolReuseOrder(t *testing.T) {
+	for _, tc := range []struct {
+		order    ReuseOrder
+		expected []int
+	}{
+		{ReuseFIFO, []int{1, 2, 3}},
+		{ReuseLIFO, []int{3, 2, 1}},
+	} {
+		p := NewKeyedPool[int](KeyedPoolOptions[int]{
+			ReuseOrder: tc.order,
+		})
+		for i := 1; i <= 3; i++ {
+			p.Put("a", i)
+		}
+		var got []int
+		for i := 0; i < 3; i++ {
+			v, err := p.Get("a")
+			if err != nil {
+				t.Fatalf("p.Get() failed with %v", err)
+			}
+			got = append(got, v)
+		}
+		if !reflect.DeepEqual(got, tc.expected) {
+			t.Errorf("reuse order %d: got %v, want %v", tc.order, got, tc.expected)
+		}
+	}
+}
+
+func TestKeyedPoolEvictionPolicy(t *testing.T) {
+	type object struct {
+		name string
+	}
+	for _, tc := range []struct {
+		name     string
+		policy   KeyedPoolEvictionPolicy
+		expected string
+	}{
+		{"lru", EvictLRU, "a1"},
+		{"lfu", EvictLFU, "b1"},
+		{"fifo", EvictFIFO, "b1"},
+		{"fair share", EvictFairShare, "c1"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var evicted []string
+			p := NewKeyedPool[*object](KeyedPoolOptions[*object]{
+				MaxEntries:     4,
+				Shards:         1,
+				EvictionPolicy: tc.policy,
+				OnEvicted: func(key string, value *object) {
+					evicted = append(evicted, value.name)
+				},
+			})
+			now := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+			p.shards[0].now = func() time.Time {
+				now = now.Add(time.Second)
+				return now
+			}
+			p.shards[0].new = func(key string) (*object, error) {
+				return &object{name: key + "1"}, nil
+			}
+
+			// b1 is created before a1, but a1 is returned first. a1 is used
+			// twice, and c has two objects.
+			get := func(key string) *object {
+				v, err := p.Get(key)
+				if err != nil {
+					t.Fatalf("p.Get() failed with %v", err)
+				}
+				return v
+			}
+			b1 := get("b")
+			p.Put("a", get("a"))
+			p.Put("a", get("a"))
+			p.Put("b", b1)
+			p.Put("c", &object{name: "c1"})
+			p.Put("c", &object{name: "c2"})
+			p.Put("d", &object{name: "d1"})
+
+			if !reflect.DeepEqual(evicted, []string{tc.expected}) {
+				t.Errorf("evicted = %v, want [%s]", evicted, tc.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,184 @@
+package base
+
+import (
+	"sync/atomic"
+)
+
+// KeyedPoolStats is a snapshot of the counters of a KeyedPool, or of one of
+// its shards.
+type KeyedPoolStats struct {
+	// Hits is the number of times Get returned an object that was in the pool.
+	Hits uint64
+
+	// Misses is the number of times Get did not find a suitable object in the
+	// pool.
+	Misses uint64
+
+	// News is the number of times New was invoked, and NewFailures is how many
+	// of those returned an error.
+	News        uint64
+	NewFailures uint64
+
+	// Evictions is the number of objects that were evicted from the pool, by
+	// reason.
+	Evictions KeyedPoolEvictions
+
+	// Entries is the number of objects that are currently in the pool.
+	Entries int
+}
+
+// KeyedPoolEvictions is the number of objects that were evicted from a
+// KeyedPool, by reason.
+type KeyedPoolEvictions struct {
+	// Capacity is the number of objects evicted to make room for others.
+	Capacity uint64
+
+	// Removed is the number of objects evicted through Remove.
+	Removed uint64
+
+	// Cleared is the number of objects evicted through Clear.
+	Cleared uint64
+
+	// Expired is the number of objects evicted because they exceeded their
+	// IdleTimeout or MaxLifetime.
+	Expired uint64
+
+	// Invalid is the number of objects evicted because they failed
+	// ValidateOnGet or ValidateOnPut.
+	Invalid uint64
+
+	// Discarded is the number of objects that were checked out and destroyed
+	// through Discard instead of being returned to the pool.
+	Discarded uint64
+}
+
+// Stats returns a snapshot of the counters of the pool, aggregated across all
+// shards.
+func (p *KeyedPool[T]) Stats() KeyedPoolStats {
+	var stats KeyedPoolStats
+	for _, shardStats := range p.ShardStats() {
+		stats.Hits += shardStats.Hits
+		stats.Misses += shardStats.Misses
+		stats.News += shardStats.News
+		stats.NewFailures += shardStats.NewFailures
+		stats.Evictions.Capacity += shardStats.Evictions.Capacity
+		stats.Evictions.Removed += shardStats.Evictions.Removed
+		stats.Evictions.Cleared += shardStats.Evictions.Cleared
+		stats.Evictions.Expired += shardStats.Evictions.Expired
+		stats.Evictions.Invalid += shardStats.Evictions.Invalid
+		stats.Evictions.Discarded += shardStats.Evictions.Discarded
+		stats.Entries += shardStats.Entries
+	}
+	return stats
+}
+
+// ShardStats returns a snapshot of the counters of each one of the shards of
+// the pool. This can be used to detect an uneven distribution of keys.
+func (p *KeyedPool[T]) ShardStats() []KeyedPoolStats {
+	stats := make([]KeyedPoolStats, len(p.shards))
+	for i, shard := range p.shards {
+		stats[i] = shard.stats()
+	}
+	return stats
+}
+
+// EntriesPerKey returns the number of objects that are currently in the pool
+// for each key.
+func (p *KeyedPool[T]) EntriesPerKey() map[string]int {
+	entries := make(map[string]int)
+	for _, shard := range p.shards {
+		shard.RLock()
+		for key, entryList := range shard.entries {
+			entries[key] = entryList.Len()
+		}
+		shard.RUnlock()
+	}
+	return entries
+}
+
+// poolCounters are the counters of a poolShard. All of them are accessed
+// atomically.
+type poolCounters struct {
+	hits        uint64
+	misses      uint64
+	news        uint64
+	newFailures uint64
+
+	evictedCapacity  uint64
+	evictedRemoved   uint64
+	evictedCleared   uint64
+	evictedExpired   uint64
+	evictedInvalid   uint64
+	evictedDiscarded uint64
+}
+
+// poolEvictionReason is the reason why an object was evicted from the pool.
+type poolEvictionReason int
+
+const (
+	poolEvictionCapacity poolEvictionReason = iota
+	poolEvictionRemoved
+	poolEvictionCleared
+	poolEvictionExpired
+	poolEvictionInvalid
+	poolEvictionDiscarded
+)
+
+func (p *poolShard[T]) stats() KeyedPoolStats {
+	p.RLock()
+	entries := p.list.Len()
+	p.RUnlock()
+	return KeyedPoolStats{
+		Hits:        atomic.LoadUint64(&p.counters.hits),
+		Misses:      atomic.LoadUint64(&p.counters.misses),
+		News:        atomic.LoadUint64(&p.counters.news),
+		NewFailures: atomic.LoadUint64(&p.counters.newFailures),
+		Evictions: KeyedPoolEvictions{
+			Capacity:  atomic.LoadUint64(&p.counters.evictedCapacity),
+			Removed:   atomic.LoadUint64(&p.counters.evictedRemoved),
+			Cleared:   atomic.LoadUint64(&p.counters.evictedCleared),
+			Expired:   atomic.LoadUint64(&p.counters.evictedExpired),
+			Invalid:   atomic.LoadUint64(&p.counters.evictedInvalid),
+			Discarded: atomic.LoadUint64(&p.counters.evictedDiscarded),
+		},
+		Entries: entries,
+	}
+}
+
+// count adds n to the counter, and publishes it to the metrics with the
+// provided name suffix.
+func (p *poolShard[T]) count(counter *uint64, name string, n int) {
+	if n <= 0 {
+		return
+	}
+	atomic.AddUint64(counter, uint64(n))
+	if p.metrics != nil {
+		p.metrics.CounterAdd(p.metricsPrefix+name, float64(n))
+	}
+}
+
+// countEvictions adds n to the eviction counter for the reason.
+func (p *poolShard[T]) countEvictions(reason poolEvictionReason, n int) {
+	switch reason {
+	case poolEvictionCapacity:
+		p.count(&p.counters.evictedCapacity, "_evictions_capacity_total", n)
+	case poolEvictionRemoved:
+		p.count(&p.counters.evictedRemoved, "_evictions_removed_total", n)
+	case poolEvictionCleared:
+		p.count(&p.counters.evictedCleared, "_evictions_cleared_total", n)
+	case poolEvictionExpired:
+		p.count(&p.counters.evictedExpired, "_evictions_expired_total", n)
+	case poolEvictionInvalid:
+		p.count(&p.counters.evictedInvalid, "_evictions_invalid_total", n)
+	case poolEvictionDiscarded:
+		p.count(&p.counters.evictedDiscarded, "_evictions_discarded_total", n)
+	}
+}
+
+// entriesChanged publishes a change in the number of entries to the metrics.
+func (p *poolShard[T]) entriesChanged(delta int) {
+	if delta == 0 || p.metrics == nil {
+		return
+	}
+	p.metrics.GaugeAdd(p.metricsPrefix+"_entries", float64(delta))
+}
@@ -0,0 +1,79 @@
+package base
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestKeyedPoolStats(t *testing.T) {
+	metrics := &recordingMetrics{}
+	p := NewKeyedPool[int](KeyedPoolOptions[int]{
+		MaxEntries: 2,
+		Shards:     1,
+		Metrics:    metrics,
+		New: func(key string) (int, error) {
+			if key == "fail" {
+				return 0, errors.New("failed")
+			}
+			return len(key), nil
+		},
+	})
+
+	a, _ := p.Get("a")
+	p.Put("a", a)
+	a, _ = p.Get("a")
+	p.Put("a", a)
+	if _, err := p.Get("fail"); err == nil {
+		t.Errorf("p.Get() should have failed")
+	}
+	p.Put("b", 1)
+	p.Put("b", 2)
+	p.Put("c", 3)
+	p.Put("d", 4)
+	a, _ = p.Get("a")
+	p.Discard("a", a)
+
+	if entries := p.EntriesPerKey(); !reflect.DeepEqual(entries, map[string]int{"c": 1, "d": 1}) {
+		t.Errorf("p.EntriesPerKey() = %v", entries)
+	}
+	p.Remove("c")
+	p.Clear()
+
+	expected := KeyedPoolStats{
+		Hits:        1,
+		Misses:      3,
+		News:        3,
+		NewFailures: 1,
+		Evictions: KeyedPoolEvictions{
+			Capacity:  3,
+			Removed:   1,
+			Cleared:   1,
+			Discarded: 1,
+		},
+	}
+	if stats := p.Stats(); stats != expected {
+		t.Errorf("p.Stats() = %+v, want %+v", stats, expected)
+	}
+	if shardStats := p.ShardStats(); len(shardStats) != 1 || shardStats[0] != expected {
+		t.Errorf("p.ShardStats() = %+v, want [%+v]", shardStats, expected)
+	}
+
+	for name, value := range map[string]float64{
+		"keyed_pool_hits_total":                1,
+		"keyed_pool_misses_total":              3,
+		"keyed_pool_news_total":                3,
+		"keyed_pool_new_failures_total":        1,
+		"keyed_pool_evictions_capacity_total":  3,
+		"keyed_pool_evictions_removed_total":   1,
+		"keyed_pool_evictions_cleared_total":   1,
+		"keyed_pool_evictions_discarded_total": 1,
+	} {
+		if got := metrics.counter(name); got != value {
+			t.Errorf("counter %s = %v, want %v", name, got, value)
+		}
+	}
+	if got := metrics.gauge("keyed_pool_entries"); got != 0 {
+		t.Errorf("gauge keyed_pool_entries = %v, want 0", got)
+	}
+}
@@ -1,9 +1,13 @@
 package base
 
 import (
+	"context"
+	"errors"
 	"math/rand"
 	"strconv"
+	"sync"
 	"testing"
+	"time"
 )
 
 func BenchmarkKeyedPool_Random(b *testing.B) {
@@ -158,3 +162,776 @@ func TestKeyedPoolClear(t *testing.T) {
 		t.Fatalf("bad len: %v, want 0", p.Len())
 	}
 }
+
+func TestKeyedPoolMaxActive(t *testing.T) {
+	created := 0
+	p := NewKeyedPool[int](KeyedPoolOptions[int]{
+		MaxActivePerKey: 2,
+		MaxActive:       3,
+		New: func(key string) (int, error) {
+			created++
+			return created, nil
+		},
+	})
+
+	a1, _ := p.Get("a")
+	a2, _ := p.Get("a")
+	if p.Active() != 2 {
+		t.Fatalf("p.Active() = %d, want 2", p.Active())
+	}
+
+	// The per-key limit has been reached.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := p.GetContext(ctx, "a"); err != context.DeadlineExceeded {
+		t.Fatalf("p.GetContext() = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	b1, _ := p.Get("b")
+	if p.Active() != 3 {
+		t.Fatalf("p.Active() = %d, want 3", p.Active())
+	}
+
+	// The total limit has been reached. Waiters are served in order.
+	results := make(chan string, 2)
+	var wg sync.WaitGroup
+	for _, key := range []string{"b", "c"} {
+		key := key
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, err := p.GetContext(context.Background(), key)
+			if err != nil {
+				t.Errorf("p.GetContext(%q) = %v", key, err)
+			}
+			results <- key
+			p.Put(key, v)
+		}()
+		// Give the goroutine a chance to be queued before the next one.
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case key := <-results:
+		t.Fatalf("p.GetContext(%q) should have blocked", key)
+	default:
+	}
+
+	p.Put("a", a1)
+	if key := <-results; key != "b" {
+		t.Errorf("first waiter served = %q, want %q", key, "b")
+	}
+	if key := <-results; key != "c" {
+		t.Errorf("second waiter served = %q, want %q", key, "c")
+	}
+	wg.Wait()
+
+	p.Put("a", a2)
+	p.Discard("b", b1)
+	if p.Active() != 0 {
+		t.Fatalf("p.Active() = %d, want 0", p.Active())
+	}
+}
+
+func TestKeyedPoolMaxActiveForeignPut(t *testing.T) {
+	p := NewKeyedPool[int](KeyedPoolOptions[int]{
+		MaxActive: 1,
+		New: func(key string) (int, error) {
+			return 1, nil
+		},
+	})
+
+	a, _ := p.Get("a")
+	// Objects that were not checked out do not free any slots.
+	p.Put("b", 2)
+	if p.Active() != 1 {
+		t.Fatalf("p.Active() = %d, want 1", p.Active())
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := p.GetContext(ctx, "b"); err != context.DeadlineExceeded {
+		t.Fatalf("p.GetContext() = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	p.Put("a", a)
+	if p.Active() != 0 {
+		t.Fatalf("p.Active() = %d, want 0", p.Active())
+	}
+}
+
+func TestKeyedPoolMaxActiveFIFO(t *testing.T) {
+	waitForWaiters := func(p *KeyedPool[int], n int) {
+		t.Helper()
+		deadline := time.Now().Add(10 * time.Second)
+		for {
+			p.limiter.lock.Lock()
+			waiters := p.limiter.waiters.Len()
+			p.limiter.lock.Unlock()
+			if waiters == n {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("waiters = %d, want %d", waiters, n)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	t.Run("order", func(t *testing.T) {
+		p := NewKeyedPool[int](KeyedPoolOptions[int]{
+			MaxActive: 1,
+			New: func(key string) (int, error) {
+				return 0, nil
+			},
+		})
+		held, _ := p.Get("a")
+
+		// Only one object can be checked out at a time, so the order in which
+		// the callers are served is the order in which they were admitted.
+		var lock sync.Mutex
+		var served []string
+		var wg sync.WaitGroup
+		keys := []string{"c", "a", "d", "e", "b", "f", "a", "c"}
+		for i, key := range keys {
+			key := key
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				v, err := p.GetContext(context.Background(), key)
+				if err != nil {
+					t.Errorf("p.GetContext(%q) = %v", key, err)
+					return
+				}
+				lock.Lock()
+				served = append(served, key)
+				lock.Unlock()
+				p.Put(key, v)
+			}()
+			waitForWaiters(p, i+1)
+		}
+		p.Put("a", held)
+		wg.Wait()
+
+		if len(served) != len(keys) {
+			t.Fatalf("served = %v, want %v", served, keys)
+		}
+		for i, key := range keys {
+			if served[i] != key {
+				t.Fatalf("served = %v, want %v", served, keys)
+			}
+		}
+	})
+
+	t.Run("per-key limit", func(t *testing.T) {
+		p := NewKeyedPool[int](KeyedPoolOptions[int]{
+			MaxActivePerKey: 1,
+			MaxActive:       2,
+			New: func(key string) (int, error) {
+				return 0, nil
+			},
+		})
+		held, _ := p.Get("a")
+
+		waited := make(chan int, 1)
+		go func() {
+			v, err := p.GetContext(context.Background(), "a")
+			if err != nil {
+				t.Errorf("p.GetContext(%q) = %v", "a", err)
+			}
+			waited <- v
+		}()
+		waitForWaiters(p, 1)
+
+		// The caller that is waiting is only blocked by the limit of its own
+		// key, so it does not hold back the callers with other keys.
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		b, err := p.GetContext(ctx, "b")
+		if err != nil {
+			t.Fatalf("p.GetContext() failed with %v", err)
+		}
+
+		// The total limit has been reached now, so the next caller with
+		// another key waits behind the first one, which is served first once
+		// its key is below the limit.
+		served := make(chan int, 1)
+		go func() {
+			v, err := p.GetContext(context.Background(), "c")
+			if err != nil {
+				t.Errorf("p.GetContext(%q) = %v", "c", err)
+			}
+			served <- v
+		}()
+		waitForWaiters(p, 2)
+		p.Put("a", held)
+		a := <-waited
+		waitForWaiters(p, 1)
+		p.Put("b", b)
+		p.Put("c", <-served)
+		p.Put("a", a)
+		if p.Active() != 0 {
+			t.Fatalf("p.Active() = %d, want 0", p.Active())
+		}
+	})
+}
+
+func TestKeyedPoolExpiration(t *testing.T) {
+	type conn struct {
+		id int
+	}
+	created := 0
+	var evicted []int
+	p := NewKeyedPool[*conn](KeyedPoolOptions[*conn]{
+		Shards:       1,
+		IdleTimeout:  Duration(time.Minute),
+		MaxLifetime:  Duration(time.Hour),
+		ReapInterval: Duration(time.Hour),
+		New: func(key string) (*conn, error) {
+			created++
+			return &conn{id: created}, nil
+		},
+		OnEvicted: func(key string, value *conn) {
+			evicted = append(evicted, value.id)
+		},
+	})
+	defer p.Close(context.Background())
+
+	now := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	p.shards[0].now = func() time.Time { return now }
+
+	c1, _ := p.Get("a")
+	c2, _ := p.Get("a")
+	p.Put("a", c1)
+	now = now.Add(30 * time.Second)
+	p.Put("a", c2)
+
+	// c1 has been idle for too long, but c2 has not.
+	now = now.Add(45 * time.Second)
+	p.Reap()
+	if len(evicted) != 1 || evicted[0] != c1.id {
+		t.Fatalf("evicted = %v, want [%d]", evicted, c1.id)
+	}
+	if p.Len() != 1 {
+		t.Fatalf("p.Len() = %d, want 1", p.Len())
+	}
+
+	// Expired objects are skipped by Get.
+	now = now.Add(45 * time.Second)
+	c3, _ := p.Get("a")
+	if c3.id != 3 {
+		t.Errorf("p.Get() = %d, want a fresh object", c3.id)
+	}
+	if len(evicted) != 2 || evicted[1] != c2.id {
+		t.Fatalf("evicted = %v, want [%d %d]", evicted, c1.id, c2.id)
+	}
+
+	// Objects that exceed their lifetime while leased are evicted when
+	// released, even if they were recently used.
+	p.Put("a", c3)
+	lease, err := p.Acquire(context.Background(), "a")
+	if err != nil {
+		t.Fatalf("p.Acquire() failed with %v", err)
+	}
+	if lease.Value() != c3 {
+		t.Fatalf("lease.Value() = %d, want %d", lease.Value().id, c3.id)
+	}
+	now = now.Add(2 * time.Hour)
+	lease.Release()
+	if len(evicted) != 3 || evicted[2] != c3.id {
+		t.Fatalf("evicted = %v, want [%d %d %d]", evicted, c1.id, c2.id, c3.id)
+	}
+	if p.Len() != 0 {
+		t.Fatalf("p.Len() = %d, want 0", p.Len())
+	}
+
+	// Objects that are used through Get and Put keep their creation time, so
+	// they are eventually evicted even if they are always in use.
+	c4, _ := p.Get("a")
+	for i := 0; i < 2; i++ {
+		now = now.Add(20 * time.Minute)
+		p.Put("a", c4)
+		if c, _ := p.Get("a"); c != c4 {
+			t.Fatalf("p.Get() = %d, want %d", c.id, c4.id)
+		}
+	}
+	now = now.Add(20 * time.Minute)
+	p.Put("a", c4)
+	if len(evicted) != 4 || evicted[3] != c4.id {
+		t.Fatalf("evicted = %v, want [%d %d %d %d]", evicted, c1.id, c2.id, c3.id, c4.id)
+	}
+	c5, _ := p.Get("a")
+	if c5.id != 5 {
+		t.Errorf("p.Get() = %d, want a fresh object", c5.id)
+	}
+	p.Put("a", c5)
+}
+
+func TestKeyedPoolExpirationNonComparable(t *testing.T) {
+	type conn struct {
+		ids   []int
+		extra any
+	}
+	var evicted []conn
+	p := NewKeyedPool[conn](KeyedPoolOptions[conn]{
+		Shards:       1,
+		MaxLifetime:  Duration(time.Hour),
+		ReapInterval: Duration(time.Hour),
+		New: func(key string) (conn, error) {
+			return conn{ids: []int{1}, extra: []int{2}}, nil
+		},
+		OnEvicted: func(key string, value conn) {
+			evicted = append(evicted, value)
+		},
+	})
+	defer p.Close(context.Background())
+
+	now := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	p.shards[0].now = func() time.Time { return now }
+
+	c, err := p.Get("a")
+	if err != nil {
+		t.Fatalf("p.Get() failed with %v", err)
+	}
+	p.Put("a", c)
+	lease, err := p.Acquire(context.Background(), "a")
+	if err != nil {
+		t.Fatalf("p.Acquire() failed with %v", err)
+	}
+	now = now.Add(2 * time.Hour)
+	lease.Release()
+	if len(evicted) != 1 {
+		t.Fatalf("evicted = %v, want the expired object", evicted)
+	}
+	if p.Len() != 0 {
+		t.Fatalf("p.Len() = %d, want 0", p.Len())
+	}
+}
+
+func TestKeyedPoolExpirationDuplicates(t *testing.T) {
+	evicted := 0
+	p := NewKeyedPool[int](KeyedPoolOptions[int]{
+		Shards:       1,
+		MaxLifetime:  Duration(time.Hour),
+		ReapInterval: Duration(time.Hour),
+		New: func(key string) (int, error) {
+			return 42, nil
+		},
+		OnEvicted: func(key string, value int) {
+			evicted++
+		},
+	})
+	defer p.Close(context.Background())
+
+	now := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	p.shards[0].now = func() time.Time { return now }
+
+	// Both objects are equal, but each one keeps its own creation time.
+	older, err := p.Acquire(context.Background(), "a")
+	if err != nil {
+		t.Fatalf("p.Acquire() failed with %v", err)
+	}
+	now = now.Add(45 * time.Minute)
+	newer, err := p.Acquire(context.Background(), "a")
+	if err != nil {
+		t.Fatalf("p.Acquire() failed with %v", err)
+	}
+	now = now.Add(30 * time.Minute)
+	newer.Release()
+	older.Release()
+	if evicted != 1 {
+		t.Fatalf("evicted = %d, want 1", evicted)
+	}
+	if p.Len() != 1 {
+		t.Fatalf("p.Len() = %d, want 1", p.Len())
+	}
+
+	// Objects obtained through Get and never returned are only tracked per
+	// key.
+	for i := 0; i < 3; i++ {
+		if _, err := p.Get("a"); err != nil {
+			t.Fatalf("p.Get() failed with %v", err)
+		}
+	}
+	if p.Active() != 3 {
+		t.Fatalf("p.Active() = %d, want 3", p.Active())
+	}
+	if len(p.shards[0].checkedOut) != 1 {
+		t.Errorf("p.shards[0].checkedOut = %v, want a single key", p.shards[0].checkedOut)
+	}
+	for i := 0; i < 3; i++ {
+		p.Discard("a", 42)
+	}
+	if len(p.shards[0].checkedOut) != 0 {
+		t.Errorf("p.shards[0].checkedOut = %v, want empty", p.shards[0].checkedOut)
+	}
+}
+
+func TestKeyedPoolReaper(t *testing.T) {
+	evicted := make(chan string, 1)
+	p := NewKeyedPool[int](KeyedPoolOptions[int]{
+		IdleTimeout:  Duration(10 * time.Millisecond),
+		ReapInterval: Duration(5 * time.Millisecond),
+		OnEvicted: func(key string, value int) {
+			evicted <- key
+		},
+	})
+	p.Put("a", 1)
+
+	select {
+	case key := <-evicted:
+		if key != "a" {
+			t.Errorf("evicted %q, want %q", key, "a")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the idle object was not evicted")
+	}
+	p.Close(context.Background())
+	p.Close(context.Background())
+}
+
+func TestKeyedPoolValidation(t *testing.T) {
+	type conn struct {
+		id     int
+		broken bool
+	}
+	created := 0
+	var evicted []int
+	p := NewKeyedPool[*conn](KeyedPoolOptions[*conn]{
+		New: func(key string) (*conn, error) {
+			created++
+			return &conn{id: created}, nil
+		},
+		OnEvicted: func(key string, value *conn) {
+			evicted = append(evicted, value.id)
+		},
+		ValidateOnGet: func(key string, value *conn) error {
+			if value.broken {
+				return errors.New("broken")
+			}
+			return nil
+		},
+		ValidateOnPut: func(key string, value *conn) error {
+			if value.id == 3 {
+				return errors.New("not welcome back")
+			}
+			return nil
+		},
+	})
+
+	c1, _ := p.Get("a")
+	c2, _ := p.Get("a")
+	p.Put("a", c1)
+	p.Put("a", c2)
+
+	// Both pooled objects break while idle, so Get creates a new one.
+	c1.broken = true
+	c2.broken = true
+	c3, err := p.Get("a")
+	if err != nil {
+		t.Fatalf("p.Get() failed with %v", err)
+	}
+	if c3.id != 3 {
+		t.Errorf("p.Get() = %d, want 3", c3.id)
+	}
+	if len(evicted) != 2 {
+		t.Fatalf("evicted = %v, want [1 2]", evicted)
+	}
+
+	p.Put("a", c3)
+	if p.Len() != 0 {
+		t.Errorf("p.Len() = %d, want 0", p.Len())
+	}
+	if len(evicted) != 3 || evicted[2] != 3 {
+		t.Fatalf("evicted = %v, want [1 2 3]", evicted)
+	}
+	if stats := p.Stats(); stats.Evictions.Invalid != 3 {
+		t.Errorf("p.Stats().Evictions.Invalid = %d, want 3", stats.Evictions.Invalid)
+	}
+}
+
+func TestKeyedPoolMaxConcurrentNewPerKey(t *testing.T) {
+	var lock sync.Mutex
+	inFlight, maxInFlight, created := 0, 0, 0
+	release := make(chan error)
+	p := NewKeyedPool[int](KeyedPoolOptions[int]{
+		Shards:                 1,
+		MaxConcurrentNewPerKey: 1,
+		New: func(key string) (int, error) {
+			lock.Lock()
+			inFlight++
+			maxInFlight = Max(maxInFlight, inFlight)
+			lock.Unlock()
+
+			err := <-release
+
+			lock.Lock()
+			defer lock.Unlock()
+			inFlight--
+			if err != nil {
+				return 0, err
+			}
+			created++
+			return created, nil
+		},
+	})
+	waitForWaiters := func(n int) {
+		t.Helper()
+		shard := p.shards[0]
+		deadline := time.Now().Add(10 * time.Second)
+		for {
+			waiters := 0
+			shard.Lock()
+			if creation, ok := shard.creating["a"]; ok {
+				waiters = creation.waiters.Len()
+			}
+			shard.Unlock()
+			if waiters == n {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("waiters = %d, want %d", waiters, n)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// A failed creation is propagated to all the callers waiting for it.
+	errs := make(chan error, 3)
+	for i := 0; i < 3; i++ {
+		go func() {
+			_, err := p.Get("a")
+			errs <- err
+		}()
+	}
+	waitForWaiters(3)
+	creationErr := errors.New("creation failed")
+	release <- creationErr
+	for i := 0; i < 3; i++ {
+		if err := <-errs; err != creationErr {
+			t.Errorf("p.Get() = %v, want %v", err, creationErr)
+		}
+	}
+
+	// Waiters honor their context.
+	go func() {
+		_, err := p.Get("a")
+		errs <- err
+	}()
+	waitForWaiters(1)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := p.GetContext(ctx, "a"); err != context.DeadlineExceeded {
+		t.Errorf("p.GetContext() = %v, want %v", err, context.DeadlineExceeded)
+	}
+	release <- nil
+	if err := <-errs; err != nil {
+		t.Fatalf("p.Get() failed with %v", err)
+	}
+
+	// Created objects are handed to the waiters in order, and so are the
+	// objects that are returned while they wait, which saves a creation.
+	values := make([]chan int, 3)
+	for i := range values {
+		values[i] = make(chan int, 1)
+		ch := values[i]
+		go func() {
+			v, err := p.Get("a")
+			if err != nil {
+				t.Errorf("p.Get() failed with %v", err)
+			}
+			ch <- v
+		}()
+		waitForWaiters(i + 1)
+	}
+	release <- nil
+	first := <-values[0]
+	if first != 2 {
+		t.Errorf("first waiter got %d, want 2", first)
+	}
+	p.Put("a", first)
+	if v := <-values[1]; v != first {
+		t.Errorf("second waiter got %d, want %d", v, first)
+	}
+	release <- nil
+	if v := <-values[2]; v != 3 {
+		t.Errorf("third waiter got %d, want 3", v)
+	}
+	if p.Len() != 0 {
+		t.Errorf("p.Len() = %d, want 0", p.Len())
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if maxInFlight != 1 {
+		t.Errorf("maxInFlight = %d, want 1", maxInFlight)
+	}
+	if created != 3 {
+		t.Errorf("created = %d, want 3", created)
+	}
+}
+
+func TestKeyedPoolSetMaxEntries(t *testing.T) {
+	var evicted []int
+	p := NewKeyedPool[int](KeyedPoolOptions[int]{
+		MaxEntries: 4,
+		Shards:     1,
+		OnEvicted: func(key string, value int) {
+			evicted = append(evicted, value)
+		},
+	})
+	for i := 1; i <= 4; i++ {
+		p.Put(strconv.Itoa(i), i)
+	}
+
+	p.SetMaxEntries(2)
+	if p.Len() != 2 {
+		t.Errorf("p.Len() = %d, want 2", p.Len())
+	}
+	if len(evicted) != 2 || evicted[0] != 1 || evicted[1] != 2 {
+		t.Errorf("evicted = %v, want [1 2]", evicted)
+	}
+
+	p.SetMaxEntries(0)
+	p.Put("5", 5)
+	if p.Len() != 0 {
+		t.Errorf("p.Len() = %d, want 0", p.Len())
+	}
+	if len(evicted) != 5 {
+		t.Errorf("evicted = %v, want [1 2 3 4 5]", evicted)
+	}
+}
+
+func TestKeyedPoolPrewarm(t *testing.T) {
+	var lock sync.Mutex
+	created := 0
+	p := NewKeyedPool[int](KeyedPoolOptions[int]{
+		New: func(key string) (int, error) {
+			lock.Lock()
+			defer lock.Unlock()
+			created++
+			if created == 3 {
+				return 0, errors.New("failed")
+			}
+			return created, nil
+		},
+	})
+	if err := p.Prewarm("a", 4); err == nil {
+		t.Errorf("p.Prewarm() should have failed")
+	}
+	if p.Len() != 3 {
+		t.Errorf("p.Len() = %d, want 3", p.Len())
+	}
+	if stats := p.Stats(); stats.News != 4 || stats.NewFailures != 1 {
+		t.Errorf("p.Stats() = %+v, want 4 News and 1 NewFailure", stats)
+	}
+}
+
+func TestKeyedPoolPrewarmConcurrency(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		maxNew      int
+		gets        int
+		maxInFlight int
+	}{
+		{"default", 0, 0, maxPrewarmConcurrency},
+		{"max concurrent new per key", 2, 4, 2},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var lock sync.Mutex
+			inFlight, maxInFlight := 0, 0
+			p := NewKeyedPool[int](KeyedPoolOptions[int]{
+				MaxEntries:             64,
+				Shards:                 1,
+				MaxConcurrentNewPerKey: tc.maxNew,
+				New: func(key string) (int, error) {
+					lock.Lock()
+					inFlight++
+					maxInFlight = Max(maxInFlight, inFlight)
+					lock.Unlock()
+
+					time.Sleep(time.Millisecond)
+
+					lock.Lock()
+					inFlight--
+					lock.Unlock()
+					return 0, nil
+				},
+			})
+
+			// The calls to New made on behalf of Get count towards
+			// MaxConcurrentNewPerKey too.
+			var wg sync.WaitGroup
+			for i := 0; i < tc.gets; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					v, err := p.Get("a")
+					if err != nil {
+						t.Errorf("p.Get() failed with %v", err)
+						return
+					}
+					p.Put("a", v)
+				}()
+			}
+			if err := p.Prewarm("a", 40); err != nil {
+				t.Fatalf("p.Prewarm() failed with %v", err)
+			}
+			wg.Wait()
+
+			lock.Lock()
+			defer lock.Unlock()
+			if maxInFlight > tc.maxInFlight {
+				t.Errorf("maxInFlight = %d, want at most %d", maxInFlight, tc.maxInFlight)
+			}
+		})
+	}
+}
+
+func TestKeyedPoolClose(t *testing.T) {
+	var lock sync.Mutex
+	var evicted []string
+	p := NewKeyedPool[string](KeyedPoolOptions[string]{
+		IdleTimeout: Duration(time.Minute),
+		New: func(key string) (string, error) {
+			return key, nil
+		},
+		OnEvicted: func(key string, value string) {
+			lock.Lock()
+			defer lock.Unlock()
+			evicted = append(evicted, value)
+		},
+	})
+	p.Put("idle", "idle")
+	leased, _ := p.Get("leased")
+
+	// Close waits for the leased object.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := p.Close(ctx); err != context.DeadlineExceeded {
+		t.Errorf("p.Close() = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if _, err := p.Get("new"); err != ErrKeyedPoolClosed {
+		t.Errorf("p.Get() = %v, want %v", err, ErrKeyedPoolClosed)
+	}
+	if err := p.Prewarm("new", 1); err != ErrKeyedPoolClosed {
+		t.Errorf("p.Prewarm() = %v, want %v", err, ErrKeyedPoolClosed)
+	}
+
+	closed := make(chan error, 1)
+	go func() {
+		closed <- p.Close(context.Background())
+	}()
+	time.Sleep(10 * time.Millisecond)
+	p.Put("leased", leased)
+	if err := <-closed; err != nil {
+		t.Errorf("p.Close() failed with %v", err)
+	}
+
+	if p.Len() != 0 {
+		t.Errorf("p.Len() = %d, want 0", p.Len())
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if len(evicted) != 2 || evicted[0] != "idle" || evicted[1] != "leased" {
+		t.Errorf("evicted = %v, want [idle leased]", evicted)
+	}
+}
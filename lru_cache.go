@@ -2,9 +2,18 @@ package base
 
 import (
 	"container/list"
+	"context"
 	"github.com/pkg/errors"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
+)
+
+var (
+	// ErrLRUCacheFull is the category of the error returned by
+	// LRUCache.Get in hard-limit mode when there is no room for a new entry.
+	ErrLRUCacheFull = errors.New("cache full")
 )
 
 // A SizedEntry is an entry within the LRUCache that knows its own size.
@@ -16,6 +25,16 @@ type SizedEntry interface {
 	Size() Byte
 }
 
+// An ExpiringSizedEntry is a SizedEntry that chooses its own time-to-live,
+// overriding the TTL of the LRUCache.
+type ExpiringSizedEntry interface {
+	SizedEntry
+
+	// TTL returns the amount of time the entry can be served from the cache
+	// after it is created. The entry never expires if it is not positive.
+	TTL() Duration
+}
+
 // A SizedEntryRef is a wrapper around a SizedEntry.
 type SizedEntryRef[T SizedEntry] struct {
 	Value      T
@@ -35,30 +54,267 @@ type lruCacheEntry[T SizedEntry] struct {
 	listElement *list.Element
 	sizedEntry  T
 	key         string
+
+	// expires is the time after which the entry can no longer be served from
+	// the cache. It is zero if the entry never expires.
+	expires time.Time
+
+	// detached is true if the entry has been invalidated while it was in use.
+	// It is no longer in the mapping, and it is released on its last Put.
+	detached bool
+
+	// lastUsed is the value of the cache clock when the entry was last
+	// released, which orders entries across the shards of a ShardedLRUCache.
+	lastUsed uint64
+}
+
+// An lruCacheCall is an in-flight invocation of a SizedEntryFactory.
+type lruCacheCall struct {
+	done chan struct{}
+	err  error
+
+	// invalidated is true if the key was invalidated while the factory was
+	// running, so the entry it creates must not be served to anyone else.
+	invalidated bool
 }
 
 // LRUCache handles a pool of sized resources. It has a fixed maximum size with
-// a least-recently used eviction policy.
+// a least-recently used eviction policy. A new entry for the same key as an
+// evicted one is never created before the old one is released, unless the
+// cache has a Dispatcher. Evicted entries are released while the cache lock is
+// held, except the ones that are spilled to the disk tier, which are spilled
+// and released after the lock is released.
 type LRUCache[T SizedEntry] struct {
 	sync.Mutex
 	mapping       map[string]*lruCacheEntry[T]
+	pending       map[string]*lruCacheCall
 	evictList     *list.List
 	totalSize     Byte
 	evictableSize Byte
 	sizeLimit     Byte
+	dispatcher    *CallbackDispatcher
+	ttl           time.Duration
+	now           func() time.Time
+
+	// hardLimit and maxOvercommit bound the total size of the cache, and
+	// spaceFreed is closed and replaced every time an entry stops being used,
+	// to wake up the callers waiting for room.
+	hardLimit     bool
+	maxOvercommit Byte
+	spaceFreed    chan struct{}
+
+	// creations holds a token for every entry that is being created in
+	// hard-limit mode. It is nil otherwise.
+	creations chan struct{}
+
+	// clock is incremented atomically every time an entry is released. It
+	// points to a counter that is shared by all the shards of a
+	// ShardedLRUCache.
+	clock *uint64
+
+	// sharedSize and sharedEvictableSize are the total size and evictable
+	// size of the ShardedLRUCache this cache is a shard of, which are updated
+	// atomically along with totalSize and evictableSize. They are nil if the
+	// cache is not a shard.
+	sharedSize          *int64
+	sharedEvictableSize *int64
+
+	// disk is the second tier where entries evicted due to size pressure are
+	// spilled. It is nil if the cache only lives in memory.
+	disk *lruCacheDisk[T]
+}
+
+// LRUCacheOptions are options that can be passed to NewLRUCacheWithOptions to
+// customize the cache limits and functionality.
+type LRUCacheOptions struct {
+	// SizeLimit is the maximum total size of the entries in the cache before
+	// the least-recently used ones that are not in use are evicted.
+	SizeLimit Byte
+
+	// Dispatcher is used to release the evicted entries in the background, so
+	// that callers are not stalled by slow releases. Use Dispatcher.Wait to
+	// wait for the pending releases. Releases are dispatched after the cache
+	// lock is released, so a new entry for the same key can be created before
+	// the old one is released. Release must not dispatch more callbacks to
+	// the same Dispatcher, since it might be running in one of its workers
+	// and Dispatch blocks while the queue is full, which would deadlock once
+	// all the workers do that. Entries are released on the goroutine that
+	// caused the eviction if unset, while holding the cache lock unless they
+	// are spilled to the disk tier first.
+	Dispatcher *CallbackDispatcher
+
+	// TTL is the amount of time an entry can be served from the cache after
+	// it is created. Expired entries are removed the next time they are
+	// requested, or when they are evicted due to size pressure. Entries that
+	// implement ExpiringSizedEntry can override it. Entries never expire if
+	// unset.
+	TTL Duration
+
+	// HardLimit makes the cache refuse to grow past SizeLimit plus
+	// MaxOvercommit when all its entries are in use. Get for a new entry
+	// that does not fit blocks until enough entries are returned through Put,
+	// or fails with an error of category ErrLRUCacheFull once its context is
+	// done. Without it, the cache can be overcommitted without bounds.
+	//
+	// The size of an entry is only known once the factory has created it, so
+	// the entries exist outside of the cache while the callers wait for room
+	// for them. Their number is bounded by MaxConcurrentCreations.
+	HardLimit bool
+
+	// MaxOvercommit is the number of bytes the cache can grow past SizeLimit
+	// in hard-limit mode. The default is 0 if unset.
+	MaxOvercommit Byte
+
+	// MaxConcurrentCreations is the maximum number of entries that can be
+	// created at the same time in hard-limit mode, counting from the moment
+	// the factory is invoked until the entry is added to the cache or
+	// released because it did not fit. Get waits for its turn before invoking
+	// the factory, or fails with an error of category ErrLRUCacheFull once its
+	// context is done. The default is 1 if unset.
+	MaxConcurrentCreations int
 }
 
 // NewLRUCache returns an empty LRUCache with the provided size limit.
 func NewLRUCache[T SizedEntry](sizeLimit Byte) *LRUCache[T] {
+	return NewLRUCacheWithOptions[T](LRUCacheOptions{
+		SizeLimit: sizeLimit,
+	})
+}
+
+// NewLRUCacheWithOptions returns an empty LRUCache with the provided options.
+func NewLRUCacheWithOptions[T SizedEntry](options LRUCacheOptions) *LRUCache[T] {
+	var creations chan struct{}
+	if options.HardLimit {
+		if options.MaxConcurrentCreations <= 0 {
+			options.MaxConcurrentCreations = 1
+		}
+		creations = make(chan struct{}, options.MaxConcurrentCreations)
+	}
 	return &LRUCache[T]{
-		mapping:   make(map[string]*lruCacheEntry[T]),
-		evictList: list.New(),
-		sizeLimit: sizeLimit,
+		mapping:       make(map[string]*lruCacheEntry[T]),
+		pending:       make(map[string]*lruCacheCall),
+		evictList:     list.New(),
+		sizeLimit:     options.SizeLimit,
+		dispatcher:    options.Dispatcher,
+		ttl:           time.Duration(options.TTL),
+		now:           time.Now,
+		hardLimit:     options.HardLimit,
+		maxOvercommit: options.MaxOvercommit,
+		spaceFreed:    make(chan struct{}),
+		creations:     creations,
+		clock:         new(uint64),
 	}
 }
 
-func (c *LRUCache[T]) evictLocked() {
-	for c.evictList.Len() > 0 && c.totalSize.Bytes() > c.sizeLimit.Bytes() {
+// releaseLocked releases the entries that were evicted while the cache lock is
+// still held, so that a concurrent Get cannot create a new entry for the same
+// key before the old one is released. If the cache has a Dispatcher, the
+// entries are returned instead, so that they are dispatched with release once
+// the lock is no longer held, since Dispatch blocks while its queue is full.
+func (c *LRUCache[T]) releaseLocked(evicted []T) []T {
+	if c.dispatcher != nil {
+		return evicted
+	}
+	for _, sizedEntry := range evicted {
+		sizedEntry.Release()
+	}
+	return nil
+}
+
+// release releases the entries that were evicted, or that were never added to
+// the cache. This must be called without holding the cache lock.
+func (c *LRUCache[T]) release(evicted []T) {
+	for _, sizedEntry := range evicted {
+		if c.dispatcher != nil {
+			c.dispatcher.Dispatch(sizedEntry.Release)
+		} else {
+			sizedEntry.Release()
+		}
+	}
+}
+
+// An lruCacheEviction is an entry that was evicted from an LRUCache due to
+// size pressure, which can be spilled to the disk tier.
+type lruCacheEviction[T SizedEntry] struct {
+	key     string
+	value   T
+	expires time.Time
+
+	// epoch is the invalidation epoch of the disk tier at the time of the
+	// eviction, so that entries invalidated before they are spilled are not
+	// written to disk.
+	epoch uint64
+
+	// call makes the callers that want the same key wait until the entry is
+	// spilled and released. It is nil if the cache has a Dispatcher.
+	call *lruCacheCall
+}
+
+// releaseEvictedLocked is like releaseLocked, but for the entries that were
+// evicted due to size pressure, which are spilled to the disk tier, if any,
+// before they are released. Spilling is too slow to be done while holding the
+// cache lock, so if there is a disk tier, the entries are returned to be
+// spilled and released by releaseEvicted, and in the meantime they are
+// registered as pending calls so that a concurrent Get for the same key waits
+// until the old entry is released, and then promotes it back from disk.
+func (c *LRUCache[T]) releaseEvictedLocked(evictions []lruCacheEviction[T]) []lruCacheEviction[T] {
+	if c.dispatcher != nil {
+		return evictions
+	}
+	if c.disk == nil {
+		for _, eviction := range evictions {
+			eviction.value.Release()
+		}
+		return nil
+	}
+	for i := range evictions {
+		call := &lruCacheCall{done: make(chan struct{})}
+		c.pending[evictions[i].key] = call
+		evictions[i].call = call
+	}
+	return evictions
+}
+
+// releaseEvicted spills and releases the entries returned by
+// releaseEvictedLocked, or dispatches them. This must be called without
+// holding the cache lock.
+func (c *LRUCache[T]) releaseEvicted(evictions []lruCacheEviction[T]) {
+	for _, eviction := range evictions {
+		eviction := eviction
+		if c.dispatcher != nil {
+			c.dispatcher.Dispatch(func() { c.spillAndRelease(eviction) })
+			continue
+		}
+		c.spillAndRelease(eviction)
+		if eviction.call != nil {
+			c.Lock()
+			delete(c.pending, eviction.key)
+			close(eviction.call.done)
+			c.Unlock()
+		}
+	}
+}
+
+func (c *LRUCache[T]) spillAndRelease(eviction lruCacheEviction[T]) {
+	if c.disk != nil {
+		c.disk.spill(eviction, c.now())
+	}
+	eviction.value.Release()
+}
+
+// evictLocked evicts the least-recently used entries that are not in use
+// until the cache is within its size limit, and returns them so that they can
+// be released once the lock is no longer held.
+func (c *LRUCache[T]) evictLocked() []lruCacheEviction[T] {
+	return c.evictUntilLocked(c.sizeLimit)
+}
+
+// evictUntilLocked evicts the least-recently used entries that are not in use
+// until the total size of the cache is at most limit, and returns them so that
+// they can be released once the lock is no longer held.
+func (c *LRUCache[T]) evictUntilLocked(limit Byte) []lruCacheEviction[T] {
+	var evicted []lruCacheEviction[T]
+	for c.evictList.Len() > 0 && c.totalSize.Bytes() > limit.Bytes() {
 		element := c.evictList.Back()
 		cacheEntry := element.Value.(*lruCacheEntry[T])
 
@@ -73,63 +329,306 @@ func (c *LRUCache[T]) evictLocked() {
 			))
 		}
 
-		c.totalSize = Byte(c.totalSize.Bytes() - cacheEntry.sizedEntry.Size().Bytes())
-		c.evictableSize = Byte(c.evictableSize.Bytes() - cacheEntry.sizedEntry.Size().Bytes())
+		evicted = append(evicted, c.evictEntryLocked(cacheEntry))
+	}
+	return evicted
+}
 
-		cacheEntry.listElement = nil
-		c.evictList.Remove(element)
-		delete(c.mapping, cacheEntry.key)
+// removeLocked removes an entry that is not in use from the cache and
+// returns it so that it can be released.
+func (c *LRUCache[T]) removeLocked(cacheEntry *lruCacheEntry[T]) T {
+	c.addSizeLocked(-cacheEntry.sizedEntry.Size().Bytes())
+	c.addEvictableSizeLocked(-cacheEntry.sizedEntry.Size().Bytes())
 
-		cacheEntry.sizedEntry.Release()
+	c.evictList.Remove(cacheEntry.listElement)
+	cacheEntry.listElement = nil
+	delete(c.mapping, cacheEntry.key)
+
+	return cacheEntry.sizedEntry
+}
+
+// oldestEvictable returns the time at which the least-recently used entry
+// that is not in use was released, if any.
+func (c *LRUCache[T]) oldestEvictable() (uint64, bool) {
+	c.Lock()
+	defer c.Unlock()
+	element := c.evictList.Back()
+	if element == nil {
+		return 0, false
 	}
+	return element.Value.(*lruCacheEntry[T]).lastUsed, true
 }
 
-func (c *LRUCache[T]) reserveLocked(size Byte) {
-	c.totalSize = Byte(c.totalSize.Bytes() + size.Bytes())
-	c.evictLocked()
+// evictOldest evicts and releases the least-recently used entry that is not in
+// use, regardless of the size limit, and returns whether there was one.
+func (c *LRUCache[T]) evictOldest() bool {
+	c.Lock()
+	element := c.evictList.Back()
+	if element == nil {
+		c.Unlock()
+		return false
+	}
+	evicted := c.releaseEvictedLocked([]lruCacheEviction[T]{
+		c.evictEntryLocked(element.Value.(*lruCacheEntry[T])),
+	})
+	c.Unlock()
+	c.releaseEvicted(evicted)
+	return true
+}
+
+// evictEntryLocked removes an entry that is not in use from the cache due to
+// size pressure.
+func (c *LRUCache[T]) evictEntryLocked(cacheEntry *lruCacheEntry[T]) lruCacheEviction[T] {
+	eviction := lruCacheEviction[T]{
+		key:     cacheEntry.key,
+		expires: cacheEntry.expires,
+	}
+	if c.disk != nil {
+		eviction.epoch = c.disk.currentEpoch()
+	}
+	eviction.value = c.removeLocked(cacheEntry)
+	return eviction
+}
+
+func (c *LRUCache[T]) reserveLocked(size Byte) []lruCacheEviction[T] {
+	c.addSizeLocked(size.Bytes())
+	return c.evictLocked()
+}
+
+// addSizeLocked adds delta to the total size of the cache, and to the total
+// size of the ShardedLRUCache it is a shard of, if any.
+func (c *LRUCache[T]) addSizeLocked(delta int64) {
+	c.totalSize = Byte(c.totalSize.Bytes() + delta)
+	if c.sharedSize != nil {
+		atomic.AddInt64(c.sharedSize, delta)
+	}
+}
+
+// addEvictableSizeLocked adds delta to the evictable size of the cache, and to
+// the evictable size of the ShardedLRUCache it is a shard of, if any.
+func (c *LRUCache[T]) addEvictableSizeLocked(delta int64) {
+	c.evictableSize = Byte(c.evictableSize.Bytes() + delta)
+	if c.sharedEvictableSize != nil {
+		atomic.AddInt64(c.sharedEvictableSize, delta)
+	}
 }
 
 // Get atomically gets a previously-created entry if it was found in the cache,
 // or a newly-created one otherwise. It is the caller's responsibility to call
 // Put() with the returned SizedEntryRef method once it's no longer needed so
 // that the underlying resource can be evicted from the cache, if needed.
+//
+// The factory is invoked without holding the cache lock, so other keys can be
+// accessed while an entry is being created. Concurrent calls for the same key
+// wait for a single invocation of the factory. If it fails, all of them
+// return its error, and the next call for the key invokes the factory again.
+// In a cache created with NewTieredLRUCache, entries that were spilled to disk
+// are promoted back to memory instead of invoking the factory.
 func (c *LRUCache[T]) Get(
 	key string,
 	factory SizedEntryFactory[T],
 ) (*SizedEntryRef[T], error) {
-	c.Lock()
-	defer c.Unlock()
+	return c.GetContext(context.Background(), key, factory)
+}
+
+// GetContext is like Get, but if another caller is already creating the entry,
+// it waits until the creation finishes or ctx is done, in which case ctx.Err()
+// is returned. A factory invoked by this call is not interrupted when ctx is
+// done. In hard-limit mode, ctx also bounds the time waiting for a turn to
+// create the new entry and for room for it.
+func (c *LRUCache[T]) GetContext(
+	ctx context.Context,
+	key string,
+	factory SizedEntryFactory[T],
+) (*SizedEntryRef[T], error) {
+	for {
+		c.Lock()
+
+		var evicted []T
+		if cacheEntry, ok := c.mapping[key]; ok {
+			if cacheEntry.expires.IsZero() || c.now().Before(cacheEntry.expires) {
+				ref := c.acquireLocked(cacheEntry)
+				c.Unlock()
+				return ref, nil
+			}
+			if sizedEntry, ok := c.invalidateLocked(cacheEntry); ok {
+				evicted = append(evicted, sizedEntry)
+			}
+		}
 
-	if cacheEntry, ok := c.mapping[key]; ok {
-		if atomic.AddInt32(&cacheEntry.refCount, 1) == 1 {
-			if cacheEntry.listElement == nil {
-				panic(errors.New("Invalid nil LRU cache list element"))
+		evicted = c.releaseLocked(evicted)
+		if call, ok := c.pending[key]; ok {
+			c.Unlock()
+			c.release(evicted)
+			select {
+			case <-call.done:
+			case <-ctx.Done():
+				return nil, ctx.Err()
 			}
-			c.evictList.Remove(cacheEntry.listElement)
-			c.evictableSize = Byte(c.evictableSize.Bytes() - cacheEntry.sizedEntry.Size().Bytes())
-			cacheEntry.listElement = nil
+			if call.err != nil {
+				return nil, call.err
+			}
+			// The entry was created, so try again to get a reference to it.
+			continue
+		}
+
+		call := &lruCacheCall{done: make(chan struct{})}
+		c.pending[key] = call
+		c.Unlock()
+		c.release(evicted)
+
+		return c.create(ctx, key, factory, call)
+	}
+}
+
+// waitForSpace blocks until there is room for value in the cache without
+// exceeding the hard limit, evicting entries as needed, and then reserves it.
+// value has already been created, so it is held while waiting.
+// If that does not happen before ctx is done, value is released and an error
+// of category ErrLRUCacheFull is returned.
+func (c *LRUCache[T]) waitForSpace(ctx context.Context, key string, value T) error {
+	size := value.Size()
+	limit := Byte(c.sizeLimit.Bytes() + c.maxOvercommit.Bytes())
+	if size > limit {
+		c.release([]T{value})
+		return ErrorWithCategory(
+			ErrLRUCacheFull,
+			errors.Errorf("entry %q of %d bytes is larger than the limit of %d bytes", key, size.Bytes(), limit.Bytes()),
+		)
+	}
+
+	for {
+		c.Lock()
+		evicted := c.evictUntilLocked(Byte(c.sizeLimit.Bytes() - size.Bytes()))
+		fits := c.totalSize.Bytes()+size.Bytes() <= limit.Bytes()
+		if fits {
+			c.addSizeLocked(size.Bytes())
+		}
+		spaceFreed := c.spaceFreed
+		evicted = c.releaseEvictedLocked(evicted)
+		c.Unlock()
+		c.releaseEvicted(evicted)
+
+		if fits {
+			return nil
+		}
+		select {
+		case <-spaceFreed:
+		case <-ctx.Done():
+			c.release([]T{value})
+			return ErrorWithCategory(ErrLRUCacheFull, ctx.Err())
+		}
+	}
+}
+
+// signalSpaceFreedLocked wakes up all the callers waiting for room in the
+// cache.
+func (c *LRUCache[T]) signalSpaceFreedLocked() {
+	close(c.spaceFreed)
+	c.spaceFreed = make(chan struct{})
+}
+
+// acquireLocked increments the reference count of an entry that is already
+// in the cache, removing it from the list of evictable entries if needed.
+func (c *LRUCache[T]) acquireLocked(cacheEntry *lruCacheEntry[T]) *SizedEntryRef[T] {
+	if atomic.AddInt32(&cacheEntry.refCount, 1) == 1 {
+		if cacheEntry.listElement == nil {
+			panic(errors.New("Invalid nil LRU cache list element"))
 		}
-		return &SizedEntryRef[T]{
-			Value:      cacheEntry.sizedEntry,
-			lruCache:   c,
-			cacheEntry: cacheEntry,
-		}, nil
+		c.evictList.Remove(cacheEntry.listElement)
+		c.addEvictableSizeLocked(-cacheEntry.sizedEntry.Size().Bytes())
+		cacheEntry.listElement = nil
+	}
+	return &SizedEntryRef[T]{
+		Value:      cacheEntry.sizedEntry,
+		lruCache:   c,
+		cacheEntry: cacheEntry,
+	}
+}
+
+// create invokes the factory without holding the cache lock, adds the new
+// entry to the cache, and then wakes up the callers waiting for call.
+func (c *LRUCache[T]) create(
+	ctx context.Context,
+	key string,
+	factory SizedEntryFactory[T],
+	call *lruCacheCall,
+) (*SizedEntryRef[T], error) {
+	finished := false
+	defer func() {
+		if finished {
+			return
+		}
+		// The factory panicked. Let the waiters know so that they don't block
+		// forever.
+		c.Lock()
+		delete(c.pending, key)
+		call.err = errors.Errorf("factory for %q panicked", key)
+		close(call.done)
+		c.Unlock()
+	}()
+
+	var value T
+	var expires time.Time
+	var err error
+	promoted := false
+	if c.creations != nil {
+		select {
+		case c.creations <- struct{}{}:
+			defer func() { <-c.creations }()
+		case <-ctx.Done():
+			err = ErrorWithCategory(ErrLRUCacheFull, ctx.Err())
+		}
+	}
+	if err == nil && c.disk != nil {
+		value, expires, promoted = c.disk.take(key, c.now())
+	}
+	if err == nil && !promoted {
+		value, err = factory(key)
+	}
+	finished = true
+
+	if err == nil && c.hardLimit {
+		err = c.waitForSpace(ctx, key, value)
 	}
 
-	value, err := factory(key)
+	c.Lock()
+	delete(c.pending, key)
 	if err != nil {
+		call.err = err
+		close(call.done)
+		c.Unlock()
 		return nil, err
 	}
 
-	c.reserveLocked(value.Size())
+	var evicted []lruCacheEviction[T]
+	if !c.hardLimit {
+		// In hard-limit mode, waitForSpace already reserved the space.
+		evicted = c.reserveLocked(value.Size())
+	}
 	cacheEntry := &lruCacheEntry[T]{
 		refCount:   1,
 		sizedEntry: value,
 		key:        key,
 	}
+	if promoted {
+		// Entries promoted from disk keep the expiration time they had when
+		// they were created.
+		cacheEntry.expires = expires
+	} else {
+		cacheEntry.expires = c.expiration(value)
+	}
 
-	c.mapping[key] = cacheEntry
+	if call.invalidated {
+		cacheEntry.detached = true
+	} else {
+		c.mapping[key] = cacheEntry
+	}
+	close(call.done)
+	evicted = c.releaseEvictedLocked(evicted)
+	c.Unlock()
 
+	c.releaseEvicted(evicted)
 	return &SizedEntryRef[T]{
 		Value:      value,
 		lruCache:   c,
@@ -137,13 +636,44 @@ func (c *LRUCache[T]) Get(
 	}, nil
 }
 
+// expiration returns the time after which a newly-created entry can no longer
+// be served from the cache, or zero if it never expires.
+func (c *LRUCache[T]) expiration(value T) time.Time {
+	ttl := c.ttl
+	if expiring, ok := any(value).(ExpiringSizedEntry); ok {
+		ttl = time.Duration(expiring.TTL())
+	}
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return c.now().Add(ttl)
+}
+
 // Put marks a SizedEntryRef as no longer being referred to, so that it can be
 // considered for eviction.
 func (c *LRUCache[T]) Put(r *SizedEntryRef[T]) {
 	c.Lock()
-	defer c.Unlock()
 
 	if atomic.AddInt32(&r.cacheEntry.refCount, -1) != 0 {
+		c.Unlock()
+		return
+	}
+
+	if r.cacheEntry.detached {
+		// The entry was invalidated while it was in use, so it is released
+		// right away.
+		sizedEntry := r.cacheEntry.sizedEntry
+		c.addSizeLocked(-sizedEntry.Size().Bytes())
+		c.signalSpaceFreedLocked()
+
+		var zero T
+		r.Value = zero
+		r.lruCache = nil
+		r.cacheEntry = nil
+		evicted := c.releaseLocked([]T{sizedEntry})
+		c.Unlock()
+
+		c.release(evicted)
 		return
 	}
 
@@ -155,14 +685,78 @@ func (c *LRUCache[T]) Put(r *SizedEntryRef[T]) {
 	}
 
 	r.cacheEntry.listElement = c.evictList.PushFront(r.cacheEntry)
-	c.evictableSize = Byte(c.evictableSize.Bytes() + r.cacheEntry.sizedEntry.Size().Bytes())
-	c.evictLocked()
+	r.cacheEntry.lastUsed = atomic.AddUint64(c.clock, 1)
+	c.addEvictableSizeLocked(r.cacheEntry.sizedEntry.Size().Bytes())
+	evicted := c.evictLocked()
+	c.signalSpaceFreedLocked()
 
 	// Prevent double-releasing.
 	var zero T
 	r.Value = zero
 	r.lruCache = nil
 	r.cacheEntry = nil
+	evicted = c.releaseEvictedLocked(evicted)
+	c.Unlock()
+
+	c.releaseEvicted(evicted)
+}
+
+// Invalidate removes the entry associated with key from the cache, so that
+// the next Get creates a new one. If the entry is not in use, it is released
+// immediately. Otherwise, it is released once its last reference is returned
+// through Put. If the entry is being created, it will not be served to anyone
+// other than the caller that created it. Any copy of the entry in the disk
+// tier is removed as well.
+func (c *LRUCache[T]) Invalidate(key string) {
+	c.invalidateMatching(func(k string) bool { return k == key })
+}
+
+// InvalidatePrefix invalidates all the entries whose keys start with prefix.
+func (c *LRUCache[T]) InvalidatePrefix(prefix string) {
+	c.invalidateMatching(func(k string) bool { return strings.HasPrefix(k, prefix) })
+}
+
+// InvalidateAll invalidates all the entries in the cache.
+func (c *LRUCache[T]) InvalidateAll() {
+	c.invalidateMatching(func(k string) bool { return true })
+}
+
+func (c *LRUCache[T]) invalidateMatching(match func(key string) bool) {
+	c.Lock()
+	var evicted []T
+	for key, cacheEntry := range c.mapping {
+		if !match(key) {
+			continue
+		}
+		if sizedEntry, ok := c.invalidateLocked(cacheEntry); ok {
+			evicted = append(evicted, sizedEntry)
+		}
+	}
+	for key, call := range c.pending {
+		if match(key) {
+			call.invalidated = true
+		}
+	}
+	evicted = c.releaseLocked(evicted)
+	c.Unlock()
+
+	c.release(evicted)
+	if c.disk != nil {
+		c.disk.remove(match)
+	}
+}
+
+// invalidateLocked removes the entry from the mapping. If it is not in use, it
+// is removed from the cache and returned so that it can be released.
+// Otherwise, it is detached so that it is released on its last Put.
+func (c *LRUCache[T]) invalidateLocked(cacheEntry *lruCacheEntry[T]) (T, bool) {
+	if cacheEntry.listElement != nil {
+		return c.removeLocked(cacheEntry), true
+	}
+	delete(c.mapping, cacheEntry.key)
+	cacheEntry.detached = true
+	var zero T
+	return zero, false
 }
 
 // EntryCount is the number of elements in the LRUCache.
@@ -190,3 +784,22 @@ func (c *LRUCache[T]) OvercommittedSize() Byte {
 		Byte(c.totalSize.Bytes()-c.sizeLimit.Bytes()),
 	)
 }
+
+// DiskEntryCount is the number of elements in the disk tier of the LRUCache.
+// It is always zero if the cache was not created with NewTieredLRUCache.
+func (c *LRUCache[T]) DiskEntryCount() int {
+	if c.disk == nil {
+		return 0
+	}
+	return c.disk.entryCount()
+}
+
+// DiskSize is the total size in bytes of the files in the disk tier of the
+// LRUCache. It is always zero if the cache was not created with
+// NewTieredLRUCache.
+func (c *LRUCache[T]) DiskSize() Byte {
+	if c.disk == nil {
+		return 0
+	}
+	return c.disk.size()
+}
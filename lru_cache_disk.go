@@ -0,0 +1,455 @@
+package base
+
+import (
+	"bufio"
+	"container/list"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/omegaup/go-base/v3/logging"
+	"github.com/pkg/errors"
+)
+
+const (
+	// lruCacheDiskExtension is the extension of the files in the disk tier of
+	// an LRUCache.
+	lruCacheDiskExtension = ".entry"
+
+	// lruCacheDiskMaxKeyLength is the maximum length of a key that is read
+	// from a file in the disk tier, to avoid huge allocations when reading
+	// corrupt files.
+	lruCacheDiskMaxKeyLength = 64 * 1024
+)
+
+// A SizedEntryCodec serializes the entries of an LRUCache so that they can be
+// spilled to disk.
+type SizedEntryCodec[T SizedEntry] interface {
+	// Encode writes the contents of value into w.
+	Encode(w io.Writer, value T) error
+
+	// Decode reads an entry that was previously written by Encode from r.
+	Decode(key string, r io.Reader) (T, error)
+}
+
+// LRUCacheDiskOptions are options that can be passed to NewTieredLRUCache to
+// customize the disk tier of the cache.
+type LRUCacheDiskOptions[T SizedEntry] struct {
+	// Dir is the directory where the entries are stored. It is created if it
+	// does not exist. Entries that were stored by a previous process are
+	// picked up, and leftover temporary files are removed.
+	Dir string
+
+	// SizeLimit is the maximum total size of the files in Dir before the
+	// least-recently spilled ones are removed. An entry whose file would be
+	// larger than SizeLimit is not spilled.
+	SizeLimit Byte
+
+	// Codec is used to write the entries to disk and read them back.
+	Codec SizedEntryCodec[T]
+
+	// Log is used to report the entries that could not be written or read.
+	// Failures are silently ignored if unset.
+	Log logging.Logger
+}
+
+// An lruCacheDiskEntry is a file in the disk tier of an LRUCache.
+type lruCacheDiskEntry struct {
+	key         string
+	path        string
+	size        Byte
+	expires     time.Time
+	seq         uint64
+	listElement *list.Element
+}
+
+// An lruCacheDisk is the disk tier of an LRUCache. Every entry is stored in
+// its own file, which is written atomically so that a crash never leaves a
+// partially-written entry behind. Files are named after an increasing
+// sequence number, so that concurrent spills of the same key never overwrite
+// each other, and so that the order in which they were spilled can be
+// recovered after a restart. Entries are removed from disk when they are
+// promoted back to memory.
+type lruCacheDisk[T SizedEntry] struct {
+	// epoch is incremented atomically every time entries are invalidated.
+	epoch uint64
+	// seq is incremented atomically to name every new file.
+	seq uint64
+
+	dir       string
+	sizeLimit Byte
+	codec     SizedEntryCodec[T]
+	log       logging.Logger
+
+	lock      sync.Mutex
+	entries   map[string]*lruCacheDiskEntry
+	evictList *list.List
+	totalSize Byte
+}
+
+// NewTieredLRUCache returns an LRUCache with the provided options whose
+// entries are spilled to a directory on disk when they are evicted due to size
+// pressure, instead of being discarded. The disk tier has its own size limit
+// and least-recently used eviction policy, and entries are promoted back to
+// memory the next time they are requested. Entries that are invalidated or
+// expire are not spilled.
+func NewTieredLRUCache[T SizedEntry](
+	options LRUCacheOptions,
+	diskOptions LRUCacheDiskOptions[T],
+) (*LRUCache[T], error) {
+	if diskOptions.Dir == "" {
+		return nil, errors.New("missing disk tier directory")
+	}
+	if diskOptions.Codec == nil {
+		return nil, errors.New("missing disk tier codec")
+	}
+	disk := &lruCacheDisk[T]{
+		dir:       diskOptions.Dir,
+		sizeLimit: diskOptions.SizeLimit,
+		codec:     diskOptions.Codec,
+		log:       diskOptions.Log,
+		entries:   make(map[string]*lruCacheDiskEntry),
+		evictList: list.New(),
+	}
+	if err := disk.load(time.Now()); err != nil {
+		return nil, errors.Wrapf(err, "failed to load disk tier from %q", diskOptions.Dir)
+	}
+
+	c := NewLRUCacheWithOptions[T](options)
+	c.disk = disk
+	return c, nil
+}
+
+// load creates the directory if needed and indexes the entries that were
+// stored in it by a previous process.
+func (d *lruCacheDisk[T]) load(now time.Time) error {
+	if err := os.MkdirAll(d.dir, 0o755); err != nil {
+		return err
+	}
+	dirEntries, err := os.ReadDir(d.dir)
+	if err != nil {
+		return err
+	}
+
+	var loaded []*lruCacheDiskEntry
+	for _, dirEntry := range dirEntries {
+		name := dirEntry.Name()
+		path := filepath.Join(d.dir, name)
+		if strings.HasPrefix(name, ".") && strings.Contains(name, lruCacheDiskExtension+".tmp") {
+			// A temporary file that was not committed before a crash.
+			os.Remove(path)
+			continue
+		}
+		if !strings.HasSuffix(name, lruCacheDiskExtension) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, lruCacheDiskExtension), 10, 64)
+		if err != nil {
+			continue
+		}
+		entry, err := readLRUCacheDiskEntry(path)
+		if err != nil {
+			d.logError("failed to read cache entry from disk", path, err)
+			os.Remove(path)
+			continue
+		}
+		entry.seq = seq
+		loaded = append(loaded, entry)
+	}
+	sort.Slice(loaded, func(i, j int) bool {
+		return loaded[i].seq < loaded[j].seq
+	})
+
+	var removed []string
+	for _, entry := range loaded {
+		if entry.seq > d.seq {
+			d.seq = entry.seq
+		}
+		if !entry.expires.IsZero() && !now.Before(entry.expires) {
+			removed = append(removed, entry.path)
+			continue
+		}
+		if previous, ok := d.entries[entry.key]; ok {
+			removed = append(removed, d.removeEntryLocked(previous))
+		}
+		d.addEntryLocked(entry)
+	}
+	removed = append(removed, d.evictLocked()...)
+	removeFiles(removed)
+	return nil
+}
+
+// readLRUCacheDiskEntry reads the header of a file in the disk tier.
+func readLRUCacheDiskEntry(path string) (*lruCacheDiskEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	key, expires, err := readLRUCacheDiskHeader(bufio.NewReader(f))
+	if err != nil {
+		return nil, err
+	}
+	return &lruCacheDiskEntry{
+		key:     key,
+		path:    path,
+		size:    Byte(info.Size()),
+		expires: expires,
+	}, nil
+}
+
+// writeLRUCacheDiskHeader writes the key and the expiration time of an entry,
+// which precede its encoded value in its file.
+func writeLRUCacheDiskHeader(w io.Writer, key string, expires time.Time) error {
+	var expiresNanos int64
+	if !expires.IsZero() {
+		expiresNanos = expires.UnixNano()
+	}
+	buf := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(buf, uint64(len(key)))
+	if _, err := w.Write(buf[:n]); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, key); err != nil {
+		return err
+	}
+	n = binary.PutVarint(buf, expiresNanos)
+	_, err := w.Write(buf[:n])
+	return err
+}
+
+// readLRUCacheDiskHeader reads the header that was written by
+// writeLRUCacheDiskHeader.
+func readLRUCacheDiskHeader(r *bufio.Reader) (string, time.Time, error) {
+	keyLength, err := binary.ReadUvarint(r)
+	if err != nil {
+		return "", time.Time{}, errors.Wrap(err, "failed to read key length")
+	}
+	if keyLength > lruCacheDiskMaxKeyLength {
+		return "", time.Time{}, errors.Errorf("key length %d is too large", keyLength)
+	}
+	key := make([]byte, keyLength)
+	if _, err := io.ReadFull(r, key); err != nil {
+		return "", time.Time{}, errors.Wrap(err, "failed to read key")
+	}
+	expiresNanos, err := binary.ReadVarint(r)
+	if err != nil {
+		return "", time.Time{}, errors.Wrap(err, "failed to read expiration time")
+	}
+	var expires time.Time
+	if expiresNanos != 0 {
+		expires = time.Unix(0, expiresNanos)
+	}
+	return string(key), expires, nil
+}
+
+// currentEpoch returns the current invalidation epoch.
+func (d *lruCacheDisk[T]) currentEpoch() uint64 {
+	return atomic.LoadUint64(&d.epoch)
+}
+
+// spill writes an entry that was evicted from memory into its own file. The
+// entry is discarded if it has already expired, or if any entries were
+// invalidated since it was evicted.
+func (d *lruCacheDisk[T]) spill(eviction lruCacheEviction[T], now time.Time) {
+	if !eviction.expires.IsZero() && !now.Before(eviction.expires) {
+		return
+	}
+	if d.currentEpoch() != eviction.epoch {
+		return
+	}
+
+	seq := atomic.AddUint64(&d.seq, 1)
+	path := filepath.Join(d.dir, fmt.Sprintf("%020d%s", seq, lruCacheDiskExtension))
+	size, err := d.write(path, eviction)
+	if err != nil {
+		if !HasErrorCategory(err, ErrAtomicFileTooLarge) {
+			d.logError("failed to write cache entry to disk", path, err)
+		}
+		return
+	}
+
+	d.lock.Lock()
+	if d.currentEpoch() != eviction.epoch {
+		// The entry was potentially invalidated while it was being written.
+		d.lock.Unlock()
+		os.Remove(path)
+		return
+	}
+	var removed []string
+	if previous, ok := d.entries[eviction.key]; ok {
+		removed = append(removed, d.removeEntryLocked(previous))
+	}
+	d.addEntryLocked(&lruCacheDiskEntry{
+		key:     eviction.key,
+		path:    path,
+		size:    size,
+		expires: eviction.expires,
+		seq:     seq,
+	})
+	removed = append(removed, d.evictLocked()...)
+	d.lock.Unlock()
+
+	removeFiles(removed)
+}
+
+// write atomically writes the entry to path and returns the size of the file.
+func (d *lruCacheDisk[T]) write(path string, eviction lruCacheEviction[T]) (Byte, error) {
+	f, err := NewAtomicFile(path, 0o644, d.sizeLimit)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	if err := writeLRUCacheDiskHeader(w, eviction.key, eviction.expires); err != nil {
+		return 0, err
+	}
+	if err := d.codec.Encode(w, eviction.value); err != nil {
+		return 0, err
+	}
+	if err := w.Flush(); err != nil {
+		return 0, err
+	}
+	size := f.Size()
+	if err := f.Commit(); err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+// take removes the entry associated with key from the disk tier and returns
+// its decoded value and expiration time. It returns false if the entry is not
+// on disk, has expired, or could not be read.
+func (d *lruCacheDisk[T]) take(key string, now time.Time) (T, time.Time, bool) {
+	var zero T
+
+	d.lock.Lock()
+	entry, ok := d.entries[key]
+	if ok {
+		d.removeEntryLocked(entry)
+	}
+	d.lock.Unlock()
+
+	if !ok {
+		return zero, time.Time{}, false
+	}
+	defer os.Remove(entry.path)
+	if !entry.expires.IsZero() && !now.Before(entry.expires) {
+		return zero, time.Time{}, false
+	}
+
+	value, err := d.read(entry)
+	if err != nil {
+		d.logError("failed to read cache entry from disk", entry.path, err)
+		return zero, time.Time{}, false
+	}
+	return value, entry.expires, true
+}
+
+// read decodes the value stored in the file of the entry.
+func (d *lruCacheDisk[T]) read(entry *lruCacheDiskEntry) (T, error) {
+	var zero T
+	f, err := os.Open(entry.path)
+	if err != nil {
+		return zero, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	key, _, err := readLRUCacheDiskHeader(r)
+	if err != nil {
+		return zero, err
+	}
+	if key != entry.key {
+		return zero, errors.Errorf("unexpected key %q, want %q", key, entry.key)
+	}
+	return d.codec.Decode(key, r)
+}
+
+// remove removes all the entries whose keys match from the disk tier, and
+// makes sure that entries that are being spilled concurrently are discarded.
+func (d *lruCacheDisk[T]) remove(match func(key string) bool) {
+	d.lock.Lock()
+	atomic.AddUint64(&d.epoch, 1)
+	var removed []string
+	for key, entry := range d.entries {
+		if match(key) {
+			removed = append(removed, d.removeEntryLocked(entry))
+		}
+	}
+	d.lock.Unlock()
+
+	removeFiles(removed)
+}
+
+// addEntryLocked adds the entry as the most-recently used one.
+func (d *lruCacheDisk[T]) addEntryLocked(entry *lruCacheDiskEntry) {
+	entry.listElement = d.evictList.PushFront(entry)
+	d.entries[entry.key] = entry
+	d.totalSize = Byte(d.totalSize.Bytes() + entry.size.Bytes())
+}
+
+// removeEntryLocked removes the entry from the index and returns the path of
+// its file, which must be removed after releasing the lock.
+func (d *lruCacheDisk[T]) removeEntryLocked(entry *lruCacheDiskEntry) string {
+	d.evictList.Remove(entry.listElement)
+	delete(d.entries, entry.key)
+	d.totalSize = Byte(d.totalSize.Bytes() - entry.size.Bytes())
+	return entry.path
+}
+
+// evictLocked removes the least-recently used entries until the disk tier
+// fits within its size limit, and returns the paths of their files.
+func (d *lruCacheDisk[T]) evictLocked() []string {
+	var removed []string
+	for d.totalSize > d.sizeLimit {
+		element := d.evictList.Back()
+		if element == nil {
+			break
+		}
+		removed = append(removed, d.removeEntryLocked(element.Value.(*lruCacheDiskEntry)))
+	}
+	return removed
+}
+
+func (d *lruCacheDisk[T]) entryCount() int {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return len(d.entries)
+}
+
+func (d *lruCacheDisk[T]) size() Byte {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.totalSize
+}
+
+func (d *lruCacheDisk[T]) logError(msg string, path string, err error) {
+	if d.log == nil {
+		return
+	}
+	d.log.Error(msg, map[string]any{
+		"path": path,
+		"err":  err,
+	})
+}
+
+// removeFiles removes the files, ignoring any errors.
+func removeFiles(paths []string) {
+	for _, path := range paths {
+		os.Remove(path)
+	}
+}
@@ -0,0 +1,241 @@
+package base
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type blob struct {
+	contents string
+	released bool
+}
+
+func (b *blob) Release() {
+	b.released = true
+}
+
+func (b *blob) Size() Byte {
+	return Byte(len(b.contents))
+}
+
+type blobCodec struct{}
+
+func (blobCodec) Encode(w io.Writer, value *blob) error {
+	_, err := io.WriteString(w, value.contents)
+	return err
+}
+
+func (blobCodec) Decode(key string, r io.Reader) (*blob, error) {
+	contents, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return &blob{contents: string(contents)}, nil
+}
+
+func getBlob(t *testing.T, c *LRUCache[*blob], key string, created *int) string {
+	t.Helper()
+	ref, err := c.Get(key, func(key string) (*blob, error) {
+		*created++
+		return &blob{contents: key + "-contents"}, nil
+	})
+	if err != nil {
+		t.Fatalf("c.Get(%q) failed with %v", key, err)
+	}
+	contents := ref.Value.contents
+	c.Put(ref)
+	return contents
+}
+
+func TestTieredLRUCache(t *testing.T) {
+	dirname, err := ioutil.TempDir("", "tiered-lru-cache")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir failed with %v", err)
+	}
+	defer os.RemoveAll(dirname)
+
+	newCache := func() *LRUCache[*blob] {
+		c, err := NewTieredLRUCache[*blob](
+			LRUCacheOptions{SizeLimit: Byte(16)},
+			LRUCacheDiskOptions[*blob]{
+				Dir:       dirname,
+				SizeLimit: Byte(64),
+				Codec:     blobCodec{},
+			},
+		)
+		if err != nil {
+			t.Fatalf("NewTieredLRUCache failed with %v", err)
+		}
+		return c
+	}
+	c := newCache()
+
+	// "a-contents" is 10 bytes, so only one entry fits in memory, and the
+	// other one is spilled to disk.
+	created := 0
+	getBlob(t, c, "a", &created)
+	getBlob(t, c, "b", &created)
+	if created != 2 {
+		t.Errorf("created = %d, want 2", created)
+	}
+	if c.EntryCount() != 1 {
+		t.Errorf("c.EntryCount() = %d, want 1", c.EntryCount())
+	}
+	if c.DiskEntryCount() != 1 {
+		t.Errorf("c.DiskEntryCount() = %d, want 1", c.DiskEntryCount())
+	}
+
+	// The entry is promoted back to memory without invoking the factory, and
+	// the other one is spilled in its place.
+	if contents := getBlob(t, c, "a", &created); contents != "a-contents" {
+		t.Errorf("contents = %q, want %q", contents, "a-contents")
+	}
+	if created != 2 {
+		t.Errorf("created = %d, want 2", created)
+	}
+	if c.DiskEntryCount() != 1 {
+		t.Errorf("c.DiskEntryCount() = %d, want 1", c.DiskEntryCount())
+	}
+
+	// The disk tier has its own size limit. Every file has a 3-byte header, so
+	// only four entries fit.
+	for _, key := range []string{"c", "d", "e", "f", "g"} {
+		getBlob(t, c, key, &created)
+	}
+	if c.DiskEntryCount() != 4 {
+		t.Errorf("c.DiskEntryCount() = %d, want 4", c.DiskEntryCount())
+	}
+	if c.DiskSize() != Byte(52) {
+		t.Errorf("c.DiskSize() = %d, want 52", c.DiskSize().Bytes())
+	}
+	created = 0
+	getBlob(t, c, "a", &created)
+	if created != 1 {
+		t.Errorf("created = %d, want 1", created)
+	}
+
+	// Invalidated entries are removed from disk.
+	c.InvalidateAll()
+	if c.DiskEntryCount() != 0 {
+		t.Errorf("c.DiskEntryCount() = %d, want 0", c.DiskEntryCount())
+	}
+	files, err := filepath.Glob(filepath.Join(dirname, "*"))
+	if err != nil {
+		t.Fatalf("filepath.Glob failed with %v", err)
+	}
+	if len(files) != 0 {
+		t.Errorf("files = %v, want none", files)
+	}
+
+	// The disk tier survives a restart, and leftover temporary files are
+	// removed.
+	getBlob(t, c, "x", &created)
+	getBlob(t, c, "y", &created)
+	tempPath := filepath.Join(dirname, ".00000000000000000100.entry.tmp1234")
+	if err := ioutil.WriteFile(tempPath, []byte("partial"), 0o644); err != nil {
+		t.Fatalf("ioutil.WriteFile failed with %v", err)
+	}
+
+	c = newCache()
+	if c.DiskEntryCount() != 1 {
+		t.Errorf("c.DiskEntryCount() = %d, want 1", c.DiskEntryCount())
+	}
+	if _, err := os.Stat(tempPath); !os.IsNotExist(err) {
+		t.Errorf("os.Stat(%q) = %v, want not exist", tempPath, err)
+	}
+	created = 0
+	if contents := getBlob(t, c, "x", &created); contents != "x-contents" {
+		t.Errorf("contents = %q, want %q", contents, "x-contents")
+	}
+	if created != 0 {
+		t.Errorf("created = %d, want 0", created)
+	}
+}
+
+// blockingBlobCodec is a blobCodec that blocks while encoding one of the
+// entries.
+type blockingBlobCodec struct {
+	blobCodec
+	contents string
+	encoding chan struct{}
+	proceed  chan struct{}
+}
+
+func (c blockingBlobCodec) Encode(w io.Writer, value *blob) error {
+	if value.contents == c.contents {
+		close(c.encoding)
+		<-c.proceed
+	}
+	return c.blobCodec.Encode(w, value)
+}
+
+func TestTieredLRUCacheSpillWithoutLock(t *testing.T) {
+	dirname, err := ioutil.TempDir("", "tiered-lru-cache")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir failed with %v", err)
+	}
+	defer os.RemoveAll(dirname)
+
+	codec := blockingBlobCodec{
+		contents: "a-contents",
+		encoding: make(chan struct{}),
+		proceed:  make(chan struct{}),
+	}
+	c, err := NewTieredLRUCache[*blob](
+		LRUCacheOptions{SizeLimit: Byte(16)},
+		LRUCacheDiskOptions[*blob]{
+			Dir:       dirname,
+			SizeLimit: Byte(64),
+			Codec:     codec,
+		},
+	)
+	if err != nil {
+		t.Fatalf("NewTieredLRUCache failed with %v", err)
+	}
+
+	created := 0
+	getBlob(t, c, "a", &created)
+	a := c.mapping["a"].sizedEntry
+	spilled := make(chan struct{})
+	go func() {
+		defer close(spilled)
+		ref, err := c.Get("b", func(key string) (*blob, error) {
+			return &blob{contents: key + "-contents"}, nil
+		})
+		if err != nil {
+			t.Errorf("c.Get(%q) failed with %v", "b", err)
+			return
+		}
+		c.Put(ref)
+	}()
+	<-codec.encoding
+
+	// The cache can be used while the evicted entry is being spilled.
+	ref, err := c.Get("c", func(key string) (*blob, error) {
+		created++
+		return &blob{contents: key + "-contents"}, nil
+	})
+	if err != nil {
+		t.Fatalf("c.Get(%q) failed with %v", "c", err)
+	}
+	if a.released {
+		t.Errorf("a was released before it was spilled")
+	}
+	close(codec.proceed)
+	<-spilled
+	c.Put(ref)
+	if !a.released {
+		t.Errorf("a was not released after it was spilled")
+	}
+
+	// The entry was spilled before it was released, so it is promoted back.
+	if contents := getBlob(t, c, "a", &created); contents != "a-contents" {
+		t.Errorf("contents = %q, want %q", contents, "a-contents")
+	}
+	if created != 2 {
+		t.Errorf("created = %d, want 2", created)
+	}
+}
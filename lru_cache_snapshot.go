@@ -0,0 +1,410 @@
+package base
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/omegaup/go-base/v3/logging"
+	"github.com/pkg/errors"
+)
+
+// lruCacheSnapshotMagic is written at the start of every snapshot file.
+const lruCacheSnapshotMagic = "LRUSNAP1"
+
+// An lruCacheSnapshotRecord is an entry that was read from a snapshot file.
+type lruCacheSnapshotRecord struct {
+	key     string
+	expires time.Time
+
+	// value is the encoded value of the entry. It is only meaningful if
+	// hasValue is true.
+	value    []byte
+	hasValue bool
+}
+
+// LRUCacheRestoreOptions are options that can be passed to
+// LRUCache.RestoreSnapshot to customize how the entries are restored.
+type LRUCacheRestoreOptions[T SizedEntry] struct {
+	// Codec is used to decode the values that were saved in the snapshot. The
+	// factory is invoked for all the entries if unset, or for the ones whose
+	// value was not saved.
+	Codec SizedEntryCodec[T]
+
+	// Lazy makes RestoreSnapshot return as soon as the snapshot is read, and
+	// restore the entries in the background. Calls to Get for entries that
+	// have not been restored yet invoke their factory as usual.
+	Lazy bool
+
+	// Log is used to report the entries that could not be restored. Failures
+	// are silently ignored if unset.
+	Log logging.Logger
+}
+
+// WriteSnapshot atomically writes the keys of the entries in the cache to
+// path, from the most- to the least-recently used, where the entries that are
+// in use are considered to be the most-recently used. If codec is not nil, the
+// values are written too. Entries that have expired are skipped.
+//
+// In order to encode the values, the entries are marked as in use while the
+// snapshot is written, so they cannot be evicted during that time.
+func (c *LRUCache[T]) WriteSnapshot(path string, codec SizedEntryCodec[T]) error {
+	c.Lock()
+	now := c.now()
+	var inUse, evictable []*lruCacheEntry[T]
+	for _, cacheEntry := range c.mapping {
+		if cacheEntry.listElement == nil {
+			inUse = append(inUse, cacheEntry)
+		}
+	}
+	sort.Slice(inUse, func(i, j int) bool {
+		return inUse[i].lastUsed > inUse[j].lastUsed
+	})
+	for element := c.evictList.Front(); element != nil; element = element.Next() {
+		evictable = append(evictable, element.Value.(*lruCacheEntry[T]))
+	}
+	var entries []*lruCacheEntry[T]
+	for _, cacheEntry := range append(inUse, evictable...) {
+		if cacheEntry.expires.IsZero() || now.Before(cacheEntry.expires) {
+			entries = append(entries, cacheEntry)
+		}
+	}
+	var refs []*SizedEntryRef[T]
+	if codec != nil {
+		for _, cacheEntry := range entries {
+			refs = append(refs, c.acquireLocked(cacheEntry))
+		}
+	}
+	c.Unlock()
+
+	defer func() {
+		// Return the entries in reverse order, so that their relative recency
+		// is preserved.
+		for i := len(refs) - 1; i >= 0; i-- {
+			c.Put(refs[i])
+		}
+	}()
+
+	f, err := NewAtomicFile(path, 0o644, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	if _, err := io.WriteString(w, lruCacheSnapshotMagic); err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	for i, cacheEntry := range entries {
+		if err := writeLRUCacheDiskHeader(w, cacheEntry.key, cacheEntry.expires); err != nil {
+			return err
+		}
+		if codec == nil {
+			if err := writeUvarint(w, 0); err != nil {
+				return err
+			}
+			continue
+		}
+		buf.Reset()
+		if err := codec.Encode(&buf, refs[i].Value); err != nil {
+			return errors.Wrapf(err, "failed to encode %q", cacheEntry.key)
+		}
+		// The length is offset by one, so that zero means that the value was
+		// not saved.
+		if err := writeUvarint(w, uint64(buf.Len())+1); err != nil {
+			return err
+		}
+		if _, err := w.Write(buf.Bytes()); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return f.Commit()
+}
+
+// RestoreSnapshot adds the entries saved in the snapshot at path by
+// WriteSnapshot to the cache, by decoding their values or invoking factory,
+// in the saved order. Restoration stops once the cache reaches its size limit,
+// so that the most-recently used entries are prioritized, and the entries keep
+// their relative recency order. Entries that are already in the cache or that
+// have expired are skipped, and the ones that fail to be restored are logged.
+// Restoration stops when ctx is done.
+//
+// If path does not exist, the cache is left empty and nil is returned.
+func (c *LRUCache[T]) RestoreSnapshot(
+	ctx context.Context,
+	path string,
+	factory SizedEntryFactory[T],
+	options LRUCacheRestoreOptions[T],
+) error {
+	records, err := readLRUCacheSnapshot(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errors.Wrapf(err, "failed to read snapshot %q", path)
+	}
+
+	if options.Lazy {
+		go c.restore(ctx, records, factory, options)
+		return nil
+	}
+	return c.restore(ctx, records, factory, options)
+}
+
+func (c *LRUCache[T]) restore(
+	ctx context.Context,
+	records []lruCacheSnapshotRecord,
+	factory SizedEntryFactory[T],
+	options LRUCacheRestoreOptions[T],
+) error {
+	for _, record := range records {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		full, err := c.restoreEntry(record, factory, options.Codec)
+		if err != nil && options.Log != nil {
+			options.Log.Warn("failed to restore cache entry", map[string]any{
+				"key": record.key,
+				"err": err,
+			})
+		}
+		if full {
+			return nil
+		}
+	}
+	return nil
+}
+
+// restoreEntry adds the entry as the least-recently used one. It returns true
+// if the cache is full and restoration must stop.
+func (c *LRUCache[T]) restoreEntry(
+	record lruCacheSnapshotRecord,
+	factory SizedEntryFactory[T],
+	codec SizedEntryCodec[T],
+) (bool, error) {
+	c.Lock()
+	if _, ok := c.mapping[record.key]; ok {
+		c.Unlock()
+		return false, nil
+	}
+	if _, ok := c.pending[record.key]; ok {
+		c.Unlock()
+		return false, nil
+	}
+	if c.totalSize >= c.sizeLimit {
+		c.Unlock()
+		return true, nil
+	}
+	if !record.expires.IsZero() && !c.now().Before(record.expires) {
+		c.Unlock()
+		return false, nil
+	}
+	call := &lruCacheCall{done: make(chan struct{})}
+	c.pending[record.key] = call
+	c.Unlock()
+
+	finished := false
+	defer func() {
+		if finished {
+			return
+		}
+		// The factory panicked. Let the waiters know so that they don't block
+		// forever.
+		c.Lock()
+		delete(c.pending, record.key)
+		call.err = errors.Errorf("factory for %q panicked", record.key)
+		close(call.done)
+		c.Unlock()
+	}()
+
+	var value T
+	var err error
+	decoded := record.hasValue && codec != nil
+	if decoded {
+		value, err = codec.Decode(record.key, bytes.NewReader(record.value))
+	} else {
+		value, err = factory(record.key)
+	}
+	finished = true
+
+	c.Lock()
+	delete(c.pending, record.key)
+	if err != nil {
+		call.err = err
+		close(call.done)
+		c.Unlock()
+		return false, err
+	}
+
+	size := value.Size()
+	invalidated := call.invalidated
+	fits := c.totalSize.Bytes()+size.Bytes() <= c.sizeLimit.Bytes()
+	if fits && !invalidated {
+		cacheEntry := &lruCacheEntry[T]{
+			sizedEntry: value,
+			key:        record.key,
+			expires:    record.expires,
+		}
+		if !decoded {
+			cacheEntry.expires = c.expiration(value)
+		}
+		cacheEntry.listElement = c.evictList.PushBack(cacheEntry)
+		c.mapping[record.key] = cacheEntry
+		c.addSizeLocked(size.Bytes())
+		c.addEvictableSizeLocked(size.Bytes())
+	}
+	close(call.done)
+	c.Unlock()
+
+	if !fits || invalidated {
+		c.release([]T{value})
+	}
+	return !fits, nil
+}
+
+// readLRUCacheSnapshot reads all the records in the snapshot at path.
+func readLRUCacheSnapshot(path string) ([]lruCacheSnapshotRecord, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	r := bufio.NewReader(f)
+	magic := make([]byte, len(lruCacheSnapshotMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != lruCacheSnapshotMagic {
+		return nil, errors.New("not a cache snapshot")
+	}
+
+	var records []lruCacheSnapshotRecord
+	for {
+		if _, err := r.Peek(1); err == io.EOF {
+			return records, nil
+		}
+		key, expires, err := readLRUCacheDiskHeader(r)
+		if err != nil {
+			return nil, err
+		}
+		record := lruCacheSnapshotRecord{
+			key:     key,
+			expires: expires,
+		}
+		valueLength, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read value length")
+		}
+		if valueLength > 0 {
+			if valueLength-1 > uint64(info.Size()) {
+				return nil, errors.Errorf("value length %d is too large", valueLength-1)
+			}
+			record.value = make([]byte, valueLength-1)
+			if _, err := io.ReadFull(r, record.value); err != nil {
+				return nil, errors.Wrap(err, "failed to read value")
+			}
+			record.hasValue = true
+		}
+		records = append(records, record)
+	}
+}
+
+func writeUvarint(w io.Writer, x uint64) error {
+	buf := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(buf, x)
+	_, err := w.Write(buf[:n])
+	return err
+}
+
+// LRUCacheSnapshotterOptions are options that can be passed to
+// NewLRUCacheSnapshotter to customize its behavior.
+type LRUCacheSnapshotterOptions[T SizedEntry] struct {
+	// Path is the file where the snapshot is written.
+	Path string
+
+	// Codec is used to write the values of the entries along with their keys.
+	// Only the keys are written if unset.
+	Codec SizedEntryCodec[T]
+
+	// Interval is the time between snapshots. Snapshots are only written on
+	// Close if unset.
+	Interval Duration
+
+	// Log is used to report the snapshots that could not be written in the
+	// background. Failures are silently ignored if unset.
+	Log logging.Logger
+}
+
+// An LRUCacheSnapshotter writes snapshots of an LRUCache periodically and
+// when it is closed, so that the cache can be warmed up after a restart with
+// LRUCache.RestoreSnapshot.
+type LRUCacheSnapshotter[T SizedEntry] struct {
+	cache   *LRUCache[T]
+	options LRUCacheSnapshotterOptions[T]
+
+	done      chan struct{}
+	closeOnce sync.Once
+	closeErr  error
+	wg        sync.WaitGroup
+}
+
+// NewLRUCacheSnapshotter returns an LRUCacheSnapshotter for the cache with the
+// provided options.
+func NewLRUCacheSnapshotter[T SizedEntry](
+	cache *LRUCache[T],
+	options LRUCacheSnapshotterOptions[T],
+) *LRUCacheSnapshotter[T] {
+	s := &LRUCacheSnapshotter[T]{
+		cache:   cache,
+		options: options,
+		done:    make(chan struct{}),
+	}
+	if options.Interval > 0 {
+		s.wg.Add(1)
+		go s.snapshotPeriodically(time.Duration(options.Interval))
+	}
+	return s
+}
+
+// Close stops writing snapshots in the background and writes a final one,
+// returning its error. It is safe to call Close more than once.
+func (s *LRUCacheSnapshotter[T]) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.done)
+		s.wg.Wait()
+		s.closeErr = s.cache.WriteSnapshot(s.options.Path, s.options.Codec)
+	})
+	return s.closeErr
+}
+
+func (s *LRUCacheSnapshotter[T]) snapshotPeriodically(interval time.Duration) {
+	defer s.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+		err := s.cache.WriteSnapshot(s.options.Path, s.options.Codec)
+		if err != nil && s.options.Log != nil {
+			s.options.Log.Error("failed to write cache snapshot", map[string]any{
+				"path": s.options.Path,
+				"err":  err,
+			})
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package base
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLRUCacheSnapshot(t *testing.T) {
+	dirname, err := ioutil.TempDir("", "lru-cache-snapshot")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir failed with %v", err)
+	}
+	defer os.RemoveAll(dirname)
+	path := filepath.Join(dirname, "snapshot")
+
+	c := NewLRUCache[*blob](Byte(40))
+	created := 0
+	for _, key := range []string{"a", "b", "c", "a"} {
+		getBlob(t, c, key, &created)
+	}
+	// "d" is in use, so it is the most-recently used.
+	inUse, err := c.Get("d", func(key string) (*blob, error) {
+		return &blob{contents: key + "-contents"}, nil
+	})
+	if err != nil {
+		t.Fatalf("c.Get failed with %v", err)
+	}
+	if err := c.WriteSnapshot(path, nil); err != nil {
+		t.Fatalf("c.WriteSnapshot failed with %v", err)
+	}
+	c.Put(inUse)
+
+	// Only the three most-recently used entries fit.
+	var createdKeys []string
+	restored := NewLRUCache[*blob](Byte(30))
+	err = restored.RestoreSnapshot(
+		context.Background(),
+		path,
+		func(key string) (*blob, error) {
+			createdKeys = append(createdKeys, key)
+			return &blob{contents: key + "-contents"}, nil
+		},
+		LRUCacheRestoreOptions[*blob]{},
+	)
+	if err != nil {
+		t.Fatalf("restored.RestoreSnapshot failed with %v", err)
+	}
+	if want := []string{"d", "a", "c"}; !reflect.DeepEqual(want, createdKeys) {
+		t.Errorf("createdKeys = %v, want %v", createdKeys, want)
+	}
+	if restored.EvictableSize() != Byte(30) {
+		t.Errorf("restored.EvictableSize() = %d, want 30", restored.EvictableSize().Bytes())
+	}
+
+	// The recency order is preserved, so "c" is evicted first.
+	created = 0
+	getBlob(t, restored, "e", &created)
+	getBlob(t, restored, "d", &created)
+	getBlob(t, restored, "a", &created)
+	if created != 1 {
+		t.Errorf("created = %d, want 1", created)
+	}
+
+	// A missing snapshot leaves the cache empty.
+	empty := NewLRUCache[*blob](Byte(30))
+	err = empty.RestoreSnapshot(
+		context.Background(),
+		filepath.Join(dirname, "missing"),
+		nil,
+		LRUCacheRestoreOptions[*blob]{},
+	)
+	if err != nil {
+		t.Fatalf("empty.RestoreSnapshot failed with %v", err)
+	}
+	if empty.EntryCount() != 0 {
+		t.Errorf("empty.EntryCount() = %d, want 0", empty.EntryCount())
+	}
+}
+
+func TestLRUCacheSnapshotValues(t *testing.T) {
+	dirname, err := ioutil.TempDir("", "lru-cache-snapshot")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir failed with %v", err)
+	}
+	defer os.RemoveAll(dirname)
+	path := filepath.Join(dirname, "snapshot")
+
+	c := NewLRUCache[*blob](Byte(40))
+	for _, key := range []string{"a", "b"} {
+		ref, err := c.Get(key, func(key string) (*blob, error) {
+			return &blob{contents: key + "-value"}, nil
+		})
+		if err != nil {
+			t.Fatalf("c.Get failed with %v", err)
+		}
+		c.Put(ref)
+	}
+	snapshotter := NewLRUCacheSnapshotter[*blob](c, LRUCacheSnapshotterOptions[*blob]{
+		Path:  path,
+		Codec: blobCodec{},
+	})
+	if err := snapshotter.Close(); err != nil {
+		t.Fatalf("snapshotter.Close failed with %v", err)
+	}
+
+	// The values are decoded, so the factory is not invoked.
+	restored := NewLRUCache[*blob](Byte(40))
+	err = restored.RestoreSnapshot(
+		context.Background(),
+		path,
+		func(key string) (*blob, error) {
+			return nil, errors.New("unexpected factory invocation")
+		},
+		LRUCacheRestoreOptions[*blob]{Codec: blobCodec{}},
+	)
+	if err != nil {
+		t.Fatalf("restored.RestoreSnapshot failed with %v", err)
+	}
+	created := 0
+	if contents := getBlob(t, restored, "a", &created); contents != "a-value" {
+		t.Errorf("contents = %q, want %q", contents, "a-value")
+	}
+	if created != 0 {
+		t.Errorf("created = %d, want 0", created)
+	}
+}
+
+func TestLRUCacheSnapshotLazy(t *testing.T) {
+	dirname, err := ioutil.TempDir("", "lru-cache-snapshot")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir failed with %v", err)
+	}
+	defer os.RemoveAll(dirname)
+	path := filepath.Join(dirname, "snapshot")
+
+	c := NewLRUCache[*blob](Byte(40))
+	created := 0
+	for _, key := range []string{"a", "b"} {
+		getBlob(t, c, key, &created)
+	}
+	snapshotter := NewLRUCacheSnapshotter[*blob](c, LRUCacheSnapshotterOptions[*blob]{
+		Path:     path,
+		Interval: Duration(10 * time.Millisecond),
+	})
+	defer snapshotter.Close()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if _, err := os.Stat(path); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("snapshot was not written periodically")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// RestoreSnapshot returns before any factory is done.
+	unblock := make(chan struct{})
+	var lock sync.Mutex
+	var createdKeys []string
+	restored := NewLRUCache[*blob](Byte(40))
+	err = restored.RestoreSnapshot(
+		context.Background(),
+		path,
+		func(key string) (*blob, error) {
+			<-unblock
+			lock.Lock()
+			createdKeys = append(createdKeys, key)
+			lock.Unlock()
+			return &blob{contents: key + "-contents"}, nil
+		},
+		LRUCacheRestoreOptions[*blob]{Lazy: true},
+	)
+	if err != nil {
+		t.Fatalf("restored.RestoreSnapshot failed with %v", err)
+	}
+	close(unblock)
+
+	for {
+		restored.Lock()
+		entryCount := restored.EntryCount()
+		restored.Unlock()
+		if entryCount == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("restored.EntryCount() = %d, want 2", entryCount)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if want := []string{"b", "a"}; !reflect.DeepEqual(want, createdKeys) {
+		t.Errorf("createdKeys = %v, want %v", createdKeys, want)
+	}
+}
@@ -1,8 +1,12 @@
 package base
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"sync"
 	"testing"
+	"time"
 )
 
 type releasable struct {
@@ -230,3 +234,361 @@ func TestLRUCache(t *testing.T) {
 		}
 	}
 }
+
+func TestLRUCacheFactoryWithoutLock(t *testing.T) {
+	c := NewLRUCache[*releasable](Kibibyte)
+
+	// A slow factory does not block other keys.
+	unblock := make(chan struct{})
+	var lock sync.Mutex
+	calls := 0
+	slowFactory := func(key string) (*releasable, error) {
+		lock.Lock()
+		calls++
+		lock.Unlock()
+		<-unblock
+		return &releasable{size: Byte(1), t: t}, nil
+	}
+	refs := make(chan *SizedEntryRef[*releasable], 3)
+	for i := 0; i < 3; i++ {
+		go func() {
+			ref, err := c.Get("slow", slowFactory)
+			if err != nil {
+				t.Errorf("c.Get() failed with %v", err)
+			}
+			refs <- ref
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	ref, err := c.Get("fast", func(key string) (*releasable, error) {
+		return &releasable{size: Byte(1), t: t}, nil
+	})
+	if err != nil {
+		t.Fatalf("c.Get() failed with %v", err)
+	}
+	c.Put(ref)
+
+	// Waiters honor their context.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := c.GetContext(ctx, "slow", slowFactory); err != context.DeadlineExceeded {
+		t.Errorf("c.GetContext() = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	// All the concurrent callers share a single creation.
+	close(unblock)
+	var values []*releasable
+	for i := 0; i < 3; i++ {
+		ref := <-refs
+		values = append(values, ref.Value)
+		c.Put(ref)
+	}
+	if values[0] != values[1] || values[1] != values[2] {
+		t.Errorf("values = %v, want the same value", values)
+	}
+	lock.Lock()
+	if calls != 1 {
+		t.Errorf("calls = %d, want 1", calls)
+	}
+	lock.Unlock()
+
+	// Failed creations are not cached.
+	failure := errors.New("failed")
+	if _, err := c.Get("flaky", func(key string) (*releasable, error) {
+		return nil, failure
+	}); err != failure {
+		t.Errorf("c.Get() = %v, want %v", err, failure)
+	}
+	ref, err = c.Get("flaky", func(key string) (*releasable, error) {
+		return &releasable{size: Byte(1), t: t}, nil
+	})
+	if err != nil {
+		t.Fatalf("c.Get() failed with %v", err)
+	}
+	c.Put(ref)
+}
+
+type expiringReleasable struct {
+	releasable
+	ttl Duration
+}
+
+func (r *expiringReleasable) TTL() Duration {
+	return r.ttl
+}
+
+func TestLRUCacheTTL(t *testing.T) {
+	c := NewLRUCacheWithOptions[SizedEntry](LRUCacheOptions{
+		SizeLimit: Kibibyte,
+		TTL:       Duration(time.Minute),
+	})
+	now := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	c.now = func() time.Time { return now }
+
+	short := &releasable{size: Byte(1), t: t}
+	long := &expiringReleasable{releasable: releasable{size: Byte(1), t: t}, ttl: Duration(time.Hour)}
+	for key, value := range map[string]SizedEntry{"short": short, "long": long} {
+		value := value
+		ref, err := c.Get(key, func(key string) (SizedEntry, error) {
+			return value, nil
+		})
+		if err != nil {
+			t.Fatalf("c.Get(%q) failed with %v", key, err)
+		}
+		c.Put(ref)
+	}
+
+	// Only the entry with the default TTL expires.
+	now = now.Add(2 * time.Minute)
+	for key, expectedFresh := range map[string]bool{"short": true, "long": false} {
+		created := false
+		ref, err := c.Get(key, func(key string) (SizedEntry, error) {
+			created = true
+			return &releasable{size: Byte(1), t: t}, nil
+		})
+		if err != nil {
+			t.Fatalf("c.Get(%q) failed with %v", key, err)
+		}
+		if created != expectedFresh {
+			t.Errorf("c.Get(%q) created = %v, want %v", key, created, expectedFresh)
+		}
+		c.Put(ref)
+	}
+	if !short.released || long.released {
+		t.Errorf("short.released, long.released = %v, %v, want true, false", short.released, long.released)
+	}
+	if c.Size() != Byte(2) {
+		t.Errorf("c.Size() = %d, want 2", c.Size())
+	}
+}
+
+func TestLRUCacheInvalidate(t *testing.T) {
+	c := NewLRUCache[*releasable](Kibibyte)
+	entries := make(map[string]*releasable)
+	get := func(key string) *SizedEntryRef[*releasable] {
+		ref, err := c.Get(key, func(key string) (*releasable, error) {
+			entries[key] = &releasable{size: Byte(1), t: t}
+			return entries[key], nil
+		})
+		if err != nil {
+			t.Fatalf("c.Get(%q) failed with %v", key, err)
+		}
+		return ref
+	}
+	for _, key := range []string{"problem/a", "problem/b", "run/1"} {
+		c.Put(get(key))
+	}
+
+	// An unreferenced entry is released immediately.
+	c.Invalidate("run/1")
+	if !entries["run/1"].released || c.EntryCount() != 2 || c.Size() != Byte(2) {
+		t.Errorf("run/1 was not removed")
+	}
+
+	// A referenced entry is released on its last Put, and is no longer served.
+	ref := get("problem/a")
+	stale := entries["problem/a"]
+	c.InvalidatePrefix("problem/")
+	if !entries["problem/b"].released {
+		t.Errorf("problem/b was not released")
+	}
+	if stale.released {
+		t.Errorf("problem/a was released while in use")
+	}
+	fresh := get("problem/a")
+	if fresh.Value == stale {
+		t.Errorf("the stale entry was served after being invalidated")
+	}
+	c.Put(ref)
+	if !stale.released {
+		t.Errorf("problem/a was not released on its last Put")
+	}
+	if c.Size() != Byte(1) {
+		t.Errorf("c.Size() = %d, want 1", c.Size())
+	}
+	c.Put(fresh)
+
+	c.InvalidateAll()
+	if c.EntryCount() != 0 || c.Size() != Byte(0) {
+		t.Errorf("c.EntryCount(), c.Size() = %d, %d, want 0, 0", c.EntryCount(), c.Size())
+	}
+}
+
+// lockCheckingReleasable records whether the lock of its cache was held while
+// it was released.
+type lockCheckingReleasable struct {
+	releasable
+	cache    *LRUCache[*lockCheckingReleasable]
+	lockHeld bool
+}
+
+func (r *lockCheckingReleasable) Release() {
+	r.releasable.Release()
+	if r.cache.TryLock() {
+		r.cache.Unlock()
+		return
+	}
+	r.lockHeld = true
+}
+
+func TestLRUCacheReleaseUnderLock(t *testing.T) {
+	c := NewLRUCacheWithOptions[*lockCheckingReleasable](LRUCacheOptions{
+		SizeLimit: Byte(1),
+		TTL:       Duration(time.Minute),
+	})
+	now := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	c.now = func() time.Time { return now }
+	entries := make(map[string]*lockCheckingReleasable)
+	get := func(key string) {
+		ref, err := c.Get(key, func(key string) (*lockCheckingReleasable, error) {
+			entries[key] = &lockCheckingReleasable{
+				releasable: releasable{size: Byte(1), t: t},
+				cache:      c,
+			}
+			return entries[key], nil
+		})
+		if err != nil {
+			t.Fatalf("c.Get(%q) failed with %v", key, err)
+		}
+		c.Put(ref)
+	}
+
+	// Without a Dispatcher, entries are released before any other caller can
+	// create a new entry for the same key, whether they are evicted due to
+	// size pressure, because they expired, or because they were invalidated.
+	get("evicted")
+	get("expired")
+	expired := entries["expired"]
+	now = now.Add(2 * time.Minute)
+	get("expired")
+	get("invalidated")
+	c.Invalidate("invalidated")
+
+	for key, entry := range map[string]*lockCheckingReleasable{
+		"evicted":     entries["evicted"],
+		"expired":     expired,
+		"invalidated": entries["invalidated"],
+	} {
+		if !entry.released {
+			t.Errorf("%q was not released", key)
+		} else if !entry.lockHeld {
+			t.Errorf("%q was released without holding the cache lock", key)
+		}
+	}
+}
+
+func TestLRUCacheHardLimit(t *testing.T) {
+	c := NewLRUCacheWithOptions[*releasable](LRUCacheOptions{
+		SizeLimit:     Byte(2),
+		MaxOvercommit: Byte(1),
+		HardLimit:     true,
+	})
+	factory := func(size Byte) SizedEntryFactory[*releasable] {
+		return func(key string) (*releasable, error) {
+			return &releasable{size: size, t: t}, nil
+		}
+	}
+
+	// Entries that can never fit fail right away.
+	if _, err := c.Get("huge", factory(Byte(4))); !HasErrorCategory(err, ErrLRUCacheFull) {
+		t.Errorf("c.Get() = %v, want an error of category %v", err, ErrLRUCacheFull)
+	}
+
+	// The cache can be overcommitted up to MaxOvercommit.
+	a, err := c.Get("a", factory(Byte(2)))
+	if err != nil {
+		t.Fatalf("c.Get() failed with %v", err)
+	}
+	b, err := c.Get("b", factory(Byte(1)))
+	if err != nil {
+		t.Fatalf("c.Get() failed with %v", err)
+	}
+	if c.OvercommittedSize() != Byte(1) {
+		t.Errorf("c.OvercommittedSize() = %d, want 1", c.OvercommittedSize())
+	}
+
+	// Beyond that, Get waits until the context is done.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = c.GetContext(ctx, "c", factory(Byte(1)))
+	if UnwrapCauseFromErrorCategory(err, ErrLRUCacheFull) != context.DeadlineExceeded {
+		t.Errorf("c.GetContext() = %v, want an error of category %v", err, ErrLRUCacheFull)
+	}
+
+	// Or until enough entries are returned.
+	refs := make(chan *SizedEntryRef[*releasable], 1)
+	go func() {
+		ref, err := c.Get("c", factory(Byte(2)))
+		if err != nil {
+			t.Errorf("c.Get() failed with %v", err)
+		}
+		refs <- ref
+	}()
+	time.Sleep(10 * time.Millisecond)
+	select {
+	case <-refs:
+		t.Fatalf("c.Get() should have blocked")
+	default:
+	}
+	aValue := a.Value
+	c.Put(a)
+	ref := <-refs
+	if !aValue.released {
+		t.Errorf("a was not evicted to make room")
+	}
+	if c.Size() != Byte(3) {
+		t.Errorf("c.Size() = %d, want 3", c.Size())
+	}
+	c.Put(b)
+	c.Put(ref)
+	if c.Size() > Byte(3) {
+		t.Errorf("c.Size() = %d, want at most 3", c.Size())
+	}
+}
+
+func TestLRUCacheHardLimitConcurrentCreations(t *testing.T) {
+	c := NewLRUCacheWithOptions[*releasable](LRUCacheOptions{
+		SizeLimit:              Byte(1),
+		HardLimit:              true,
+		MaxConcurrentCreations: 1,
+	})
+	created := make(chan struct{}, 2)
+	unblock := make(chan struct{})
+	factory := func(key string) (*releasable, error) {
+		created <- struct{}{}
+		<-unblock
+		return &releasable{size: Byte(1), t: t}, nil
+	}
+
+	refs := make(chan *SizedEntryRef[*releasable], 1)
+	go func() {
+		ref, err := c.Get("a", factory)
+		if err != nil {
+			t.Errorf("c.Get() failed with %v", err)
+		}
+		refs <- ref
+	}()
+	<-created
+
+	// The factory is not invoked while another creation is in flight.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := c.GetContext(ctx, "b", factory)
+	if UnwrapCauseFromErrorCategory(err, ErrLRUCacheFull) != context.DeadlineExceeded {
+		t.Errorf("c.GetContext() = %v, want an error of category %v", err, ErrLRUCacheFull)
+	}
+	select {
+	case <-created:
+		t.Fatalf("factory should not have been invoked")
+	default:
+	}
+
+	close(unblock)
+	c.Put(<-refs)
+	ref, err := c.Get("b", factory)
+	if err != nil {
+		t.Fatalf("c.Get() failed with %v", err)
+	}
+	c.Put(ref)
+}
@@ -0,0 +1,260 @@
+package base
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"time"
+)
+
+// A JSONLinesWriter writes values of type T as JSON Lines into a
+// RotatingFile. Each record is written with a single call to Write, so
+// records are never interleaved nor split across files. All operations are
+// thread-safe.
+type JSONLinesWriter[T any] struct {
+	file *RotatingFile
+}
+
+// NewJSONLinesWriter creates a new JSONLinesWriter that writes into a
+// RotatingFile created with the provided options.
+func NewJSONLinesWriter[T any](options RotatingFileOptions) (*JSONLinesWriter[T], error) {
+	file, err := NewRotatingFileWithOptions(options)
+	if err != nil {
+		return nil, err
+	}
+	return &JSONLinesWriter[T]{
+		file: file,
+	}, nil
+}
+
+// Write encodes record as a single line of JSON and writes it.
+func (w *JSONLinesWriter[T]) Write(record T) error {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(record); err != nil {
+		return err
+	}
+	_, err := w.file.Write(buf.Bytes())
+	return err
+}
+
+// File returns the underlying RotatingFile.
+func (w *JSONLinesWriter[T]) File() *RotatingFile {
+	return w.file
+}
+
+// Close closes the underlying RotatingFile.
+func (w *JSONLinesWriter[T]) Close() error {
+	return w.file.Close()
+}
+
+// csvColumn is a single column of a CSV file, backed by a field of a struct.
+type csvColumn struct {
+	name  string
+	index int
+}
+
+// A CSVWriter writes values of type T, which must be a struct or a pointer to
+// a struct, as rows of a CSV file into a RotatingFile. The header is written
+// every time a new, empty file is opened. Each record is written with a
+// single call to Write, so records are never interleaved nor split across
+// files. All operations are thread-safe.
+//
+// Every exported field of the struct becomes a column, named after the field
+// or the name in its `csv:"name"` tag. Fields tagged with `csv:"-"` are
+// skipped. Fields can be strings, booleans, numbers, time.Time (formatted as
+// RFC 3339), or types that implement encoding.TextMarshaler or fmt.Stringer,
+// or pointers to any of those.
+type CSVWriter[T any] struct {
+	file    *RotatingFile
+	columns []csvColumn
+}
+
+// NewCSVWriter creates a new CSVWriter that writes into a RotatingFile created
+// with the provided options. If options has an OpenedCallback, it is invoked
+// after the header is written.
+func NewCSVWriter[T any](options RotatingFileOptions) (*CSVWriter[T], error) {
+	columns, err := csvColumns(reflect.TypeOf((*T)(nil)).Elem())
+	if err != nil {
+		return nil, err
+	}
+	w := &CSVWriter[T]{
+		columns: columns,
+	}
+
+	header := make([]string, len(columns))
+	for i, column := range columns {
+		header[i] = column.name
+	}
+	callback := options.OpenedCallback
+	if callback == nil {
+		callback = NopOpenedCallback
+	}
+	options.OpenedCallback = func(f *os.File, isEmpty bool) error {
+		if isEmpty {
+			encoded, err := encodeCSVRow(header)
+			if err != nil {
+				return err
+			}
+			if _, err := f.Write(encoded); err != nil {
+				return err
+			}
+		}
+		return callback(f, isEmpty)
+	}
+
+	w.file, err = NewRotatingFileWithOptions(options)
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// Write encodes record as a single CSV row and writes it.
+func (w *CSVWriter[T]) Write(record T) error {
+	value := reflect.ValueOf(&record).Elem()
+	if value.Kind() == reflect.Ptr {
+		if value.IsNil() {
+			return fmt.Errorf("csv writer: nil record")
+		}
+		value = value.Elem()
+	}
+	row := make([]string, len(w.columns))
+	for i, column := range w.columns {
+		field, err := formatCSVField(value.Field(column.index))
+		if err != nil {
+			return fmt.Errorf("csv writer: field %s: %w", column.name, err)
+		}
+		row[i] = field
+	}
+	encoded, err := encodeCSVRow(row)
+	if err != nil {
+		return err
+	}
+	_, err = w.file.Write(encoded)
+	return err
+}
+
+// File returns the underlying RotatingFile.
+func (w *CSVWriter[T]) File() *RotatingFile {
+	return w.file
+}
+
+// Close closes the underlying RotatingFile.
+func (w *CSVWriter[T]) Close() error {
+	return w.file.Close()
+}
+
+// csvColumns returns the columns for the provided struct type.
+func csvColumns(t reflect.Type) ([]csvColumn, error) {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("csv writer: %v is not a struct", t)
+	}
+	var columns []csvColumn
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		name := field.Name
+		if tag, ok := field.Tag.Lookup("csv"); ok {
+			if tag == "-" {
+				continue
+			}
+			if tag != "" {
+				name = tag
+			}
+		}
+		if !isCSVFieldType(field.Type) {
+			return nil, fmt.Errorf("csv writer: field %s has unsupported type %v", field.Name, field.Type)
+		}
+		columns = append(columns, csvColumn{name: name, index: i})
+	}
+	if len(columns) == 0 {
+		return nil, fmt.Errorf("csv writer: %v has no exported fields", t)
+	}
+	return columns, nil
+}
+
+var (
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	stringerType      = reflect.TypeOf((*fmt.Stringer)(nil)).Elem()
+	timeType          = reflect.TypeOf(time.Time{})
+)
+
+func isCSVFieldType(t reflect.Type) bool {
+	if t == timeType || t.Implements(textMarshalerType) || t.Implements(stringerType) {
+		return true
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return isCSVFieldType(t.Elem())
+	case reflect.String, reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
+
+func formatCSVField(v reflect.Value) (string, error) {
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return "", nil
+		}
+		if v.Elem().Type() == timeType || !v.Type().Implements(textMarshalerType) && !v.Type().Implements(stringerType) {
+			return formatCSVField(v.Elem())
+		}
+	}
+	if v.Type() == timeType {
+		return v.Interface().(time.Time).Format(time.RFC3339Nano), nil
+	}
+	if marshaler, ok := v.Interface().(encoding.TextMarshaler); ok {
+		text, err := marshaler.MarshalText()
+		if err != nil {
+			return "", err
+		}
+		return string(text), nil
+	}
+	if stringer, ok := v.Interface().(fmt.Stringer); ok {
+		return stringer.String(), nil
+	}
+	switch v.Kind() {
+	case reflect.String:
+		return v.String(), nil
+	case reflect.Bool:
+		return strconv.FormatBool(v.Bool()), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(v.Int(), 10), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(v.Uint(), 10), nil
+	case reflect.Float32:
+		return strconv.FormatFloat(v.Float(), 'g', -1, 32), nil
+	case reflect.Float64:
+		return strconv.FormatFloat(v.Float(), 'g', -1, 64), nil
+	}
+	return "", fmt.Errorf("unsupported type %v", v.Type())
+}
+
+func encodeCSVRow(row []string) ([]byte, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	if err := w.Write(row); err != nil {
+		return nil, err
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,169 @@
+package base
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+type testRunEvent struct {
+	RunID    int64     `json:"run_id" csv:"run_id"`
+	Verdict  string    `json:"verdict" csv:"verdict"`
+	Time     time.Time `json:"time" csv:"time"`
+	Runtime  Duration  `json:"runtime" csv:"runtime"`
+	Memory   *Byte     `json:"memory,omitempty" csv:"memory"`
+	Internal string    `json:"-" csv:"-"`
+}
+
+func TestJSONLinesWriter(t *testing.T) {
+	dirname, err := ioutil.TempDir("", "record-writer")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir failed with %v", err)
+	}
+	defer os.RemoveAll(dirname)
+
+	location := time.UTC
+	w, err := NewJSONLinesWriter[testRunEvent](RotatingFileOptions{
+		Path:     path.Join(dirname, "events-%Y%m%d.jsonl"),
+		Mode:     0644,
+		Location: location,
+	})
+	if err != nil {
+		t.Fatalf("NewJSONLinesWriter failed with %v", err)
+	}
+	defer w.Close()
+
+	memory := Mebibyte
+	if err := w.File().rotateAt(time.Date(2022, 1, 1, 0, 0, 0, 0, location)); err != nil {
+		t.Fatalf("rotateAt failed with %v", err)
+	}
+	if err := w.Write(testRunEvent{
+		RunID:   1,
+		Verdict: "AC",
+		Time:    time.Date(2022, 1, 1, 0, 0, 0, 0, location),
+		Runtime: Duration(time.Second),
+		Memory:  &memory,
+	}); err != nil {
+		t.Fatalf("Write failed with %v", err)
+	}
+	if err := w.File().rotateAt(time.Date(2022, 1, 2, 0, 0, 0, 0, location)); err != nil {
+		t.Fatalf("rotateAt failed with %v", err)
+	}
+	if err := w.Write(testRunEvent{
+		RunID:    2,
+		Verdict:  "WA",
+		Time:     time.Date(2022, 1, 2, 0, 0, 0, 0, location),
+		Internal: "<secret>",
+	}); err != nil {
+		t.Fatalf("Write failed with %v", err)
+	}
+	w.Close()
+
+	for filename, expectedContents := range map[string]string{
+		"events-20220101.jsonl": `{"run_id":1,"verdict":"AC","time":"2022-01-01T00:00:00Z","runtime":"1s","memory":1048576}` + "\n",
+		"events-20220102.jsonl": `{"run_id":2,"verdict":"WA","time":"2022-01-02T00:00:00Z","runtime":"0s"}` + "\n",
+	} {
+		contents, err := ioutil.ReadFile(path.Join(dirname, filename))
+		if err != nil {
+			t.Fatalf("ReadFile(%s) failed with %v", filename, err)
+		}
+		if string(contents) != expectedContents {
+			t.Errorf("Contents of %s were %q, expected %q", filename, string(contents), expectedContents)
+		}
+	}
+}
+
+func TestCSVWriter(t *testing.T) {
+	dirname, err := ioutil.TempDir("", "record-writer")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir failed with %v", err)
+	}
+	defer os.RemoveAll(dirname)
+
+	location := time.UTC
+	w, err := NewCSVWriter[*testRunEvent](RotatingFileOptions{
+		Path:     path.Join(dirname, "report-%Y%m%d.csv"),
+		Mode:     0644,
+		Location: location,
+	})
+	if err != nil {
+		t.Fatalf("NewCSVWriter failed with %v", err)
+	}
+	defer w.Close()
+
+	memory := Kibibyte
+	for _, entry := range []struct {
+		rotation time.Time
+		event    testRunEvent
+	}{
+		{
+			time.Date(2022, 1, 1, 0, 0, 0, 0, location),
+			testRunEvent{
+				RunID:   1,
+				Verdict: "AC",
+				Time:    time.Date(2022, 1, 1, 0, 0, 0, 0, location),
+				Runtime: Duration(time.Second),
+				Memory:  &memory,
+			},
+		},
+		{
+			// Reopening a non-empty file does not write the header again.
+			time.Date(2022, 1, 1, 12, 0, 0, 0, location),
+			testRunEvent{
+				RunID:   2,
+				Verdict: "compile error, \"quoted\"",
+				Time:    time.Date(2022, 1, 1, 12, 0, 0, 0, location),
+			},
+		},
+		{
+			time.Date(2022, 1, 2, 0, 0, 0, 0, location),
+			testRunEvent{
+				RunID:   3,
+				Verdict: "WA",
+				Time:    time.Date(2022, 1, 2, 0, 0, 0, 0, location),
+			},
+		},
+	} {
+		if err := w.File().rotateAt(entry.rotation); err != nil {
+			t.Fatalf("rotateAt failed with %v", err)
+		}
+		event := entry.event
+		if err := w.Write(&event); err != nil {
+			t.Fatalf("Write failed with %v", err)
+		}
+	}
+	if err := w.Write(nil); err == nil {
+		t.Errorf("Write(nil) should have failed")
+	}
+	w.Close()
+
+	for filename, expectedContents := range map[string]string{
+		"report-20220101.csv": "run_id,verdict,time,runtime,memory\n" +
+			"1,AC,2022-01-01T00:00:00Z,1s,1024\n" +
+			"2,\"compile error, \"\"quoted\"\"\",2022-01-01T12:00:00Z,0s,\n",
+		"report-20220102.csv": "run_id,verdict,time,runtime,memory\n" +
+			"3,WA,2022-01-02T00:00:00Z,0s,\n",
+	} {
+		contents, err := ioutil.ReadFile(path.Join(dirname, filename))
+		if err != nil {
+			t.Fatalf("ReadFile(%s) failed with %v", filename, err)
+		}
+		if string(contents) != expectedContents {
+			t.Errorf("Contents of %s were %q, expected %q", filename, string(contents), expectedContents)
+		}
+	}
+}
+
+func TestCSVWriterUnsupportedType(t *testing.T) {
+	type invalid struct {
+		Values []int
+	}
+	if _, err := NewCSVWriter[invalid](RotatingFileOptions{Path: os.DevNull}); err == nil {
+		t.Errorf("NewCSVWriter should have failed with an unsupported field type")
+	}
+	if _, err := NewCSVWriter[int](RotatingFileOptions{Path: os.DevNull}); err == nil {
+		t.Errorf("NewCSVWriter should have failed with a non-struct type")
+	}
+}
@@ -1,31 +1,195 @@
 package base
 
 import (
+	"fmt"
 	"io"
 	"os"
-	"os/signal"
+	"path/filepath"
+	"strings"
 	"sync"
-	"syscall"
+	"time"
+
+	"github.com/omegaup/go-base/v3/logging"
 )
 
 // OpenedCallback allows the caller to specify an action to be performed when
-// the file is opened and before it is available for writing.
+// the file is opened and before it is available for writing. During a
+// rotation, writes are blocked while the callback runs, so it must not call
+// any methods of the RotatingFile. If opening the file fails after an
+// OpenedCallback wrote into a file that was empty, the file is truncated so
+// that the next attempt observes it as empty again.
 type OpenedCallback func(f *os.File, isEmpty bool) error
 
 // NopOpenedCallback is an OpenedCallback that does nothing.
 func NopOpenedCallback(*os.File, bool) error { return nil }
 
+// SyncPolicy determines when a RotatingFile flushes the contents of the file
+// to stable storage with fsync.
+type SyncPolicy int
+
+const (
+	// SyncNever never calls fsync and lets the operating system decide when to
+	// persist the contents of the file.
+	SyncNever SyncPolicy = iota
+
+	// SyncOnRotate calls fsync on a file before it is closed due to a rotation
+	// or a call to Close.
+	SyncOnRotate
+
+	// SyncEveryFlush calls fsync every time the buffer is flushed, in addition
+	// to every rotation. In unbuffered mode, every write is a flush.
+	SyncEveryFlush
+)
+
+// RotatingFileOptions are options that can be passed to
+// NewRotatingFileWithOptions to customize how the file is opened and rotated.
+type RotatingFileOptions struct {
+	// Path is the path of the file. It can contain strftime-style directives
+	// (%Y, %y, %m, %d, %j, %H, %M, %S and %%), which are expanded using the
+	// time at which the file is opened. If Path contains any directives, the
+	// file will also be rotated on a time-based schedule.
+	Path string
+
+	// Mode is the permission bits used when creating the file.
+	Mode os.FileMode
+
+	// OpenedCallback is invoked every time a new file is opened, before it is
+	// available for writing. The default is NopOpenedCallback if unset.
+	OpenedCallback OpenedCallback
+
+	// RotationInterval is the interval at which the file will be rotated. The
+	// rotations are aligned to wall-clock boundaries, starting at midnight in
+	// Location. Intervals longer than a day must be a whole number of days.
+	// The default is the smallest unit present in Path (a second for %S, a
+	// minute for %M, an hour for %H, a day otherwise) if Path contains any
+	// directives, and no time-based rotation otherwise.
+	RotationInterval Duration
+
+	// Location is the time zone used to expand the directives in Path and to
+	// align the rotations. The default is time.Local if unset.
+	Location *time.Location
+
+	// SymlinkPath is the path of a symbolic link that will always point to the
+	// file that is currently being written. No link is maintained if unset.
+	SymlinkPath string
+
+	// Compressor, if set, is used to compress the files that were rotated away
+	// in a background worker. Rotated files can only be found if Path contains
+	// any strftime-style directives.
+	Compressor Compressor
+
+	// MaxAge is the maximum age of a rotated file, measured from its last
+	// modification. Older files are removed by the background worker. There is
+	// no age limit if unset.
+	MaxAge Duration
+
+	// MaxBackups is the maximum number of rotated files that are kept. The
+	// oldest files are removed by the background worker. There is no limit on
+	// the number of files if unset.
+	MaxBackups int
+
+	// MaxTotalSize is the maximum combined size of all the rotated files (after
+	// compression). The oldest files are removed by the background worker.
+	// There is no size limit if unset.
+	MaxTotalSize Byte
+
+	// Log is used to report failures that happen outside of calls to Write,
+	// such as scheduled or signal-driven rotations, compression and removal of
+	// rotated files. Failures are silently ignored if unset, except for the
+	// signal-driven rotations, which are reported by the RotationManager.
+	Log logging.Logger
+
+	// BufferSize, if set, enables the buffered mode, where writes are
+	// accumulated in memory and written to the file once the buffer is full,
+	// every FlushInterval, or when Flush, Rotate or Close are called. A single
+	// write is never split across two files. Data that fails to be written is
+	// kept in the buffer and retried on the next flush, even if the file is
+	// rotated in the meantime.
+	BufferSize Byte
+
+	// FlushInterval is the maximum time that data will stay in the buffer
+	// before being written to the file in buffered mode. The default is one
+	// second if unset.
+	FlushInterval Duration
+
+	// SyncPolicy determines when the file is flushed to stable storage. The
+	// default is SyncNever.
+	SyncPolicy SyncPolicy
+
+	// ReopenCheckInterval, if set, enables a watcher that periodically checks
+	// whether the file that is currently open is still the one at its path.
+	// If the file was deleted or moved without triggering a rotation, it is
+	// transparently reopened.
+	ReopenCheckInterval Duration
+
+	// Metrics, if set, is used to count the number of times the file was
+	// reopened by the watcher, under the rotating_file_reopens_total name.
+	Metrics Metrics
+
+	// RotationManager is the RotationManager that the file registers with so
+	// that it is rotated whenever a signal is received. The default is
+	// DefaultRotationManager if unset, which rotates on SIGHUP.
+	RotationManager *RotationManager
+
+	// DiskSpaceMonitor, if set, is used to protect the disk from filling up.
+	// Whenever the free space is below MinFreeSpace, writes are handled
+	// according to LowDiskSpacePolicy instead of being written to the file,
+	// and normal operation is resumed automatically once space is available.
+	DiskSpaceMonitor *DiskSpaceMonitor
+
+	// MinFreeSpace is the free disk space below which the LowDiskSpacePolicy
+	// is applied.
+	MinFreeSpace Byte
+
+	// LowDiskSpacePolicy is how writes are handled while the free disk space
+	// is below MinFreeSpace. The default is LowDiskSpaceDrop.
+	LowDiskSpacePolicy LowDiskSpacePolicy
+
+	// LowDiskSpaceBufferSize is the maximum number of bytes that are kept in
+	// memory with the LowDiskSpaceBuffer policy. The default is 1 MiB if
+	// unset.
+	LowDiskSpaceBufferSize Byte
+
+	// committedCallback is invoked while holding the lock every time a newly
+	// opened file is in place, once the rotation can no longer be aborted.
+	committedCallback func()
+}
+
 // A RotatingFile is an io.WriteCloser that supports reopening through SIGHUP.
 // It opens the underlying file in append-only mode. All
 // operations are thread-safe.
+//
+// Errors that happen during a rotation that was triggered by a signal are
+// reported by the RotationManager.
 type RotatingFile struct {
-	file          *os.File
-	signalChannel chan<- os.Signal
-	reopen        func() (*os.File, error)
-	lock          sync.Mutex
+	file      *os.File
+	path      string
+	options   RotatingFileOptions
+	done      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+	now       func() time.Time
+	syncFile  func(f *os.File) error
+	lock      sync.Mutex
+	closed    bool
+
+	// buffer holds the data that has not been written to the file yet in
+	// buffered mode. It is nil otherwise. Data that could not be written
+	// stays in it, so that it is retried on the next flush.
+	buffer []byte
+
+	// pending holds the writes that were deferred due to low disk space, and
+	// lowDiskSpace is whether the file is currently degraded.
+	pending      []byte
+	lowDiskSpace bool
+
+	// cleanupChannel is used to wake the background worker that compresses and
+	// removes rotated files. It is nil if there is no such worker.
+	cleanupChannel chan struct{}
 }
 
 var _ io.WriteCloser = &RotatingFile{}
+var _ Rotator = &RotatingFile{}
 
 func openFile(path string, mode os.FileMode, callback OpenedCallback) (*os.File, error) {
 	file, err := os.OpenFile(
@@ -36,77 +200,560 @@ func openFile(path string, mode os.FileMode, callback OpenedCallback) (*os.File,
 	if err != nil {
 		return nil, err
 	}
-	pos, err := file.Seek(0, io.SeekCurrent)
+	pos, err := file.Seek(0, io.SeekEnd)
 	if err != nil {
+		file.Close()
 		return nil, err
 	}
 	if err := callback(file, pos == 0); err != nil {
+		if pos == 0 {
+			file.Truncate(0)
+		}
 		file.Close()
 		return nil, err
 	}
 	return file, nil
 }
 
-// NewRotatingFile opens path for writing in append-only mode and listens for
-// SIGHUP so that it can reopen the file automatically.
+// NewRotatingFile opens path for writing in append-only mode and registers it
+// with DefaultRotationManager so that it is reopened automatically on SIGHUP.
 func NewRotatingFile(path string, mode os.FileMode, callback OpenedCallback) (*RotatingFile, error) {
-	file, err := openFile(path, mode, callback)
+	return NewRotatingFileWithOptions(RotatingFileOptions{
+		Path:           path,
+		Mode:           mode,
+		OpenedCallback: callback,
+	})
+}
+
+// NewRotatingFileWithOptions opens the file described by options for writing
+// in append-only mode and registers it with the RotationManager so that it can
+// be reopened automatically. If the options specify a time-based schedule, the file will
+// also be rotated automatically at every wall-clock boundary.
+func NewRotatingFileWithOptions(options RotatingFileOptions) (*RotatingFile, error) {
+	if options.OpenedCallback == nil {
+		options.OpenedCallback = NopOpenedCallback
+	}
+	if options.Location == nil {
+		options.Location = time.Local
+	}
+	if options.RotationManager == nil {
+		options.RotationManager = DefaultRotationManager
+	}
+	smallestUnit, err := rotatingFilePathUnit(options.Path)
 	if err != nil {
 		return nil, err
 	}
-
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, syscall.SIGHUP)
+	if options.RotationInterval == 0 {
+		options.RotationInterval = Duration(smallestUnit)
+	}
+	if options.RotationInterval < 0 {
+		return nil, fmt.Errorf("rotating file: invalid rotation interval %v", options.RotationInterval)
+	}
+	if interval := time.Duration(options.RotationInterval); interval > 24*time.Hour && interval%(24*time.Hour) != 0 {
+		// The boundaries are aligned to midnight every day, so they cannot
+		// be any further apart than that unless they skip whole days.
+		return nil, fmt.Errorf("rotating file: rotation interval %v is not a whole number of days", options.RotationInterval)
+	}
+	if options.BufferSize < 0 {
+		return nil, fmt.Errorf("rotating file: invalid buffer size %d", options.BufferSize.Bytes())
+	}
+	if options.BufferSize > 0 && options.FlushInterval <= 0 {
+		options.FlushInterval = Duration(time.Second)
+	}
+	if options.LowDiskSpaceBufferSize <= 0 {
+		options.LowDiskSpaceBufferSize = Mebibyte
+	}
 
 	r := &RotatingFile{
-		file:          file,
-		signalChannel: c,
-		reopen:        func() (*os.File, error) { return openFile(path, mode, callback) },
+		options:  options,
+		done:     make(chan struct{}),
+		now:      time.Now,
+		syncFile: (*os.File).Sync,
+	}
+	r.file, r.path, err = r.open(r.now())
+	if err != nil {
+		return nil, err
+	}
+	if r.options.committedCallback != nil {
+		r.options.committedCallback()
+	}
+	if r.options.BufferSize > 0 {
+		r.buffer = make([]byte, 0, int(r.options.BufferSize.Bytes()))
 	}
 
-	go func() {
-		for range c {
-			r.Rotate()
-		}
-	}()
+	r.options.RotationManager.Register(r)
+	if r.options.RotationInterval != 0 {
+		r.wg.Add(1)
+		go r.rotateOnSchedule()
+	}
+	if r.buffer != nil {
+		r.wg.Add(1)
+		go r.flushPeriodically()
+	}
+	if r.options.ReopenCheckInterval > 0 {
+		r.wg.Add(1)
+		go r.watch()
+	}
+	if r.options.DiskSpaceMonitor != nil && r.options.LowDiskSpacePolicy == LowDiskSpaceBuffer {
+		r.wg.Add(1)
+		go r.recoverFromLowDiskSpace()
+	}
+	if r.hasCleanup() {
+		r.cleanupChannel = make(chan struct{}, 1)
+		r.wg.Add(1)
+		go r.cleanupOnRotation()
+		r.requestCleanup()
+	}
 
 	return r, nil
 }
 
-// Write writes the bytes into the underlying file.
+// Write writes the bytes into the underlying file. In buffered mode, the
+// bytes might be kept in memory until the next flush. If the free disk space
+// is below the threshold, the bytes are handled according to the
+// LowDiskSpacePolicy.
 func (r *RotatingFile) Write(b []byte) (int, error) {
+	if err := r.lockForWrite(); err != nil {
+		return 0, err
+	}
 	defer r.lock.Unlock()
-	r.lock.Lock()
-	return r.file.Write(b)
+	n, err := r.writeLocked(b)
+	if err == errLowDiskSpaceDropped {
+		// Dropped writes are reported as successful.
+		return n, nil
+	}
+	return n, err
 }
 
 // WriteString is like Write, but writes the contents of string s rather than a
 // slice of bytes.
 func (r *RotatingFile) WriteString(s string) (int, error) {
+	return r.Write([]byte(s))
+}
+
+// writeLocked writes the bytes into the file, unless there is not enough
+// free disk space. It returns errLowDiskSpaceDropped if the bytes were
+// discarded.
+func (r *RotatingFile) writeLocked(b []byte) (int, error) {
+	// With LowDiskSpaceBlock, lockForWrite already waited for free space
+	// without releasing the lock afterwards, so the write is never degraded.
+	if r.options.LowDiskSpacePolicy != LowDiskSpaceBlock && r.lowDiskSpaceLocked() {
+		return r.writeDegradedLocked(b)
+	}
+	if err := r.writePendingLocked(); err != nil {
+		return 0, err
+	}
+	return r.writeFileLocked(b)
+}
+
+// writeFileLocked writes the bytes into the buffer or the file, honoring the
+// SyncPolicy.
+func (r *RotatingFile) writeFileLocked(b []byte) (int, error) {
+	if r.buffer == nil {
+		return r.writeThroughLocked(b)
+	}
+	if len(r.buffer)+len(b) <= cap(r.buffer) {
+		r.buffer = append(r.buffer, b...)
+		return len(b), nil
+	}
+	if err := r.flushBufferLocked(); err != nil {
+		return 0, err
+	}
+	if len(b) < cap(r.buffer) {
+		r.buffer = append(r.buffer, b...)
+		return len(b), nil
+	}
+	// The write would not fit in the buffer anyway.
+	return r.writeThroughLocked(b)
+}
+
+// flushBufferLocked writes the buffered data into the file, honoring the
+// SyncPolicy. Any data that could not be written is kept in the buffer, so
+// that a transient failure does not prevent the next flush from succeeding.
+func (r *RotatingFile) flushBufferLocked() error {
+	if len(r.buffer) == 0 {
+		return nil
+	}
+	n, err := r.writeThroughLocked(r.buffer)
+	r.buffer = r.buffer[:copy(r.buffer, r.buffer[n:])]
+	return err
+}
+
+// writeThroughLocked writes the bytes directly into the file, and flushes it
+// to stable storage if the SyncPolicy is SyncEveryFlush.
+func (r *RotatingFile) writeThroughLocked(b []byte) (int, error) {
+	n, err := r.file.Write(b)
+	if err == nil && r.options.SyncPolicy == SyncEveryFlush {
+		err = r.syncFile(r.file)
+	}
+	return n, err
+}
+
+// Flush writes any buffered data into the underlying file. If the SyncPolicy
+// is SyncEveryFlush, the file is also flushed to stable storage.
+func (r *RotatingFile) Flush() error {
+	defer r.lock.Unlock()
+	r.lock.Lock()
+	if r.closed {
+		return os.ErrClosed
+	}
+	return r.flushLocked()
+}
+
+func (r *RotatingFile) flushLocked() error {
+	if r.buffer != nil {
+		// The buffered data goes through writeThroughLocked, which honors
+		// the SyncPolicy.
+		return r.flushBufferLocked()
+	}
+	if r.options.SyncPolicy == SyncEveryFlush {
+		return r.syncFile(r.file)
+	}
+	return nil
+}
+
+// closeFileLocked flushes any buffered data and closes the current file,
+// honoring the SyncPolicy.
+func (r *RotatingFile) closeFileLocked() error {
+	err := r.flushBufferLocked()
+	if r.options.SyncPolicy != SyncNever {
+		if syncErr := r.syncFile(r.file); err == nil {
+			err = syncErr
+		}
+	}
+	if closeErr := r.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// flushPeriodically flushes the buffer every FlushInterval, until the file is
+// closed.
+func (r *RotatingFile) flushPeriodically() {
+	defer r.wg.Done()
+	ticker := time.NewTicker(time.Duration(r.options.FlushInterval))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-ticker.C:
+		}
+		if err := r.Flush(); err != nil {
+			r.logError("failed to flush file", map[string]any{
+				"path": r.Name(),
+				"err":  err,
+			})
+		}
+	}
+}
+
+// Name returns the path of the file that is currently being written.
+func (r *RotatingFile) Name() string {
 	defer r.lock.Unlock()
 	r.lock.Lock()
-	return r.file.WriteString(s)
+	return r.path
+}
+
+// rotationLog returns the Logger used to report the rotations triggered by the
+// RotationManager that failed.
+func (r *RotatingFile) rotationLog() logging.Logger {
+	return r.options.Log
 }
 
-// Close closes the underlying file and stops listening for SIGHUP.
+// Close flushes any buffered data, closes the underlying file, unregisters it
+// from the RotationManager and waits for the background workers to finish.
 func (r *RotatingFile) Close() error {
+	r.closeOnce.Do(func() {
+		r.options.RotationManager.Unregister(r)
+		close(r.done)
+	})
+	r.wg.Wait()
+
 	defer r.lock.Unlock()
 	r.lock.Lock()
-	signal.Stop(r.signalChannel)
-	return r.file.Close()
+	if r.closed {
+		return os.ErrClosed
+	}
+	r.closed = true
+	pendingErr := r.writePendingLocked()
+	if err := r.closeFileLocked(); err != nil {
+		return err
+	}
+	return pendingErr
 }
 
-// Rotate reopens the file and closes the previous one.
+// Rotate reopens the file and closes the previous one. If the file has a
+// time-based schedule, the new file will be the one that corresponds to the
+// current time. Any buffered data is written to the previous file before it
+// is closed.
 func (r *RotatingFile) Rotate() error {
-	newFile, err := r.reopen()
+	return r.rotateAt(r.now())
+}
+
+func (r *RotatingFile) rotateAt(t time.Time) error {
+	// The lock is held while the new file is opened so that the
+	// OpenedCallback observes all the writes that were made to the previous
+	// file, and no writes can happen until the new file is in place.
+	r.lock.Lock()
+	if r.closed {
+		r.lock.Unlock()
+		return os.ErrClosed
+	}
+	// A failed flush does not prevent the rotation, since the data is kept in
+	// the buffer. closeFileLocked tries to write it into the previous file
+	// once more and reports the error, and whatever is still left is written
+	// into the new file.
+	r.flushBufferLocked()
+	newFile, newPath, err := r.open(t)
 	if err != nil {
+		r.lock.Unlock()
 		return err
 	}
+	err = r.closeFileLocked()
+	r.file = newFile
+	r.path = newPath
+	if r.options.committedCallback != nil {
+		r.options.committedCallback()
+	}
+	r.lock.Unlock()
 
+	r.requestCleanup()
+	return err
+}
+
+// writeComposed atomically composes the contents with compose and writes them
+// into the file, and then invokes committed if the write succeeded. If the
+// contents are discarded due to low disk space, committed is not invoked and
+// no error is returned. Both
+// functions are invoked while holding the lock, so they are serialized with
+// the OpenedCallback of any rotation.
+func (r *RotatingFile) writeComposed(compose func() ([]byte, error), committed func()) error {
+	if err := r.lockForWrite(); err != nil {
+		return err
+	}
 	defer r.lock.Unlock()
+	b, err := compose()
+	if err != nil {
+		return err
+	}
+	if _, err := r.writeLocked(b); err != nil {
+		if err == errLowDiskSpaceDropped {
+			return nil
+		}
+		return err
+	}
+	committed()
+	return nil
+}
+
+// open opens the file that corresponds to the provided time and updates the
+// symbolic link to point to it.
+func (r *RotatingFile) open(t time.Time) (*os.File, string, error) {
+	path := formatRotatingFilePath(r.options.Path, t.In(r.options.Location))
+	file, err := openFile(path, r.options.Mode, func(f *os.File, isEmpty bool) error {
+		if err := r.options.OpenedCallback(f, isEmpty); err != nil {
+			return err
+		}
+		if r.options.SymlinkPath != "" {
+			return updateSymlink(path, r.options.SymlinkPath)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return file, path, nil
+}
+
+// watch periodically checks whether the file was deleted or moved, and
+// reopens it if needed, until the file is closed.
+func (r *RotatingFile) watch() {
+	defer r.wg.Done()
+	ticker := time.NewTicker(time.Duration(r.options.ReopenCheckInterval))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-ticker.C:
+		}
+		if err := r.reopenIfMoved(); err != nil {
+			r.logError("failed to reopen file", map[string]any{
+				"path": r.Name(),
+				"err":  err,
+			})
+		}
+	}
+}
+
+// reopenIfMoved reopens the file if the one that is currently open is no
+// longer the one at its path.
+func (r *RotatingFile) reopenIfMoved() error {
 	r.lock.Lock()
-	oldFile := r.file
-	r.file = newFile
-	oldFile.Close()
+	if r.closed {
+		r.lock.Unlock()
+		return nil
+	}
+	path := r.path
+	openInfo, err := r.file.Stat()
+	r.lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	pathInfo, err := os.Stat(path)
+	if err == nil && os.SameFile(openInfo, pathInfo) {
+		return nil
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if r.options.Log != nil {
+		r.options.Log.Warn("file was deleted or moved, reopening", map[string]any{
+			"path": path,
+		})
+	}
+	if r.options.Metrics != nil {
+		r.options.Metrics.CounterAdd("rotating_file_reopens_total", 1)
+	}
+	return r.Rotate()
+}
+
+// rotateOnSchedule rotates the file every time a wall-clock boundary is
+// crossed, until the file is closed.
+func (r *RotatingFile) rotateOnSchedule() {
+	defer r.wg.Done()
+	for {
+		next := r.nextRotation(r.now())
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-r.done:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		// Timers can fire slightly before the wall clock reaches the boundary,
+		// so the boundary itself is used to choose the name of the new file.
+		t := r.now()
+		if t.Before(next) {
+			t = next
+		}
+		if err := r.rotateAt(t); err != nil {
+			r.logError("failed to rotate file", map[string]any{
+				"path": r.options.Path,
+				"err":  err,
+			})
+		}
+	}
+}
+
+// nextRotation returns the first rotation boundary that is strictly after t.
+// Boundaries are aligned to midnight in the file's location. Intervals that
+// are a whole number of days are computed using calendar days so that they
+// are not affected by daylight saving time transitions.
+func (r *RotatingFile) nextRotation(t time.Time) time.Time {
+	interval := time.Duration(r.options.RotationInterval)
+	t = t.In(r.options.Location)
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, r.options.Location)
+	if interval%(24*time.Hour) == 0 {
+		return midnight.AddDate(0, 0, int(interval/(24*time.Hour)))
+	}
+	next := midnight.Add(interval * (t.Sub(midnight)/interval + 1))
+	if tomorrow := midnight.AddDate(0, 0, 1); interval < 24*time.Hour && next.After(tomorrow) {
+		return tomorrow
+	}
+	return next
+}
+
+// updateSymlink atomically replaces the symbolic link at linkPath so that it
+// points to target.
+func updateSymlink(target, linkPath string) error {
+	if absTarget, err := filepath.Abs(target); err == nil {
+		target = absTarget
+	}
+	tempPath := fmt.Sprintf("%s.%d.tmp", linkPath, os.Getpid())
+	os.Remove(tempPath)
+	if err := os.Symlink(target, tempPath); err != nil {
+		return err
+	}
+	if err := os.Rename(tempPath, linkPath); err != nil {
+		os.Remove(tempPath)
+		return err
+	}
 	return nil
 }
+
+// rotatingFilePathUnit validates the strftime-style directives in path and
+// returns the smallest unit of time that they represent, or zero if there are
+// no time directives.
+func rotatingFilePathUnit(path string) (time.Duration, error) {
+	var unit time.Duration
+	for i := 0; i < len(path); i++ {
+		if path[i] != '%' {
+			continue
+		}
+		if i+1 == len(path) {
+			return 0, fmt.Errorf("rotating file: trailing %% in path %q", path)
+		}
+		i++
+		var directiveUnit time.Duration
+		switch path[i] {
+		case '%':
+			continue
+		case 'Y', 'y', 'm', 'd', 'j':
+			directiveUnit = 24 * time.Hour
+		case 'H':
+			directiveUnit = time.Hour
+		case 'M':
+			directiveUnit = time.Minute
+		case 'S':
+			directiveUnit = time.Second
+		default:
+			return 0, fmt.Errorf("rotating file: unsupported directive %%%c in path %q", path[i], path)
+		}
+		if unit == 0 || directiveUnit < unit {
+			unit = directiveUnit
+		}
+	}
+	return unit, nil
+}
+
+// formatRotatingFilePath expands the strftime-style directives in path using
+// the provided time. The path is assumed to have been validated with
+// rotatingFilePathUnit.
+func formatRotatingFilePath(path string, t time.Time) string {
+	if !strings.Contains(path, "%") {
+		return path
+	}
+	var sb strings.Builder
+	for i := 0; i < len(path); i++ {
+		if path[i] != '%' || i+1 == len(path) {
+			sb.WriteByte(path[i])
+			continue
+		}
+		i++
+		switch path[i] {
+		case '%':
+			sb.WriteByte('%')
+		case 'Y':
+			fmt.Fprintf(&sb, "%04d", t.Year())
+		case 'y':
+			fmt.Fprintf(&sb, "%02d", t.Year()%100)
+		case 'm':
+			fmt.Fprintf(&sb, "%02d", int(t.Month()))
+		case 'd':
+			fmt.Fprintf(&sb, "%02d", t.Day())
+		case 'j':
+			fmt.Fprintf(&sb, "%03d", t.YearDay())
+		case 'H':
+			fmt.Fprintf(&sb, "%02d", t.Hour())
+		case 'M':
+			fmt.Fprintf(&sb, "%02d", t.Minute())
+		case 'S':
+			fmt.Fprintf(&sb, "%02d", t.Second())
+		}
+	}
+	return sb.String()
+}
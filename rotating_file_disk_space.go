@@ -0,0 +1,137 @@
+package base
+
+import (
+	"errors"
+	"os"
+)
+
+// LowDiskSpacePolicy determines how a RotatingFile handles writes while the
+// free disk space is below the threshold.
+type LowDiskSpacePolicy int
+
+const (
+	// LowDiskSpaceDrop discards the writes, but reports them as successful.
+	LowDiskSpaceDrop LowDiskSpacePolicy = iota
+
+	// LowDiskSpaceBuffer keeps the writes in memory, up to a limit, and writes
+	// them to the file once there is enough free space. Writes that exceed the
+	// limit are discarded.
+	LowDiskSpaceBuffer
+
+	// LowDiskSpaceBlock blocks the writes until there is enough free space or
+	// the file is closed.
+	LowDiskSpaceBlock
+)
+
+// errLowDiskSpaceDropped is returned by writeLocked when the bytes were
+// discarded due to low disk space.
+var errLowDiskSpaceDropped = errors.New("rotating file: write dropped due to low disk space")
+
+// lowDiskSpaceLocked returns whether the free disk space is below the
+// threshold, and logs the transitions between states.
+func (r *RotatingFile) lowDiskSpaceLocked() bool {
+	if r.options.DiskSpaceMonitor == nil {
+		return false
+	}
+	free := r.options.DiskSpaceMonitor.Free()
+	low := free < r.options.MinFreeSpace
+	if low != r.lowDiskSpace && r.options.Log != nil {
+		if low {
+			r.options.Log.Warn("low disk space, degrading writes", map[string]any{
+				"path":   r.path,
+				"free":   free.Bytes(),
+				"policy": r.options.LowDiskSpacePolicy,
+			})
+		} else {
+			r.options.Log.Info("disk space recovered, resuming writes", map[string]any{
+				"path": r.path,
+				"free": free.Bytes(),
+			})
+		}
+	}
+	r.lowDiskSpace = low
+	return low
+}
+
+// writeDegradedLocked handles a write while the free disk space is below the
+// threshold. It returns errLowDiskSpaceDropped if the bytes were discarded.
+func (r *RotatingFile) writeDegradedLocked(b []byte) (int, error) {
+	if r.options.LowDiskSpacePolicy == LowDiskSpaceBuffer &&
+		Byte(len(r.pending)+len(b)) <= r.options.LowDiskSpaceBufferSize {
+		r.pending = append(r.pending, b...)
+		return len(b), nil
+	}
+	if r.options.Metrics != nil {
+		r.options.Metrics.CounterAdd("rotating_file_dropped_bytes_total", float64(len(b)))
+	}
+	return len(b), errLowDiskSpaceDropped
+}
+
+// writePendingLocked writes all the data that was kept in memory while the
+// free disk space was low.
+func (r *RotatingFile) writePendingLocked() error {
+	if len(r.pending) == 0 {
+		return nil
+	}
+	n, err := r.writeFileLocked(r.pending)
+	r.pending = r.pending[n:]
+	if len(r.pending) == 0 {
+		r.pending = nil
+	}
+	return err
+}
+
+// lockForWrite acquires the lock for a write. If the policy is
+// LowDiskSpaceBlock, it also blocks while the free disk space is below the
+// threshold, and the lock is kept from the last check until the write, so
+// that the write cannot be degraded afterwards. It returns os.ErrClosed
+// without holding the lock if the file is closed.
+func (r *RotatingFile) lockForWrite() error {
+	monitor := r.options.DiskSpaceMonitor
+	block := monitor != nil && r.options.LowDiskSpacePolicy == LowDiskSpaceBlock
+	for {
+		// The channel needs to be obtained before checking the free space so
+		// that no updates are missed.
+		var updated <-chan struct{}
+		if block {
+			updated = monitor.Updated()
+		}
+		r.lock.Lock()
+		if r.closed {
+			r.lock.Unlock()
+			return os.ErrClosed
+		}
+		if !block || !r.lowDiskSpaceLocked() {
+			return nil
+		}
+		r.lock.Unlock()
+		select {
+		case <-r.done:
+			return os.ErrClosed
+		case <-updated:
+		}
+	}
+}
+
+// recoverFromLowDiskSpace writes the data that was kept in memory as soon as
+// there is enough free disk space, until the file is closed.
+func (r *RotatingFile) recoverFromLowDiskSpace() {
+	defer r.wg.Done()
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-r.options.DiskSpaceMonitor.Updated():
+		}
+		r.lock.Lock()
+		if !r.closed && len(r.pending) > 0 && !r.lowDiskSpaceLocked() {
+			if err := r.writePendingLocked(); err != nil {
+				r.logError("failed to write pending data", map[string]any{
+					"path": r.path,
+					"err":  err,
+				})
+			}
+		}
+		r.lock.Unlock()
+	}
+}
@@ -0,0 +1,217 @@
+package base
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/omegaup/go-base/v3/logging"
+)
+
+func newFakeDiskSpaceMonitor(t *testing.T, free Byte) (*DiskSpaceMonitor, func(Byte)) {
+	t.Helper()
+	var lock sync.Mutex
+	m := &DiskSpaceMonitor{
+		options: DiskSpaceMonitorOptions{Interval: Duration(time.Hour)},
+		statfs: func(string) (Byte, error) {
+			lock.Lock()
+			defer lock.Unlock()
+			return free, nil
+		},
+		updated: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	if err := m.Check(); err != nil {
+		t.Fatalf("Check failed with %v", err)
+	}
+	return m, func(newFree Byte) {
+		lock.Lock()
+		free = newFree
+		lock.Unlock()
+		if err := m.Check(); err != nil {
+			t.Fatalf("Check failed with %v", err)
+		}
+	}
+}
+
+func TestRotatingFileLowDiskSpace(t *testing.T) {
+	dirname, err := ioutil.TempDir("", "rotating-file")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir failed with %v", err)
+	}
+	defer os.RemoveAll(dirname)
+
+	for _, entry := range []struct {
+		name     string
+		policy   LowDiskSpacePolicy
+		expected string
+		dropped  float64
+	}{
+		{"drop", LowDiskSpaceDrop, "before\nafter\n", 13},
+		{"buffer", LowDiskSpaceBuffer, "before\nduring\nafter\n", 6},
+	} {
+		t.Run(entry.name, func(t *testing.T) {
+			monitor, setFree := newFakeDiskSpaceMonitor(t, Gibibyte)
+			metrics := &recordingMetrics{}
+			logFilename := path.Join(dirname, entry.name)
+			logFile, err := NewRotatingFileWithOptions(RotatingFileOptions{
+				Path:                   logFilename,
+				Mode:                   0644,
+				Metrics:                metrics,
+				DiskSpaceMonitor:       monitor,
+				MinFreeSpace:           Mebibyte,
+				LowDiskSpacePolicy:     entry.policy,
+				LowDiskSpaceBufferSize: Byte(7),
+			})
+			if err != nil {
+				t.Fatalf("NewRotatingFileWithOptions failed with %v", err)
+			}
+			defer logFile.Close()
+
+			logFile.WriteString("before\n")
+			setFree(Kibibyte)
+			logFile.WriteString("during\n")
+			// This exceeds the in-memory limit, so it is always dropped.
+			logFile.WriteString("extra\n")
+			setFree(Gibibyte)
+			logFile.WriteString("after\n")
+			logFile.Close()
+
+			contents, err := ioutil.ReadFile(logFilename)
+			if err != nil {
+				t.Fatalf("ReadFile failed with %v", err)
+			}
+			if string(contents) != entry.expected {
+				t.Errorf("contents = %q, expected %q", string(contents), entry.expected)
+			}
+			if dropped := metrics.counter("rotating_file_dropped_bytes_total"); dropped != entry.dropped {
+				t.Errorf("dropped = %v, expected %v", dropped, entry.dropped)
+			}
+		})
+	}
+}
+
+func TestRotatingFileLowDiskSpaceBlock(t *testing.T) {
+	dirname, err := ioutil.TempDir("", "rotating-file")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir failed with %v", err)
+	}
+	defer os.RemoveAll(dirname)
+
+	monitor, setFree := newFakeDiskSpaceMonitor(t, Kibibyte)
+	logFilename := path.Join(dirname, "log")
+	logFile, err := NewRotatingFileWithOptions(RotatingFileOptions{
+		Path:               logFilename,
+		Mode:               0644,
+		DiskSpaceMonitor:   monitor,
+		MinFreeSpace:       Mebibyte,
+		LowDiskSpacePolicy: LowDiskSpaceBlock,
+	})
+	if err != nil {
+		t.Fatalf("NewRotatingFileWithOptions failed with %v", err)
+	}
+	defer logFile.Close()
+
+	written := make(chan error, 1)
+	go func() {
+		_, err := logFile.WriteString("blocked\n")
+		written <- err
+	}()
+	select {
+	case err := <-written:
+		t.Fatalf("WriteString returned %v while there was no disk space", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	setFree(Gibibyte)
+	select {
+	case err := <-written:
+		if err != nil {
+			t.Fatalf("WriteString failed with %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("WriteString did not unblock after the disk space recovered")
+	}
+	logFile.Close()
+
+	contents, err := ioutil.ReadFile(logFilename)
+	if err != nil {
+		t.Fatalf("ReadFile failed with %v", err)
+	}
+	if string(contents) != "blocked\n" {
+		t.Errorf("contents = %q, expected %q", string(contents), "blocked\n")
+	}
+}
+
+// recoveryLogger invokes onRecovered when a RotatingFile logs that the disk
+// space recovered.
+type recoveryLogger struct {
+	logging.Logger
+	onRecovered func()
+}
+
+func (l *recoveryLogger) Info(msg string, context map[string]any) {
+	if msg == "disk space recovered, resuming writes" {
+		l.onRecovered()
+	}
+}
+
+func TestRotatingFileLowDiskSpaceBlockDipAfterWakeUp(t *testing.T) {
+	dirname, err := ioutil.TempDir("", "rotating-file")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir failed with %v", err)
+	}
+	defer os.RemoveAll(dirname)
+
+	monitor, setFree := newFakeDiskSpaceMonitor(t, Kibibyte)
+	logFilename := path.Join(dirname, "log")
+	logFile, err := NewRotatingFileWithOptions(RotatingFileOptions{
+		Path:               logFilename,
+		Mode:               0644,
+		DiskSpaceMonitor:   monitor,
+		MinFreeSpace:       Mebibyte,
+		LowDiskSpacePolicy: LowDiskSpaceBlock,
+		Log: &recoveryLogger{
+			Logger: logging.NewInMemoryLogfmtLogger(ioutil.Discard),
+			// The free space dips again right after the writer wakes up.
+			onRecovered: func() { setFree(Kibibyte) },
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewRotatingFileWithOptions failed with %v", err)
+	}
+	defer logFile.Close()
+
+	written := make(chan error, 1)
+	go func() {
+		_, err := logFile.WriteString("blocked\n")
+		written <- err
+	}()
+	select {
+	case err := <-written:
+		t.Fatalf("WriteString returned %v while there was no disk space", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	setFree(Gibibyte)
+	select {
+	case err := <-written:
+		if err != nil {
+			t.Fatalf("WriteString failed with %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("WriteString did not unblock after the disk space recovered")
+	}
+	logFile.Close()
+
+	contents, err := ioutil.ReadFile(logFilename)
+	if err != nil {
+		t.Fatalf("ReadFile failed with %v", err)
+	}
+	if string(contents) != "blocked\n" {
+		t.Errorf("contents = %q, expected %q", string(contents), "blocked\n")
+	}
+}
@@ -0,0 +1,290 @@
+package base
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A Compressor compresses the files that were rotated away by a RotatingFile.
+type Compressor interface {
+	// Extension is the suffix that will be appended to the names of the
+	// compressed files, including the leading dot.
+	Extension() string
+
+	// NewWriter returns an io.WriteCloser that compresses everything written
+	// to it into w. Close will be called once all the contents are written.
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+}
+
+type gzipCompressor struct{}
+
+// GzipCompressor is a Compressor that produces gzip files.
+var GzipCompressor Compressor = gzipCompressor{}
+
+func (gzipCompressor) Extension() string { return ".gz" }
+
+func (gzipCompressor) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriter(w), nil
+}
+
+// rotatedFile is a file that was previously written by a RotatingFile.
+type rotatedFile struct {
+	path       string
+	compressed bool
+	size       Byte
+	modTime    time.Time
+}
+
+// rotatedFilePattern returns a glob that matches all the files that can be
+// produced by expanding path, and a regular expression that matches the
+// names of those files exactly, optionally followed by extension.
+func rotatedFilePattern(path string, extension string) (string, *regexp.Regexp, error) {
+	var glob, re strings.Builder
+	re.WriteString("^")
+	for i := 0; i < len(path); i++ {
+		if path[i] != '%' || i+1 == len(path) {
+			glob.WriteString(escapeGlob(path[i : i+1]))
+			re.WriteString(regexp.QuoteMeta(path[i : i+1]))
+			continue
+		}
+		i++
+		switch path[i] {
+		case '%':
+			glob.WriteString("%")
+			re.WriteString("%")
+			continue
+		case 'Y':
+			re.WriteString(`\d{4}`)
+		case 'j':
+			re.WriteString(`\d{3}`)
+		default:
+			re.WriteString(`\d{2}`)
+		}
+		glob.WriteString("*")
+	}
+	if extension != "" {
+		re.WriteString("(" + regexp.QuoteMeta(extension) + ")?")
+	}
+	re.WriteString("$")
+	compiled, err := regexp.Compile(re.String())
+	if err != nil {
+		return "", nil, err
+	}
+	return glob.String(), compiled, nil
+}
+
+func escapeGlob(s string) string {
+	switch s {
+	case "*", "?", "[", "\\":
+		return "\\" + s
+	}
+	return s
+}
+
+// rotatedFiles returns all the files that were previously written by r,
+// excluding the one that is currently open, sorted from newest to oldest.
+func (r *RotatingFile) rotatedFiles() ([]rotatedFile, error) {
+	extension := ""
+	if r.options.Compressor != nil {
+		extension = r.options.Compressor.Extension()
+	}
+	glob, re, err := rotatedFilePattern(r.options.Path, extension)
+	if err != nil {
+		return nil, err
+	}
+	candidates, err := filepath.Glob(glob)
+	if err != nil {
+		return nil, err
+	}
+	if extension != "" {
+		compressedCandidates, err := filepath.Glob(glob + escapeGlob(extension))
+		if err != nil {
+			return nil, err
+		}
+		candidates = append(candidates, compressedCandidates...)
+	}
+
+	currentPath := r.Name()
+	var files []rotatedFile
+	for _, candidate := range candidates {
+		if candidate == currentPath || !re.MatchString(candidate) {
+			continue
+		}
+		info, err := os.Lstat(candidate)
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		files = append(files, rotatedFile{
+			path:       candidate,
+			compressed: extension != "" && strings.HasSuffix(candidate, extension),
+			size:       Byte(info.Size()),
+			modTime:    info.ModTime(),
+		})
+	}
+	sort.Slice(files, func(i, j int) bool {
+		if !files[i].modTime.Equal(files[j].modTime) {
+			return files[i].modTime.After(files[j].modTime)
+		}
+		return files[i].path > files[j].path
+	})
+	return files, nil
+}
+
+// hasCleanup returns whether the rotated files need to be compressed or
+// removed.
+func (r *RotatingFile) hasCleanup() bool {
+	return r.options.Compressor != nil ||
+		r.options.MaxAge > 0 ||
+		r.options.MaxBackups > 0 ||
+		r.options.MaxTotalSize > 0
+}
+
+// cleanupOnRotation compresses and removes the rotated files every time the
+// file is rotated, until the file is closed.
+func (r *RotatingFile) cleanupOnRotation() {
+	defer r.wg.Done()
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-r.cleanupChannel:
+		}
+		r.cleanup()
+	}
+}
+
+// requestCleanup schedules the background worker to process the rotated
+// files. It never blocks.
+func (r *RotatingFile) requestCleanup() {
+	if r.cleanupChannel == nil {
+		return
+	}
+	select {
+	case r.cleanupChannel <- struct{}{}:
+	default:
+	}
+}
+
+// cleanup compresses all the rotated files that are not yet compressed and
+// then enforces the retention limits. Failures are logged.
+func (r *RotatingFile) cleanup() {
+	files, err := r.rotatedFiles()
+	if err != nil {
+		r.logError("failed to list rotated files", map[string]any{"err": err})
+		return
+	}
+
+	if r.options.Compressor != nil {
+		for i, file := range files {
+			if file.compressed {
+				continue
+			}
+			compressed, err := compressRotatedFile(file, r.options.Compressor)
+			if err != nil {
+				r.logError("failed to compress rotated file", map[string]any{
+					"path": file.path,
+					"err":  err,
+				})
+				continue
+			}
+			files[i] = compressed
+		}
+	}
+
+	var totalSize Byte
+	now := r.now()
+	for i, file := range files {
+		totalSize += file.size
+		if (r.options.MaxAge <= 0 || now.Sub(file.modTime) <= time.Duration(r.options.MaxAge)) &&
+			(r.options.MaxBackups <= 0 || i < r.options.MaxBackups) &&
+			(r.options.MaxTotalSize <= 0 || totalSize <= r.options.MaxTotalSize) {
+			continue
+		}
+		if err := os.Remove(file.path); err != nil && !os.IsNotExist(err) {
+			r.logError("failed to remove rotated file", map[string]any{
+				"path": file.path,
+				"err":  err,
+			})
+		}
+	}
+}
+
+// compressRotatedFile compresses file into a new file with the compressor's
+// extension and removes the original. The modification time is preserved so
+// that the retention limits are not affected by the compression.
+func compressRotatedFile(file rotatedFile, compressor Compressor) (rotatedFile, error) {
+	src, err := os.Open(file.path)
+	if err != nil {
+		return file, err
+	}
+	defer src.Close()
+
+	info, err := src.Stat()
+	if err != nil {
+		return file, err
+	}
+	compressedPath := file.path + compressor.Extension()
+	tempPath := compressedPath + ".tmp"
+	dst, err := os.OpenFile(tempPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return file, err
+	}
+	if err := func() error {
+		w, err := compressor.NewWriter(dst)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(w, src); err != nil {
+			w.Close()
+			return err
+		}
+		if err := w.Close(); err != nil {
+			return err
+		}
+		return dst.Sync()
+	}(); err != nil {
+		dst.Close()
+		os.Remove(tempPath)
+		return file, err
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(tempPath)
+		return file, err
+	}
+	if err := os.Chtimes(tempPath, info.ModTime(), info.ModTime()); err != nil {
+		os.Remove(tempPath)
+		return file, err
+	}
+	if err := os.Rename(tempPath, compressedPath); err != nil {
+		os.Remove(tempPath)
+		return file, err
+	}
+	if err := os.Remove(file.path); err != nil {
+		return file, fmt.Errorf("compressed into %s, but failed to remove original: %w", compressedPath, err)
+	}
+
+	compressedInfo, err := os.Stat(compressedPath)
+	if err != nil {
+		return file, err
+	}
+	return rotatedFile{
+		path:       compressedPath,
+		compressed: true,
+		size:       Byte(compressedInfo.Size()),
+		modTime:    compressedInfo.ModTime(),
+	}, nil
+}
+
+func (r *RotatingFile) logError(msg string, context map[string]any) {
+	if r.options.Log == nil {
+		return
+	}
+	r.options.Log.Error(msg, context)
+}
@@ -0,0 +1,139 @@
+package base
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func writeRotatedFile(t *testing.T, filename string, contents string, age time.Duration) {
+	t.Helper()
+	if err := ioutil.WriteFile(filename, []byte(contents), 0644); err != nil {
+		t.Fatalf("WriteFile(%s) failed with %v", filename, err)
+	}
+	modTime := time.Now().Add(-age)
+	if err := os.Chtimes(filename, modTime, modTime); err != nil {
+		t.Fatalf("Chtimes(%s) failed with %v", filename, err)
+	}
+}
+
+func listDir(t *testing.T, dirname string) []string {
+	t.Helper()
+	entries, err := ioutil.ReadDir(dirname)
+	if err != nil {
+		t.Fatalf("ReadDir(%s) failed with %v", dirname, err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestRotatingFileCompression(t *testing.T) {
+	dirname, err := ioutil.TempDir("", "rotating-file")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir failed with %v", err)
+	}
+	defer os.RemoveAll(dirname)
+
+	writeRotatedFile(t, path.Join(dirname, "events-20220101.log"), "one\n", 10*24*time.Hour)
+	writeRotatedFile(t, path.Join(dirname, "events-20220102.log"), "two\n", 5*24*time.Hour)
+	writeRotatedFile(t, path.Join(dirname, "events-20220103.log"), "three\n", 3*24*time.Hour)
+	writeRotatedFile(t, path.Join(dirname, "events-20220104.log"), "four\n", 24*time.Hour)
+	writeRotatedFile(t, path.Join(dirname, "events-unrelated.log"), "unrelated\n", 30*24*time.Hour)
+
+	logFile, err := NewRotatingFileWithOptions(RotatingFileOptions{
+		Path:       path.Join(dirname, "events-%Y%m%d.log"),
+		Mode:       0644,
+		Compressor: GzipCompressor,
+		MaxAge:     Duration(7 * 24 * time.Hour),
+		MaxBackups: 2,
+	})
+	if err != nil {
+		t.Fatalf("NewRotatingFileWithOptions failed with %v", err)
+	}
+	currentFilename := path.Base(logFile.Name())
+	logFile.WriteString("current\n")
+	if err := logFile.Close(); err != nil {
+		t.Fatalf("Close failed with %v", err)
+	}
+	// Closing the file waits for the background worker, so this makes the
+	// outcome deterministic regardless of whether the worker ran.
+	logFile.cleanup()
+
+	expectedFiles := []string{
+		"events-20220103.log.gz",
+		"events-20220104.log.gz",
+		"events-unrelated.log",
+		currentFilename,
+	}
+	sort.Strings(expectedFiles)
+	if files := listDir(t, dirname); !reflect.DeepEqual(expectedFiles, files) {
+		t.Errorf("files = %v, expected %v", files, expectedFiles)
+	}
+
+	for filename, expectedContents := range map[string]string{
+		"events-20220103.log.gz": "three\n",
+		"events-20220104.log.gz": "four\n",
+	} {
+		compressed, err := ioutil.ReadFile(path.Join(dirname, filename))
+		if err != nil {
+			t.Fatalf("ReadFile(%s) failed with %v", filename, err)
+		}
+		r, err := gzip.NewReader(bytes.NewReader(compressed))
+		if err != nil {
+			t.Fatalf("gzip.NewReader(%s) failed with %v", filename, err)
+		}
+		contents, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("ReadAll(%s) failed with %v", filename, err)
+		}
+		if string(contents) != expectedContents {
+			t.Errorf("Contents of %s were %q, expected %q", filename, string(contents), expectedContents)
+		}
+	}
+}
+
+func TestRotatingFileRetentionBySize(t *testing.T) {
+	dirname, err := ioutil.TempDir("", "rotating-file")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir failed with %v", err)
+	}
+	defer os.RemoveAll(dirname)
+
+	writeRotatedFile(t, path.Join(dirname, "events-2022010100.log"), "0123456789", 3*time.Hour)
+	writeRotatedFile(t, path.Join(dirname, "events-2022010101.log"), "0123456789", 2*time.Hour)
+	writeRotatedFile(t, path.Join(dirname, "events-2022010102.log"), "0123456789", time.Hour)
+
+	logFile, err := NewRotatingFileWithOptions(RotatingFileOptions{
+		Path:         path.Join(dirname, "events-%Y%m%d%H.log"),
+		Mode:         0644,
+		MaxTotalSize: Byte(25),
+	})
+	if err != nil {
+		t.Fatalf("NewRotatingFileWithOptions failed with %v", err)
+	}
+	currentFilename := path.Base(logFile.Name())
+	if err := logFile.Close(); err != nil {
+		t.Fatalf("Close failed with %v", err)
+	}
+	logFile.cleanup()
+
+	expectedFiles := []string{
+		"events-2022010101.log",
+		"events-2022010102.log",
+		currentFilename,
+	}
+	sort.Strings(expectedFiles)
+	if files := listDir(t, dirname); !reflect.DeepEqual(expectedFiles, files) {
+		t.Errorf("files = %v, expected %v", files, expectedFiles)
+	}
+}
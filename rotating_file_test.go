@@ -1,10 +1,14 @@
 package base
 
 import (
+	"errors"
 	"io/ioutil"
 	"os"
 	"path"
+	"reflect"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestRotatingFile(t *testing.T) {
@@ -47,3 +51,443 @@ func TestRotatingFile(t *testing.T) {
 		}
 	}
 }
+
+func TestRotatingFileTimeBased(t *testing.T) {
+	dirname, err := ioutil.TempDir("", "rotating-file")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir failed with %v", err)
+	}
+	defer os.RemoveAll(dirname)
+
+	location := time.FixedZone("UTC-6", -6*60*60)
+	var openedFiles []string
+	logFile, err := NewRotatingFileWithOptions(RotatingFileOptions{
+		Path: path.Join(dirname, "events-%Y%m%d.log"),
+		Mode: 0644,
+		OpenedCallback: func(f *os.File, isEmpty bool) error {
+			openedFiles = append(openedFiles, path.Base(f.Name()))
+			if isEmpty {
+				_, err := f.WriteString("header\n")
+				return err
+			}
+			return nil
+		},
+		Location:    location,
+		SymlinkPath: path.Join(dirname, "events.log"),
+	})
+	if err != nil {
+		t.Fatalf("NewRotatingFileWithOptions failed with %v", err)
+	}
+	defer logFile.Close()
+
+	if err := logFile.rotateAt(time.Date(2021, 12, 31, 23, 59, 59, 0, location)); err != nil {
+		t.Fatalf("rotateAt failed with %v", err)
+	}
+	logFile.WriteString("hello\n")
+	if err := logFile.rotateAt(time.Date(2022, 1, 1, 5, 59, 59, 0, time.UTC)); err != nil {
+		t.Fatalf("rotateAt failed with %v", err)
+	}
+	logFile.WriteString("world\n")
+	if err := logFile.rotateAt(time.Date(2022, 1, 1, 6, 0, 0, 0, time.UTC)); err != nil {
+		t.Fatalf("rotateAt failed with %v", err)
+	}
+	logFile.WriteString("bye\n")
+	if logFile.Name() != path.Join(dirname, "events-20220101.log") {
+		t.Errorf("logFile.Name() = %q, expected %q", logFile.Name(), path.Join(dirname, "events-20220101.log"))
+	}
+	logFile.Close()
+
+	// The first file is opened using the current time.
+	expectedOpenedFiles := []string{
+		"events-20211231.log",
+		"events-20211231.log",
+		"events-20220101.log",
+	}
+	if !reflect.DeepEqual(expectedOpenedFiles, openedFiles[1:]) {
+		t.Errorf("opened files were %v, expected %v", openedFiles, expectedOpenedFiles)
+	}
+
+	for filename, expectedContents := range map[string]string{
+		"events-20211231.log": "header\nhello\nworld\n",
+		"events-20220101.log": "header\nbye\n",
+		"events.log":          "header\nbye\n",
+	} {
+		contents, err := ioutil.ReadFile(path.Join(dirname, filename))
+		if err != nil {
+			t.Fatalf("ReadFile(%s) failed with %v", filename, err)
+		}
+		if string(contents) != expectedContents {
+			t.Errorf("Contents of %s were %q, expected %q", filename, string(contents), expectedContents)
+		}
+	}
+}
+
+func TestRotatingFileInvalidRotationInterval(t *testing.T) {
+	dirname, err := ioutil.TempDir("", "rotating-file")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir failed with %v", err)
+	}
+	defer os.RemoveAll(dirname)
+
+	for _, interval := range []time.Duration{-time.Hour, 36 * time.Hour} {
+		_, err := NewRotatingFileWithOptions(RotatingFileOptions{
+			Path:             path.Join(dirname, "events-%Y%m%d.log"),
+			Mode:             0644,
+			RotationInterval: Duration(interval),
+		})
+		if err == nil {
+			t.Errorf("NewRotatingFileWithOptions should have failed with an interval of %v", interval)
+		}
+	}
+}
+
+func TestRotatingFileNextRotation(t *testing.T) {
+	location, err := time.LoadLocation("America/Mexico_City")
+	if err != nil {
+		t.Skipf("time.LoadLocation failed with %v", err)
+	}
+	for _, entry := range []struct {
+		interval time.Duration
+		now      time.Time
+		expected time.Time
+	}{
+		{
+			24 * time.Hour,
+			time.Date(2021, 4, 3, 12, 0, 0, 0, location),
+			time.Date(2021, 4, 4, 0, 0, 0, 0, location),
+		},
+		{
+			// Daylight saving time started on 2021-04-04 in Mexico City.
+			24 * time.Hour,
+			time.Date(2021, 4, 4, 12, 0, 0, 0, location),
+			time.Date(2021, 4, 5, 0, 0, 0, 0, location),
+		},
+		{
+			time.Hour,
+			time.Date(2021, 4, 3, 12, 0, 0, 0, location),
+			time.Date(2021, 4, 3, 13, 0, 0, 0, location),
+		},
+		{
+			time.Hour,
+			time.Date(2021, 4, 3, 23, 30, 0, 0, location),
+			time.Date(2021, 4, 4, 0, 0, 0, 0, location),
+		},
+		{
+			7 * time.Hour,
+			time.Date(2021, 4, 3, 22, 0, 0, 0, location),
+			time.Date(2021, 4, 4, 0, 0, 0, 0, location),
+		},
+	} {
+		r := &RotatingFile{
+			options: RotatingFileOptions{
+				RotationInterval: Duration(entry.interval),
+				Location:         location,
+			},
+		}
+		if next := r.nextRotation(entry.now); !next.Equal(entry.expected) {
+			t.Errorf("nextRotation(%v, %v) = %v, expected %v", entry.interval, entry.now, next, entry.expected)
+		}
+	}
+}
+
+func TestFormatRotatingFilePath(t *testing.T) {
+	now := time.Date(2022, 2, 3, 4, 5, 6, 0, time.UTC)
+	for _, entry := range []struct {
+		path     string
+		expected string
+		unit     time.Duration
+	}{
+		{"events.log", "events.log", 0},
+		{"events-%Y%m%d.log", "events-20220203.log", 24 * time.Hour},
+		{"events-%y-%j-%H.log", "events-22-034-04.log", time.Hour},
+		{"%Y/%m/%d/%H%M%S-100%%.log", "2022/02/03/040506-100%.log", time.Second},
+	} {
+		unit, err := rotatingFilePathUnit(entry.path)
+		if err != nil {
+			t.Fatalf("rotatingFilePathUnit(%q) failed with %v", entry.path, err)
+		}
+		if unit != entry.unit {
+			t.Errorf("rotatingFilePathUnit(%q) = %v, expected %v", entry.path, unit, entry.unit)
+		}
+		if formatted := formatRotatingFilePath(entry.path, now); formatted != entry.expected {
+			t.Errorf("formatRotatingFilePath(%q) = %q, expected %q", entry.path, formatted, entry.expected)
+		}
+	}
+
+	if _, err := rotatingFilePathUnit("events-%Q.log"); err == nil {
+		t.Errorf("rotatingFilePathUnit should have failed with an unsupported directive")
+	}
+}
+
+func TestRotatingFileBuffered(t *testing.T) {
+	dirname, err := ioutil.TempDir("", "rotating-file")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir failed with %v", err)
+	}
+	defer os.RemoveAll(dirname)
+
+	logFilename := path.Join(dirname, "log")
+	logFile, err := NewRotatingFileWithOptions(RotatingFileOptions{
+		Path:          logFilename,
+		Mode:          0644,
+		BufferSize:    Kibibyte,
+		FlushInterval: Duration(time.Hour),
+		SyncPolicy:    SyncOnRotate,
+	})
+	if err != nil {
+		t.Fatalf("NewRotatingFileWithOptions failed with %v", err)
+	}
+	defer logFile.Close()
+
+	assertContents := func(filename, expectedContents string) {
+		t.Helper()
+		contents, err := ioutil.ReadFile(filename)
+		if err != nil {
+			t.Fatalf("ReadFile(%s) failed with %v", filename, err)
+		}
+		if string(contents) != expectedContents {
+			t.Errorf("Contents of %s were %q, expected %q", filename, string(contents), expectedContents)
+		}
+	}
+
+	logFile.WriteString("hello, ")
+	assertContents(logFilename, "")
+	if err := logFile.Flush(); err != nil {
+		t.Fatalf("Flush failed with %v", err)
+	}
+	assertContents(logFilename, "hello, ")
+
+	logFile.WriteString("world!\n")
+	oldLogFilename := logFilename + ".old"
+	if err := os.Rename(logFilename, oldLogFilename); err != nil {
+		t.Fatalf("Rename failed with %v", err)
+	}
+	if err := logFile.Rotate(); err != nil {
+		t.Fatalf("Rotate failed with %v", err)
+	}
+	assertContents(oldLogFilename, "hello, world!\n")
+
+	logFile.WriteString("hi!\n")
+	assertContents(logFilename, "")
+	if err := logFile.Close(); err != nil {
+		t.Fatalf("Close failed with %v", err)
+	}
+	assertContents(logFilename, "hi!\n")
+
+	if _, err := logFile.WriteString("too late\n"); err == nil {
+		t.Errorf("WriteString after Close should have failed")
+	}
+}
+
+func TestRotatingFileBufferedSyncEveryFlush(t *testing.T) {
+	dirname, err := ioutil.TempDir("", "rotating-file")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir failed with %v", err)
+	}
+	defer os.RemoveAll(dirname)
+
+	logFilename := path.Join(dirname, "log")
+	logFile, err := NewRotatingFileWithOptions(RotatingFileOptions{
+		Path:          logFilename,
+		Mode:          0644,
+		BufferSize:    Byte(16),
+		FlushInterval: Duration(time.Hour),
+		SyncPolicy:    SyncEveryFlush,
+	})
+	if err != nil {
+		t.Fatalf("NewRotatingFileWithOptions failed with %v", err)
+	}
+	defer logFile.Close()
+
+	syncs := 0
+	logFile.lock.Lock()
+	logFile.syncFile = func(f *os.File) error {
+		syncs++
+		return f.Sync()
+	}
+	logFile.lock.Unlock()
+
+	// Writes that overflow the buffer reach the file without an explicit
+	// Flush, and they must also be flushed to stable storage.
+	for i := 0; i < 4; i++ {
+		if _, err := logFile.WriteString("0123456789"); err != nil {
+			t.Fatalf("WriteString failed with %v", err)
+		}
+	}
+	contents, err := ioutil.ReadFile(logFilename)
+	if err != nil {
+		t.Fatalf("ReadFile(%s) failed with %v", logFilename, err)
+	}
+	logFile.lock.Lock()
+	defer logFile.lock.Unlock()
+	if len(contents) == 0 {
+		t.Fatalf("Contents of %s were empty, expected the overflowing writes", logFilename)
+	}
+	if syncs == 0 {
+		t.Errorf("syncs = 0, expected the overflowing writes to be synced")
+	}
+}
+
+func TestRotatingFileBufferedTransientError(t *testing.T) {
+	dirname, err := ioutil.TempDir("", "rotating-file")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir failed with %v", err)
+	}
+	defer os.RemoveAll(dirname)
+
+	logFilename := path.Join(dirname, "log")
+	logFile, err := NewRotatingFileWithOptions(RotatingFileOptions{
+		Path:          logFilename,
+		Mode:          0644,
+		BufferSize:    Kibibyte,
+		FlushInterval: Duration(time.Hour),
+		SyncPolicy:    SyncEveryFlush,
+	})
+	if err != nil {
+		t.Fatalf("NewRotatingFileWithOptions failed with %v", err)
+	}
+	defer logFile.Close()
+
+	transientErr := errors.New("transient")
+	failures := 1
+	logFile.lock.Lock()
+	logFile.syncFile = func(f *os.File) error {
+		if failures > 0 {
+			failures--
+			return transientErr
+		}
+		return f.Sync()
+	}
+	logFile.lock.Unlock()
+
+	logFile.WriteString("hello\n")
+	if err := logFile.Flush(); err != transientErr {
+		t.Fatalf("Flush = %v, expected %v", err, transientErr)
+	}
+
+	// A single failure does not make the file unusable.
+	if _, err := logFile.WriteString("world\n"); err != nil {
+		t.Fatalf("WriteString failed with %v", err)
+	}
+	if err := logFile.Flush(); err != nil {
+		t.Fatalf("Flush failed with %v", err)
+	}
+	if err := logFile.Rotate(); err != nil {
+		t.Fatalf("Rotate failed with %v", err)
+	}
+	if _, err := logFile.WriteString("again\n"); err != nil {
+		t.Fatalf("WriteString failed with %v", err)
+	}
+	if err := logFile.Close(); err != nil {
+		t.Fatalf("Close failed with %v", err)
+	}
+
+	contents, err := ioutil.ReadFile(logFilename)
+	if err != nil {
+		t.Fatalf("ReadFile(%s) failed with %v", logFilename, err)
+	}
+	if string(contents) != "hello\nworld\nagain\n" {
+		t.Errorf("Contents of %s were %q, expected %q", logFilename, string(contents), "hello\nworld\nagain\n")
+	}
+}
+
+type recordingMetrics struct {
+	sync.Mutex
+	gauges   map[string]float64
+	counters map[string]float64
+}
+
+func (m *recordingMetrics) GaugeAdd(name string, value float64) {
+	m.Lock()
+	defer m.Unlock()
+	if m.gauges == nil {
+		m.gauges = make(map[string]float64)
+	}
+	m.gauges[name] += value
+}
+
+func (m *recordingMetrics) CounterAdd(name string, value float64) {
+	m.Lock()
+	defer m.Unlock()
+	if m.counters == nil {
+		m.counters = make(map[string]float64)
+	}
+	m.counters[name] += value
+}
+
+func (m *recordingMetrics) SummaryObserve(name string, value float64) {
+}
+
+func (m *recordingMetrics) gauge(name string) float64 {
+	m.Lock()
+	defer m.Unlock()
+	return m.gauges[name]
+}
+
+func (m *recordingMetrics) counter(name string) float64 {
+	m.Lock()
+	defer m.Unlock()
+	return m.counters[name]
+}
+
+func TestRotatingFileReopenIfMoved(t *testing.T) {
+	dirname, err := ioutil.TempDir("", "rotating-file")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir failed with %v", err)
+	}
+	defer os.RemoveAll(dirname)
+
+	metrics := &recordingMetrics{}
+	logFilename := path.Join(dirname, "log")
+	logFile, err := NewRotatingFileWithOptions(RotatingFileOptions{
+		Path:                logFilename,
+		Mode:                0644,
+		ReopenCheckInterval: Duration(time.Hour),
+		Metrics:             metrics,
+	})
+	if err != nil {
+		t.Fatalf("NewRotatingFileWithOptions failed with %v", err)
+	}
+	defer logFile.Close()
+
+	logFile.WriteString("deleted\n")
+	if err := logFile.reopenIfMoved(); err != nil {
+		t.Fatalf("reopenIfMoved failed with %v", err)
+	}
+	if count := metrics.counter("rotating_file_reopens_total"); count != 0 {
+		t.Errorf("reopen count = %v, expected 0", count)
+	}
+
+	if err := os.Remove(logFilename); err != nil {
+		t.Fatalf("Remove failed with %v", err)
+	}
+	if err := logFile.reopenIfMoved(); err != nil {
+		t.Fatalf("reopenIfMoved failed with %v", err)
+	}
+	logFile.WriteString("moved\n")
+
+	if err := os.Rename(logFilename, logFilename+".old"); err != nil {
+		t.Fatalf("Rename failed with %v", err)
+	}
+	if err := logFile.reopenIfMoved(); err != nil {
+		t.Fatalf("reopenIfMoved failed with %v", err)
+	}
+	logFile.WriteString("reopened\n")
+	logFile.Close()
+
+	if count := metrics.counter("rotating_file_reopens_total"); count != 2 {
+		t.Errorf("reopen count = %v, expected 2", count)
+	}
+	for filename, expectedContents := range map[string]string{
+		logFilename + ".old": "moved\n",
+		logFilename:          "reopened\n",
+	} {
+		contents, err := ioutil.ReadFile(filename)
+		if err != nil {
+			t.Fatalf("ReadFile(%s) failed with %v", filename, err)
+		}
+		if string(contents) != expectedContents {
+			t.Errorf("Contents of %s were %q, expected %q", filename, string(contents), expectedContents)
+		}
+	}
+}
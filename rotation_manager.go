@@ -0,0 +1,192 @@
+package base
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/omegaup/go-base/v3/logging"
+)
+
+// A Rotator is an object that can reopen its underlying resources, such as a
+// RotatingFile.
+type Rotator interface {
+	// Rotate reopens the underlying resources.
+	Rotate() error
+}
+
+// A RotationError is the error that a Rotator returned when it was rotated by
+// a RotationManager.
+type RotationError struct {
+	Rotator Rotator
+	Err     error
+}
+
+func (e *RotationError) Error() string {
+	if named, ok := e.Rotator.(interface{ Name() string }); ok {
+		return fmt.Sprintf("failed to rotate %s: %v", named.Name(), e.Err)
+	}
+	return fmt.Sprintf("failed to rotate: %v", e.Err)
+}
+
+// Unwrap returns the error that the Rotator returned.
+func (e *RotationError) Unwrap() error { return e.Err }
+
+// Cause returns the error that the Rotator returned.
+func (e *RotationError) Cause() error { return e.Err }
+
+// RotationManagerOptions are options that can be passed to NewRotationManager
+// to customize its behavior.
+type RotationManagerOptions struct {
+	// Signals is the list of signals that trigger a rotation of all the
+	// registered Rotators. The default is SIGHUP if unset.
+	Signals []os.Signal
+
+	// OnError is invoked for every Rotator that failed to rotate after a
+	// signal was received.
+	OnError func(err *RotationError)
+
+	// Log is used to report the Rotators that failed to rotate after a signal
+	// was received, if OnError is unset and the Rotator does not have a Logger
+	// of its own, such as a RotatingFile with a Log. Failures are silently
+	// ignored if none of them is set.
+	Log logging.Logger
+}
+
+// A rotationLogger is a Rotator that has its own Logger, which is preferred
+// over the Log of the RotationManager to report its failures.
+type rotationLogger interface {
+	rotationLog() logging.Logger
+}
+
+// A RotationManager rotates a set of Rotators whenever the process receives a
+// signal or RotateAll is called. It owns a single signal subscription, which
+// is only active while there is at least one Rotator registered. All
+// operations are thread-safe.
+type RotationManager struct {
+	options RotationManagerOptions
+
+	lock          sync.Mutex
+	rotators      []Rotator
+	signalChannel chan os.Signal
+	done          chan struct{}
+}
+
+// DefaultRotationManager is the RotationManager that RotatingFile uses if
+// none is provided. It rotates all the files on SIGHUP, and reports the files
+// that failed to rotate to their Log, or to stderr if they have none.
+var DefaultRotationManager = NewRotationManager(RotationManagerOptions{
+	Log: logging.NewInMemoryLogfmtLogger(os.Stderr),
+})
+
+// NewRotationManager creates a new RotationManager with the provided options.
+// No signals are subscribed to until the first Rotator is registered.
+func NewRotationManager(options RotationManagerOptions) *RotationManager {
+	if len(options.Signals) == 0 {
+		options.Signals = []os.Signal{syscall.SIGHUP}
+	}
+	return &RotationManager{
+		options: options,
+	}
+}
+
+// Register adds a Rotator to the set of Rotators that are rotated whenever a
+// signal is received.
+func (m *RotationManager) Register(r Rotator) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for _, registered := range m.rotators {
+		if registered == r {
+			return
+		}
+	}
+	m.rotators = append(m.rotators, r)
+	if len(m.rotators) == 1 {
+		m.signalChannel = make(chan os.Signal, 1)
+		m.done = make(chan struct{})
+		signal.Notify(m.signalChannel, m.options.Signals...)
+		go m.rotateOnSignal(m.signalChannel, m.done)
+	}
+}
+
+// Unregister removes a Rotator from the set of Rotators that are rotated
+// whenever a signal is received. Once the last Rotator is removed, the signal
+// subscription is stopped.
+func (m *RotationManager) Unregister(r Rotator) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for i, registered := range m.rotators {
+		if registered != r {
+			continue
+		}
+		m.rotators = append(m.rotators[:i], m.rotators[i+1:]...)
+		if len(m.rotators) == 0 {
+			signal.Stop(m.signalChannel)
+			close(m.done)
+			m.signalChannel = nil
+			m.done = nil
+		}
+		return
+	}
+}
+
+// Len returns the number of Rotators that are currently registered.
+func (m *RotationManager) Len() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return len(m.rotators)
+}
+
+// RotateAll rotates all the registered Rotators, in the order in which they
+// were registered. It returns a RotationError for every Rotator that failed to
+// rotate, or nil if all of them succeeded.
+func (m *RotationManager) RotateAll() []*RotationError {
+	m.lock.Lock()
+	rotators := make([]Rotator, len(m.rotators))
+	copy(rotators, m.rotators)
+	m.lock.Unlock()
+
+	var errs []*RotationError
+	for _, r := range rotators {
+		if err := r.Rotate(); err != nil {
+			errs = append(errs, &RotationError{Rotator: r, Err: err})
+		}
+	}
+	return errs
+}
+
+// rotateOnSignal rotates all the registered Rotators every time a signal is
+// received, until done is closed.
+func (m *RotationManager) rotateOnSignal(signalChannel <-chan os.Signal, done <-chan struct{}) {
+	for {
+		select {
+		case <-done:
+			return
+		case <-signalChannel:
+		}
+		for _, err := range m.RotateAll() {
+			m.report(err)
+		}
+	}
+}
+
+// report reports a Rotator that failed to rotate after a signal was received.
+func (m *RotationManager) report(err *RotationError) {
+	if m.options.OnError != nil {
+		m.options.OnError(err)
+		return
+	}
+	log := m.options.Log
+	if r, ok := err.Rotator.(rotationLogger); ok && r.rotationLog() != nil {
+		log = r.rotationLog()
+	}
+	if log != nil {
+		log.Error("failed to rotate", map[string]any{
+			"err": err,
+		})
+	}
+}
@@ -0,0 +1,123 @@
+package base
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/omegaup/go-base/v3/logging"
+)
+
+type countingRotator struct {
+	rotations chan struct{}
+	err       error
+}
+
+func (r *countingRotator) Rotate() error {
+	r.rotations <- struct{}{}
+	return r.err
+}
+
+func TestRotationManager(t *testing.T) {
+	errFailed := errors.New("failed")
+	m := NewRotationManager(RotationManagerOptions{})
+
+	ok := &countingRotator{rotations: make(chan struct{}, 2)}
+	failing := &countingRotator{rotations: make(chan struct{}, 2), err: errFailed}
+	m.Register(ok)
+	m.Register(failing)
+	m.Register(ok)
+	if m.Len() != 2 {
+		t.Fatalf("m.Len() = %d, expected 2", m.Len())
+	}
+
+	errs := m.RotateAll()
+	if len(errs) != 1 || errs[0].Rotator != failing || errs[0].Unwrap() != errFailed {
+		t.Errorf("m.RotateAll() = %v, expected a single failure", errs)
+	}
+	<-ok.rotations
+	<-failing.rotations
+
+	m.Unregister(failing)
+	m.Unregister(ok)
+	if m.Len() != 0 {
+		t.Fatalf("m.Len() = %d, expected 0", m.Len())
+	}
+	if errs := m.RotateAll(); len(errs) != 0 {
+		t.Errorf("m.RotateAll() = %v, expected no errors", errs)
+	}
+}
+
+func TestRotationManagerUnregistersFiles(t *testing.T) {
+	dirname, err := ioutil.TempDir("", "rotation-manager")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir failed with %v", err)
+	}
+	defer os.RemoveAll(dirname)
+
+	m := NewRotationManager(RotationManagerOptions{})
+	for i := 0; i < 16; i++ {
+		logFile, err := NewRotatingFileWithOptions(RotatingFileOptions{
+			Path:            path.Join(dirname, "log"),
+			Mode:            0644,
+			RotationManager: m,
+		})
+		if err != nil {
+			t.Fatalf("NewRotatingFileWithOptions failed with %v", err)
+		}
+		if m.Len() != 1 {
+			t.Fatalf("m.Len() = %d, expected 1", m.Len())
+		}
+		logFile.Close()
+		if m.Len() != 0 {
+			t.Fatalf("m.Len() = %d, expected 0", m.Len())
+		}
+	}
+}
+
+func TestRotationManagerReport(t *testing.T) {
+	dirname, err := ioutil.TempDir("", "rotation-manager")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir failed with %v", err)
+	}
+	defer os.RemoveAll(dirname)
+
+	if DefaultRotationManager.options.Log == nil {
+		t.Errorf("DefaultRotationManager does not report failed rotations")
+	}
+
+	var managerLog, fileLog bytes.Buffer
+	m := NewRotationManager(RotationManagerOptions{
+		Log: logging.NewInMemoryLogfmtLogger(&managerLog),
+	})
+	logFile, err := NewRotatingFileWithOptions(RotatingFileOptions{
+		Path:            path.Join(dirname, "log"),
+		Mode:            0644,
+		RotationManager: m,
+		Log:             logging.NewInMemoryLogfmtLogger(&fileLog),
+	})
+	if err != nil {
+		t.Fatalf("NewRotatingFileWithOptions failed with %v", err)
+	}
+	defer logFile.Close()
+
+	// The failures of a RotatingFile go to its own Log.
+	errFailed := errors.New("failed")
+	m.report(&RotationError{Rotator: logFile, Err: errFailed})
+	if !strings.Contains(fileLog.String(), "failed to rotate") {
+		t.Errorf("file log = %q, expected the failed rotation", fileLog.String())
+	}
+	if managerLog.Len() != 0 {
+		t.Errorf("manager log = %q, expected nothing", managerLog.String())
+	}
+
+	// Other Rotators fall back to the Log of the RotationManager.
+	m.report(&RotationError{Rotator: &countingRotator{}, Err: errFailed})
+	if !strings.Contains(managerLog.String(), "failed to rotate") {
+		t.Errorf("manager log = %q, expected the failed rotation", managerLog.String())
+	}
+}
@@ -0,0 +1,50 @@
+//go:build linux || darwin || freebsd
+
+package base
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestRotationManagerSignal(t *testing.T) {
+	errFailed := errors.New("failed")
+	rotationErrors := make(chan *RotationError, 1)
+	// SIGUSR1 is not subscribed to by any RotationManager by default, so
+	// sending it to the test process does not rotate anything else.
+	m := NewRotationManager(RotationManagerOptions{
+		Signals: []os.Signal{syscall.SIGUSR1},
+		OnError: func(err *RotationError) {
+			rotationErrors <- err
+		},
+	})
+
+	ok := &countingRotator{rotations: make(chan struct{}, 1)}
+	failing := &countingRotator{rotations: make(chan struct{}, 1), err: errFailed}
+	m.Register(ok)
+	m.Register(failing)
+	defer m.Unregister(ok)
+	defer m.Unregister(failing)
+
+	if err := syscall.Kill(os.Getpid(), syscall.SIGUSR1); err != nil {
+		t.Fatalf("Kill failed with %v", err)
+	}
+	for _, r := range []*countingRotator{ok, failing} {
+		select {
+		case <-r.rotations:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("timed out waiting for the rotation")
+		}
+	}
+	select {
+	case err := <-rotationErrors:
+		if err.Rotator != failing {
+			t.Errorf("err.Rotator = %v, expected %v", err.Rotator, failing)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("timed out waiting for the error")
+	}
+}
@@ -0,0 +1,213 @@
+package base
+
+import (
+	"context"
+	"hash/maphash"
+	"math"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// ShardedLRUCacheOptions are options that can be passed to
+// NewShardedLRUCache to customize the cache limits and functionality.
+type ShardedLRUCacheOptions struct {
+	// LRUCacheOptions are the options of the cache. SizeLimit applies to the
+	// whole cache, not to each shard. HardLimit is not supported, and makes
+	// NewShardedLRUCache fail.
+	LRUCacheOptions
+
+	// Shards is the number of shards the cache will be split into to diminish
+	// lock contention. The default is 16 if unset.
+	Shards int
+}
+
+// ShardedLRUCache is an LRUCache that is split into shards, each with its own
+// lock, to diminish lock contention. The size limit applies to the whole
+// cache: once it is exceeded, entries that are not in use are evicted from any
+// of the shards. Every eviction compares the least-recently used entries of
+// two of the shards and evicts the older one, which approximates evicting the
+// least-recently used entry of the whole cache without locking every shard.
+type ShardedLRUCache[T SizedEntry] struct {
+	// size and evictableSize are the total size and evictable size of all the
+	// shards, in bytes. They are updated atomically by the shards while
+	// holding their own locks, so they need to be the first fields to
+	// guarantee their alignment.
+	size          int64
+	evictableSize int64
+
+	// cursor is incremented atomically to choose the shards that are compared
+	// in every eviction.
+	cursor uint32
+
+	seed      maphash.Seed
+	shards    []*LRUCache[T]
+	sizeLimit Byte
+}
+
+// NewShardedLRUCache returns an empty ShardedLRUCache with the provided
+// options.
+func NewShardedLRUCache[T SizedEntry](options ShardedLRUCacheOptions) (*ShardedLRUCache[T], error) {
+	if options.HardLimit {
+		return nil, errors.New("sharded lru cache: HardLimit is not supported")
+	}
+	if options.Shards == 0 {
+		options.Shards = 16
+	}
+	c := &ShardedLRUCache[T]{
+		seed:      maphash.MakeSeed(),
+		shards:    make([]*LRUCache[T], options.Shards),
+		sizeLimit: options.SizeLimit,
+	}
+	// The shards never evict by themselves, since the limit is enforced
+	// across all of them. They all share the same clock so that their entries
+	// can be compared.
+	shardOptions := options.LRUCacheOptions
+	shardOptions.SizeLimit = Byte(math.MaxInt64)
+	clock := new(uint64)
+	for i := range c.shards {
+		c.shards[i] = NewLRUCacheWithOptions[T](shardOptions)
+		c.shards[i].clock = clock
+		c.shards[i].sharedSize = &c.size
+		c.shards[i].sharedEvictableSize = &c.evictableSize
+	}
+	return c, nil
+}
+
+// Get atomically gets a previously-created entry if it was found in the cache,
+// or a newly-created one otherwise. It is the caller's responsibility to call
+// Put() with the returned SizedEntryRef method once it's no longer needed so
+// that the underlying resource can be evicted from the cache, if needed.
+func (c *ShardedLRUCache[T]) Get(
+	key string,
+	factory SizedEntryFactory[T],
+) (*SizedEntryRef[T], error) {
+	return c.GetContext(context.Background(), key, factory)
+}
+
+// GetContext is like Get, but if another caller is already creating the entry,
+// it waits until the creation finishes or ctx is done, in which case ctx.Err()
+// is returned.
+func (c *ShardedLRUCache[T]) GetContext(
+	ctx context.Context,
+	key string,
+	factory SizedEntryFactory[T],
+) (*SizedEntryRef[T], error) {
+	ref, err := c.shard(key).GetContext(ctx, key, factory)
+	if err != nil {
+		return nil, err
+	}
+	c.evict()
+	return ref, nil
+}
+
+// Put marks a SizedEntryRef as no longer being referred to, so that it can be
+// considered for eviction.
+func (c *ShardedLRUCache[T]) Put(r *SizedEntryRef[T]) {
+	r.lruCache.Put(r)
+	c.evict()
+}
+
+// Invalidate removes the entry associated with key from the cache, so that
+// the next Get creates a new one. If the entry is not in use, it is released
+// immediately. Otherwise, it is released once its last reference is returned
+// through Put.
+func (c *ShardedLRUCache[T]) Invalidate(key string) {
+	c.shard(key).Invalidate(key)
+}
+
+// InvalidatePrefix invalidates all the entries whose keys start with prefix.
+func (c *ShardedLRUCache[T]) InvalidatePrefix(prefix string) {
+	for _, shard := range c.shards {
+		shard.InvalidatePrefix(prefix)
+	}
+}
+
+// InvalidateAll invalidates all the entries in the cache.
+func (c *ShardedLRUCache[T]) InvalidateAll() {
+	for _, shard := range c.shards {
+		shard.InvalidateAll()
+	}
+}
+
+// EntryCount is the number of elements in the ShardedLRUCache.
+func (c *ShardedLRUCache[T]) EntryCount() int {
+	count := 0
+	for _, shard := range c.shards {
+		shard.Lock()
+		count += len(shard.mapping)
+		shard.Unlock()
+	}
+	return count
+}
+
+// Size is the total size in bytes of all the elements in the
+// ShardedLRUCache.
+func (c *ShardedLRUCache[T]) Size() Byte {
+	return Byte(atomic.LoadInt64(&c.size))
+}
+
+// EvictableSize is the size in bytes of all elements that are being considered
+// for eviction. This is, not currently being used.
+func (c *ShardedLRUCache[T]) EvictableSize() Byte {
+	return Byte(atomic.LoadInt64(&c.evictableSize))
+}
+
+// OvercommittedSize is the size in bytes that have been allocated above the
+// ShardedLRUCache's size limit. This number can be non-zero when all the
+// elements in the cache are currently being used and cannot yet be evicted.
+func (c *ShardedLRUCache[T]) OvercommittedSize() Byte {
+	return Max(
+		Byte(0),
+		Byte(c.Size().Bytes()-c.sizeLimit.Bytes()),
+	)
+}
+
+func (c *ShardedLRUCache[T]) shard(key string) *LRUCache[T] {
+	var h maphash.Hash
+	h.SetSeed(c.seed)
+	h.WriteString(key)
+	return c.shards[h.Sum64()%uint64(len(c.shards))]
+}
+
+// evict evicts entries that are not in use across all the shards until the
+// cache is within its size limit. It does not take any locks if the cache is
+// already within its size limit, or if all of its entries are in use.
+// Concurrent callers evict independently, so together they might evict a few
+// more entries than needed.
+func (c *ShardedLRUCache[T]) evict() {
+	for atomic.LoadInt64(&c.size) > c.sizeLimit.Bytes() &&
+		atomic.LoadInt64(&c.evictableSize) > 0 {
+		victim := c.chooseVictim()
+		if victim == nil {
+			// Everything is in use.
+			return
+		}
+		victim.evictOldest()
+	}
+}
+
+// chooseVictim returns the shard whose least-recently used entry that is not
+// in use is the oldest out of the next two shards that have one. Shards
+// without such an entry are skipped, so all of them are only looked at if at
+// most one has an entry to evict. It returns nil if none of them have one.
+func (c *ShardedLRUCache[T]) chooseVictim() *LRUCache[T] {
+	n := uint32(len(c.shards))
+	start := atomic.AddUint32(&c.cursor, 1)
+	var victim *LRUCache[T]
+	var victimLastUsed uint64
+	candidates := 0
+	for i := uint32(0); i < n && candidates < 2; i++ {
+		shard := c.shards[(start+i)%n]
+		lastUsed, ok := shard.oldestEvictable()
+		if !ok {
+			continue
+		}
+		candidates++
+		if victim == nil || lastUsed < victimLastUsed {
+			victim = shard
+			victimLastUsed = lastUsed
+		}
+	}
+	return victim
+}
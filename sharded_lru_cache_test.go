@@ -0,0 +1,231 @@
+package base
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestShardedLRUCache(t *testing.T) {
+	c, err := NewShardedLRUCache[*releasable](ShardedLRUCacheOptions{
+		LRUCacheOptions: LRUCacheOptions{
+			SizeLimit: Byte(4),
+		},
+		// Every eviction compares two shards, so with only two of them the
+		// entries are evicted in exact least-recently used order.
+		Shards: 2,
+	})
+	if err != nil {
+		t.Fatalf("NewShardedLRUCache() failed with %v", err)
+	}
+
+	entries := make(map[string]*releasable)
+	get := func(key string, size Byte) *SizedEntryRef[*releasable] {
+		ref, err := c.Get(key, func(key string) (*releasable, error) {
+			entries[key] = &releasable{size: size, t: t}
+			return entries[key], nil
+		})
+		if err != nil {
+			t.Fatalf("c.Get(%q) failed with %v", key, err)
+		}
+		return ref
+	}
+
+	// Fill the cache, using "k0" again so that it is no longer the oldest
+	// one.
+	for i := 0; i < 4; i++ {
+		c.Put(get(fmt.Sprintf("k%d", i), Byte(1)))
+	}
+	c.Put(get("k0", Byte(1)))
+	if c.Size() != Byte(4) || c.EvictableSize() != Byte(4) || c.EntryCount() != 4 {
+		t.Fatalf("c.Size(), c.EvictableSize(), c.EntryCount() = %d, %d, %d, want 4, 4, 4", c.Size(), c.EvictableSize(), c.EntryCount())
+	}
+
+	// Adding two more entries evicts the two least-recently used ones across
+	// all shards.
+	ref := get("k4", Byte(2))
+	if !entries["k1"].released || !entries["k2"].released {
+		t.Errorf("k1 and k2 should have been evicted")
+	}
+	if entries["k0"].released || entries["k3"].released {
+		t.Errorf("k0 and k3 should not have been evicted")
+	}
+	if c.Size() != Byte(4) || c.EvictableSize() != Byte(2) {
+		t.Errorf("c.Size(), c.EvictableSize() = %d, %d, want 4, 2", c.Size(), c.EvictableSize())
+	}
+
+	// Entries in use are never evicted, so the cache can be overcommitted.
+	big := get("k5", Byte(8))
+	if c.OvercommittedSize() != Byte(6) {
+		t.Errorf("c.OvercommittedSize() = %d, want 6", c.OvercommittedSize())
+	}
+	c.Put(ref)
+	c.Put(big)
+	if c.Size() != Byte(0) || c.OvercommittedSize() != Byte(0) {
+		t.Errorf("c.Size(), c.OvercommittedSize() = %d, %d, want 0, 0", c.Size(), c.OvercommittedSize())
+	}
+}
+
+func TestShardedLRUCacheHardLimit(t *testing.T) {
+	_, err := NewShardedLRUCache[*releasable](ShardedLRUCacheOptions{
+		LRUCacheOptions: LRUCacheOptions{
+			SizeLimit: Byte(4),
+			HardLimit: true,
+		},
+	})
+	if err == nil {
+		t.Errorf("NewShardedLRUCache() succeeded, want an error")
+	}
+}
+
+func TestShardedLRUCacheConcurrency(t *testing.T) {
+	c, err := NewShardedLRUCache[*releasable](ShardedLRUCacheOptions{
+		LRUCacheOptions: LRUCacheOptions{
+			SizeLimit: Byte(16),
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewShardedLRUCache() failed with %v", err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				ref, err := c.Get(fmt.Sprintf("k%d", (i*j)%32), func(key string) (*releasable, error) {
+					return &releasable{size: Byte(1), t: t}, nil
+				})
+				if err != nil {
+					t.Errorf("c.Get() failed with %v", err)
+					return
+				}
+				c.Put(ref)
+			}
+		}()
+	}
+	wg.Wait()
+	if c.Size() > Byte(16) {
+		t.Errorf("c.Size() = %d, want at most 16", c.Size())
+	}
+}
+
+// shardKeys returns a key with the provided prefix for every shard of the
+// cache.
+func shardKeys(c *ShardedLRUCache[*releasable], prefix string) []string {
+	keys := make([]string, len(c.shards))
+	found := 0
+	for i := 0; found < len(keys); i++ {
+		key := fmt.Sprintf("%s%d", prefix, i)
+		for j, shard := range c.shards {
+			if c.shard(key) == shard && keys[j] == "" {
+				keys[j] = key
+				found++
+			}
+		}
+	}
+	return keys
+}
+
+func TestShardedLRUCacheShardLocks(t *testing.T) {
+	c, err := NewShardedLRUCache[*releasable](ShardedLRUCacheOptions{
+		LRUCacheOptions: LRUCacheOptions{
+			SizeLimit: Byte(4),
+		},
+		Shards: 4,
+	})
+	if err != nil {
+		t.Fatalf("NewShardedLRUCache() failed with %v", err)
+	}
+	keys := shardKeys(c, "k")
+	getAndPut := func(key string) {
+		ref, err := c.Get(key, func(key string) (*releasable, error) {
+			return &releasable{size: Byte(1), t: t}, nil
+		})
+		if err != nil {
+			t.Errorf("c.Get() failed with %v", err)
+			return
+		}
+		c.Put(ref)
+	}
+	expectDone := func(done chan struct{}) {
+		t.Helper()
+		select {
+		case <-done:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("c.Get() and c.Put() blocked on the lock of another shard")
+		}
+	}
+
+	// While the cache is within its size limit, Get and Put never need the
+	// locks of the other shards.
+	for i := 1; i < len(c.shards); i++ {
+		c.shards[i].Lock()
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		getAndPut(keys[0])
+	}()
+	expectDone(done)
+	for i := 1; i < len(c.shards); i++ {
+		c.shards[i].Unlock()
+	}
+
+	// Once it is over the limit, every eviction only needs the locks of the
+	// two shards that are compared, as long as both have evictable entries.
+	for _, key := range keys[1:] {
+		getAndPut(key)
+	}
+	if c.Size() != Byte(4) || c.EvictableSize() != Byte(4) {
+		t.Fatalf("c.Size(), c.EvictableSize() = %d, %d, want 4, 4", c.Size(), c.EvictableSize())
+	}
+	c.shards[2].Lock()
+	c.shards[3].Lock()
+	atomic.StoreUint32(&c.cursor, uint32(len(c.shards)-1))
+	done = make(chan struct{})
+	go func() {
+		defer close(done)
+		getAndPut(shardKeys(c, "new")[0])
+	}()
+	expectDone(done)
+	c.shards[2].Unlock()
+	c.shards[3].Unlock()
+
+	if c.Size() != Byte(4) {
+		t.Errorf("c.Size() = %d, want 4", c.Size())
+	}
+}
+
+func BenchmarkShardedLRUCache_Parallel(b *testing.B) {
+	c, err := NewShardedLRUCache[*releasable](ShardedLRUCacheOptions{
+		LRUCacheOptions: LRUCacheOptions{
+			SizeLimit: Byte(1024),
+		},
+	})
+	if err != nil {
+		b.Fatalf("NewShardedLRUCache() failed with %v", err)
+	}
+	keys := make([]string, 512)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("k%d", i)
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			ref, err := c.Get(keys[i%len(keys)], func(key string) (*releasable, error) {
+				return &releasable{size: Byte(1)}, nil
+			})
+			if err != nil {
+				b.Fatalf("c.Get() failed with %v", err)
+			}
+			c.Put(ref)
+			i++
+		}
+	})
+}